@@ -17,19 +17,162 @@ and limitations under the License.
 package auth
 
 import (
+	"encoding/json"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // A User represents an authenticated user.
 type User struct {
-	Username string   // Username is the user's maybe-not-unique username.
-	UID      string   // UID is a unique representation of this user.
-	Groups   []string // Groups are the groups the user belongs to.
+	Username string   `json:"username"`         // Username is the user's maybe-not-unique username.
+	UID      string   `json:"uid,omitempty"`    // UID is a unique representation of this user.
+	Groups   []string `json:"groups,omitempty"` // Groups are the groups the user belongs to.
+
+	// Extra information about the user, such as the label of the token with
+	// which they authenticated.
+	Extra map[string][]string `json:"extra,omitempty"`
 }
 
-// A Generator generates a token for the given user.
+// Keys of the extra user information that describes the token with which a user
+// authenticated.
+const (
+	ExtraLabel  = "kubehook/label"
+	ExtraReason = "kubehook/reason"
+)
+
+// Sources of tokens issued to workloads rather than to users authenticated by
+// an identity proxy.
+const (
+	SourceExchange = "exchange"
+	SourceSVID     = "svid"
+)
+
+// A Generator generates a token for the given user. It returns the token, and
+// a description of the token.
 type Generator interface {
-	Generate(u *User, lifetime time.Duration) (token string, err error)
+	Generate(u *User, lifetime time.Duration, o ...GenerateOption) (token string, t *Token, err error)
+}
+
+type invalid struct{ error }
+
+// Invalid marks an error returned by a Generator as the fault of the request,
+// for example because it asks for an unsupported option or too long a lifetime.
+func Invalid(err error) error {
+	return invalid{err}
+}
+
+// IsInvalid returns true if the cause of the supplied error was marked Invalid.
+func IsInvalid(err error) bool {
+	_, ok := errors.Cause(err).(invalid)
+	return ok
+}
+
+// GenerateOptions configure the generation of a token.
+type GenerateOptions struct {
+	// Audience overrides the generator's default token audience.
+	Audience string
+
+	// NotBefore is the time at which the token becomes valid. Tokens are
+	// valid from the time they are generated if it is zero or in the past.
+	NotBefore time.Time
+
+	// OmittedGroups are groups to which the user belongs that were
+	// deliberately omitted from the token. They are recorded in the audit log.
+	OmittedGroups []string
+
+	// Label is a short name distinguishing the token from the user's other
+	// tokens, e.g. laptop.
+	Label string
+
+	// Reason describes why the token was generated.
+	Reason string
+
+	// DirectoryUsername is the name by which the user is known to the
+	// directory from which their groups are resolved, if it differs from their
+	// username.
+	DirectoryUsername string
+
+	// ResolvedGroups are the user's groups that the directory confirmed,
+	// whether or not an identity proxy also supplied them.
+	ResolvedGroups []string
+
+	// Source of the token, if it was not issued to a user authenticated by an
+	// identity proxy.
+	Source string
+}
+
+// A GenerateOption represents an optional argument to Generate.
+type GenerateOption func(*GenerateOptions)
+
+// Audience for which the token should be valid.
+func Audience(a string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.Audience = a
+	}
+}
+
+// NotBefore schedules the token to become valid at the supplied time. The
+// token's lifetime begins at this time.
+func NotBefore(t time.Time) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.NotBefore = t
+	}
+}
+
+// OmitGroups records that the supplied groups, to which the user belongs, were
+// deliberately omitted from the token.
+func OmitGroups(g ...string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.OmittedGroups = g
+	}
+}
+
+// Label the token with a short name that distinguishes it from the user's other
+// tokens.
+func Label(l string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.Label = l
+	}
+}
+
+// Reason records why the token was generated.
+func Reason(r string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.Reason = r
+	}
+}
+
+// DirectoryUsername is the name by which the user is known to the directory
+// from which their groups are resolved.
+func DirectoryUsername(u string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.DirectoryUsername = u
+	}
+}
+
+// ResolvedGroups records which of the user's groups the directory confirmed,
+// whether or not an identity proxy also supplied them.
+func ResolvedGroups(g ...string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.ResolvedGroups = g
+	}
+}
+
+// Source of the token, e.g. SourceExchange.
+func Source(s string) GenerateOption {
+	return func(o *GenerateOptions) {
+		o.Source = s
+	}
+}
+
+// NewGenerateOptions applies the supplied GenerateOptions.
+func NewGenerateOptions(o ...GenerateOption) *GenerateOptions {
+	opts := &GenerateOptions{}
+	for _, fn := range o {
+		fn(opts)
+	}
+	return opts
 }
 
 // An Authenticator authenticates a user based on a token.
@@ -42,3 +185,66 @@ type Manager interface {
 	Generator
 	Authenticator
 }
+
+// A Token describes an issued token. It never includes the token itself.
+type Token struct {
+	ID        string    `json:"id"`                  // ID uniquely identifies the token.
+	User      User      `json:"user"`                // User is the user to whom the token was issued.
+	Audience  string    `json:"audience,omitempty"`  // Audience is the audience for which the token is valid, if any.
+	IssuedAt  time.Time `json:"issuedAt"`            // IssuedAt is the time the token was issued.
+	NotBefore time.Time `json:"notBefore,omitempty"` // NotBefore is the time the token becomes valid, if not when it was issued.
+	ExpiresAt time.Time `json:"expiresAt"`           // ExpiresAt is the time the token expires.
+	LastUsed  time.Time `json:"lastUsed,omitempty"`  // LastUsed is the time the token was last authenticated.
+	Label     string    `json:"label,omitempty"`     // Label distinguishes the token from the user's other tokens, if set.
+	Reason    string    `json:"reason,omitempty"`    // Reason describes why the token was generated, if set.
+}
+
+// MarshalJSON omits NotBefore and LastUsed when they are unset, which the
+// omitempty option cannot do for a time.Time.
+func (t Token) MarshalJSON() ([]byte, error) {
+	type token Token
+	v := struct {
+		token
+		NotBefore *time.Time `json:"notBefore,omitempty"`
+		LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	}{token: token(t)}
+	if !t.NotBefore.IsZero() {
+		v.NotBefore = &t.NotBefore
+	}
+	if !t.LastUsed.IsZero() {
+		v.LastUsed = &t.LastUsed
+	}
+	return json.Marshal(v)
+}
+
+// Extra returns extra user information describing the token, suitable for
+// User.Extra. It returns nil if the token has neither a label nor a reason.
+func (t *Token) Extra() map[string][]string {
+	e := make(map[string][]string)
+	if t.Label != "" {
+		e[ExtraLabel] = []string{t.Label}
+	}
+	if t.Reason != "" {
+		e[ExtraReason] = []string{t.Reason}
+	}
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// A GroupResolver resolves the groups to which a user currently belongs, e.g.
+// by querying a directory. Users unknown to the resolver belong to no groups.
+type GroupResolver interface {
+	Groups(username string) ([]string, error)
+}
+
+// A Lister lists the unexpired tokens issued to a user.
+type Lister interface {
+	List(username string) ([]Token, error)
+}
+
+// A Revoker revokes a token issued to a user.
+type Revoker interface {
+	Revoke(username, id string) error
+}
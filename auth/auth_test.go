@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+)
+
+func TestTokenMarshalJSON(t *testing.T) {
+	issued := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		token Token
+		want  map[string]interface{}
+	}{
+		{
+			name:  "UnsetTimesOmitted",
+			token: Token{ID: "a", User: User{Username: "u"}, IssuedAt: issued, ExpiresAt: issued.Add(time.Hour)},
+			want: map[string]interface{}{
+				"id":        "a",
+				"user":      map[string]interface{}{"username": "u"},
+				"issuedAt":  "2018-01-01T00:00:00Z",
+				"expiresAt": "2018-01-01T01:00:00Z",
+			},
+		},
+		{
+			name: "SetTimesIncluded",
+			token: Token{
+				ID:        "a",
+				User:      User{Username: "u"},
+				IssuedAt:  issued,
+				NotBefore: issued.Add(time.Minute),
+				ExpiresAt: issued.Add(time.Hour),
+				LastUsed:  issued.Add(2 * time.Minute),
+			},
+			want: map[string]interface{}{
+				"id":        "a",
+				"user":      map[string]interface{}{"username": "u"},
+				"issuedAt":  "2018-01-01T00:00:00Z",
+				"notBefore": "2018-01-01T00:01:00Z",
+				"expiresAt": "2018-01-01T01:00:00Z",
+				"lastUsed":  "2018-01-01T00:02:00Z",
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.token)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+v): %v", tt.token, err)
+			}
+			got := map[string]interface{}{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s): %v", b, err)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+
+			rt := Token{}
+			if err := json.Unmarshal(b, &rt); err != nil {
+				t.Fatalf("json.Unmarshal(%s): %v", b, err)
+			}
+			if diff := deep.Equal(tt.token, rt); diff != nil {
+				t.Errorf("round trip: want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestIsInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "Invalid", err: Invalid(errors.New("boom")), want: true},
+		{name: "WrappedInvalid", err: errors.Wrap(Invalid(errors.New("boom")), "cannot generate token"), want: true},
+		{name: "NotInvalid", err: errors.New("boom")},
+		{name: "Nil"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsInvalid(tt.err); got != tt.want {
+				t.Errorf("IsInvalid(%v): want %v, got %v", tt.err, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"sync"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+)
+
+// DefaultCacheTTL is how long resolved groups are cached by default.
+const DefaultCacheTTL = time.Minute
+
+type cached struct {
+	r   auth.GroupResolver
+	ttl time.Duration
+	now func() time.Time
+
+	mx      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// Cached returns a GroupResolver that caches the groups resolved by the
+// supplied resolver for the supplied duration. Errors are not cached.
+func Cached(r auth.GroupResolver, ttl time.Duration) auth.GroupResolver {
+	return &cached{r: r, ttl: ttl, now: time.Now, entries: make(map[string]cacheEntry)}
+}
+
+func (c *cached) Groups(username string) ([]string, error) {
+	now := c.now()
+
+	c.mx.Lock()
+	e, ok := c.entries[username]
+	c.mx.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.groups, nil
+	}
+
+	gs, err := c.r.Groups(username)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.entries[username] = cacheEntry{groups: gs, expires: now.Add(c.ttl)}
+	for u, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, u)
+		}
+	}
+	return gs, nil
+}
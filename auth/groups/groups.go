@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+)
+
+// Policies with which resolved groups are merged with the groups a user
+// already has, e.g. those supplied by an authenticating proxy.
+const (
+	// MergeUnion adds resolved groups to the user's groups.
+	MergeUnion = "union"
+
+	// MergeReplace replaces the user's groups with resolved groups.
+	MergeReplace = "replace"
+
+	// MergeFallback uses resolved groups only if the user has no groups.
+	MergeFallback = "fallback"
+)
+
+// Policies with which groups may be merged.
+var Policies = []string{MergeUnion, MergeReplace, MergeFallback}
+
+type mapped struct {
+	r       auth.GroupResolver
+	mapping map[string]string
+}
+
+// Mapped returns a GroupResolver that renames the groups resolved by the
+// supplied resolver per the supplied map, e.g. from an LDAP group name to a
+// Kubernetes group name. Groups that are not in the map are not renamed.
+func Mapped(r auth.GroupResolver, mapping map[string]string) auth.GroupResolver {
+	if len(mapping) == 0 {
+		return r
+	}
+	return &mapped{r: r, mapping: mapping}
+}
+
+func (m *mapped) Groups(username string) ([]string, error) {
+	gs, err := m.r.Groups(username)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(gs))
+	for _, g := range gs {
+		if to, ok := m.mapping[g]; ok {
+			g = to
+		}
+		out = append(out, g)
+	}
+	return dedupe(out), nil
+}
+
+// An Enricher adds resolved groups to users.
+type Enricher struct {
+	// Resolver resolves the groups of users. Users are not enriched if it is
+	// nil.
+	Resolver auth.GroupResolver
+
+	// Policy determines how resolved groups are merged with the user's
+	// groups. MergeUnion is used if it is empty.
+	Policy string
+}
+
+// Enrich merges the supplied user's resolved groups with their existing groups
+// per the enricher's policy. It returns the groups the resolver confirmed, i.e.
+// those of the user's merged groups that the resolver returned, including any
+// the user already had.
+func (e Enricher) Enrich(u *auth.User) ([]string, error) {
+	if e.Resolver == nil {
+		return nil, nil
+	}
+	resolved, err := e.Resolver.Groups(u.Username)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot resolve groups of user %s", u.Username)
+	}
+	existing := nonEmpty(u.Groups)
+	switch e.Policy {
+	case MergeUnion, "":
+		u.Groups = dedupe(append(existing, resolved...))
+	case MergeReplace:
+		u.Groups = dedupe(resolved)
+	case MergeFallback:
+		if len(existing) == 0 {
+			u.Groups = dedupe(resolved)
+		}
+	default:
+		return nil, errors.Errorf("unknown group merge policy %s", e.Policy)
+	}
+	return within(dedupe(resolved), u.Groups), nil
+}
+
+// within returns the supplied groups that are also in the supplied set of
+// groups to keep.
+func within(gs, keep []string) []string {
+	k := make(map[string]bool, len(keep))
+	for _, g := range keep {
+		k[g] = true
+	}
+	out := make([]string, 0, len(gs))
+	for _, g := range gs {
+		if k[g] {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// nonEmpty returns the supplied groups, omitting empty group names.
+func nonEmpty(gs []string) []string {
+	out := make([]string, 0, len(gs))
+	for _, g := range gs {
+		if g != "" {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// dedupe returns the supplied non-empty groups in order, omitting duplicates.
+func dedupe(gs []string) []string {
+	seen := make(map[string]bool, len(gs))
+	out := make([]string, 0, len(gs))
+	for _, g := range nonEmpty(gs) {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		out = append(out, g)
+	}
+	return out
+}
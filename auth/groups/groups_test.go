@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/planetlabs/kubehook/auth"
+)
+
+type broken struct{}
+
+func (b broken) Groups(username string) ([]string, error) {
+	return nil, errors.New("boom")
+}
+
+func TestEnrich(t *testing.T) {
+	r := NewStatic(&Users{Users: map[string][]string{"alice": {"developers", "admins"}}})
+
+	cases := []struct {
+		name     string
+		e        Enricher
+		username string
+		groups   []string
+		want     []string
+		resolved []string
+		wantErr  bool
+	}{
+		{
+			name:     "NoResolver",
+			username: "alice",
+			groups:   []string{""},
+			want:     []string{""},
+		},
+		{
+			name:     "Union",
+			e:        Enricher{Resolver: r, Policy: MergeUnion},
+			username: "alice",
+			groups:   []string{"users", "developers"},
+			want:     []string{"users", "developers", "admins"},
+			resolved: []string{"developers", "admins"},
+		},
+		{
+			name:     "UnionByDefault",
+			e:        Enricher{Resolver: r},
+			username: "alice",
+			groups:   []string{""},
+			want:     []string{"developers", "admins"},
+			resolved: []string{"developers", "admins"},
+		},
+		{
+			name:     "Replace",
+			e:        Enricher{Resolver: r, Policy: MergeReplace},
+			username: "alice",
+			groups:   []string{"users"},
+			want:     []string{"developers", "admins"},
+			resolved: []string{"developers", "admins"},
+		},
+		{
+			name:     "FallbackUnused",
+			e:        Enricher{Resolver: r, Policy: MergeFallback},
+			username: "alice",
+			groups:   []string{"users"},
+			want:     []string{"users"},
+			resolved: []string{},
+		},
+		{
+			name:     "FallbackConfirms",
+			e:        Enricher{Resolver: r, Policy: MergeFallback},
+			username: "alice",
+			groups:   []string{"users", "admins"},
+			want:     []string{"users", "admins"},
+			resolved: []string{"admins"},
+		},
+		{
+			name:     "FallbackUsed",
+			e:        Enricher{Resolver: r, Policy: MergeFallback},
+			username: "alice",
+			groups:   []string{""},
+			want:     []string{"developers", "admins"},
+			resolved: []string{"developers", "admins"},
+		},
+		{
+			name:     "UnknownUser",
+			e:        Enricher{Resolver: r, Policy: MergeReplace},
+			username: "bob",
+			groups:   []string{"users"},
+			want:     []string{},
+			resolved: []string{},
+		},
+		{
+			name:     "Mapped",
+			e:        Enricher{Resolver: Mapped(r, map[string]string{"admins": "cluster-admins", "developers": "users"}), Policy: MergeUnion},
+			username: "alice",
+			groups:   []string{"users"},
+			want:     []string{"users", "cluster-admins"},
+			resolved: []string{"users", "cluster-admins"},
+		},
+		{
+			name:     "ResolverError",
+			e:        Enricher{Resolver: broken{}},
+			username: "alice",
+			wantErr:  true,
+		},
+		{
+			name:     "UnknownPolicy",
+			e:        Enricher{Resolver: r, Policy: "intersect"},
+			username: "alice",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &auth.User{Username: tt.username, Groups: tt.groups}
+			resolved, err := tt.e.Enrich(u)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("e.Enrich(...): %v", err)
+			}
+			if tt.wantErr {
+				t.Fatalf("e.Enrich(...): want error, got nil")
+			}
+			if diff := deep.Equal(tt.want, u.Groups); diff != nil {
+				t.Errorf("e.Enrich(...): want != got: %v", diff)
+			}
+			if diff := deep.Equal(tt.resolved, resolved); diff != nil {
+				t.Errorf("e.Enrich(...): want resolved != got resolved: %v", diff)
+			}
+		})
+	}
+}
+
+func TestLoadStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "users.yaml")
+	if err := ioutil.WriteFile(f, []byte("users:\n  alice: [admins, developers]\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	r, err := LoadStatic(f)
+	if err != nil {
+		t.Fatalf("LoadStatic(%v): %v", f, err)
+	}
+	got, err := r.Groups("alice")
+	if err != nil {
+		t.Fatalf("r.Groups(alice): %v", err)
+	}
+	if diff := deep.Equal([]string{"admins", "developers"}, got); diff != nil {
+		t.Errorf("r.Groups(alice): want != got: %v", diff)
+	}
+
+	if err := ioutil.WriteFile(f, []byte("users: [alice]\n"), 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile(): %v", err)
+	}
+	if _, err := LoadStatic(f); err == nil {
+		t.Errorf("LoadStatic(%v): want error for invalid users, got nil", f)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("username") {
+		case "alice":
+			json.NewEncoder(w).Encode(map[string][]string{"groups": {"admins"}}) // nolint: gosec
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	cases := []struct {
+		name     string
+		username string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "KnownUser", username: "alice", want: []string{"admins"}},
+		{name: "UnknownUser", username: "bob"},
+		{name: "ServerError", username: "broken", wantErr: true},
+	}
+
+	r, err := NewHTTP(s.Client(), s.URL+"/groups")
+	if err != nil {
+		t.Fatalf("NewHTTP(...): %v", err)
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Groups(tt.username)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("r.Groups(%q): %v", tt.username, err)
+			}
+			if tt.wantErr {
+				t.Fatalf("r.Groups(%q): want error, got %v", tt.username, got)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("r.Groups(%q): want != got: %v", tt.username, diff)
+			}
+		})
+	}
+
+	if _, err := NewHTTP(http.DefaultClient, "ftp://example.org"); err == nil {
+		t.Errorf("NewHTTP(ftp://example.org): want error, got nil")
+	}
+}
+
+type counter struct {
+	calls int
+	err   error
+}
+
+func (c *counter) Groups(username string) ([]string, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []string{username}, nil
+}
+
+func TestCached(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	cr := &counter{}
+	r := Cached(cr, time.Minute)
+	r.(*cached).now = func() time.Time { return now }
+
+	resolve := func(username string, wantCalls int) {
+		t.Helper()
+		got, err := r.Groups(username)
+		if err != nil {
+			t.Fatalf("r.Groups(%v): %v", username, err)
+		}
+		if diff := deep.Equal([]string{username}, got); diff != nil {
+			t.Errorf("r.Groups(%v): want != got: %v", username, diff)
+		}
+		if cr.calls != wantCalls {
+			t.Errorf("r.Groups(%v): want %d calls to resolver, got %d", username, wantCalls, cr.calls)
+		}
+	}
+
+	resolve("alice", 1)
+	resolve("alice", 1)
+	resolve("bob", 2)
+
+	now = now.Add(time.Minute)
+	resolve("alice", 3)
+
+	cr.err = errors.New("boom")
+	now = now.Add(time.Minute)
+	if _, err := r.Groups("alice"); err == nil {
+		t.Errorf("r.Groups(alice): want error, got nil")
+	}
+	if _, err := r.Groups("alice"); err == nil || cr.calls != 5 {
+		t.Errorf("r.Groups(alice): want uncached error, got %v after %d calls", err, cr.calls)
+	}
+}
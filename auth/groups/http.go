@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+)
+
+// queryParamUsername is the query parameter in which the HTTP resolver sends
+// the username whose groups it is resolving.
+const queryParamUsername = "username"
+
+type httpRsp struct {
+	Groups []string `json:"groups"`
+}
+
+type httpResolver struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewHTTP returns a GroupResolver that resolves groups by sending a GET request
+// to the supplied endpoint, with the username in the username query parameter.
+// The endpoint must respond with a JSON object whose groups field lists the
+// user's groups, e.g. {"groups": ["admins"]}, or with HTTP 404 if the user is
+// unknown.
+func NewHTTP(c *http.Client, endpoint string) (auth.GroupResolver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse group resolver URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("group resolver URL %s must use https or http", endpoint)
+	}
+	return &httpResolver{client: c, endpoint: endpoint}, nil
+}
+
+func (h *httpResolver) Groups(username string) ([]string, error) {
+	u, _ := url.Parse(h.endpoint) // Parsed by NewHTTP.
+	q := u.Query()
+	q.Set(queryParamUsername, username)
+	u.RawQuery = q.Encode()
+
+	r, err := h.client.Get(u.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot request groups")
+	}
+	defer r.Body.Close()
+
+	switch r.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("cannot request groups: %s", r.Status)
+	}
+	rsp := &httpRsp{}
+	if err := json.NewDecoder(r.Body).Decode(rsp); err != nil {
+		return nil, errors.Wrap(err, "cannot parse groups response")
+	}
+	return rsp.Groups, nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"text/template"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+	"gopkg.in/ldap.v2"
+)
+
+// Defaults for LDAP group resolution.
+const (
+	DefaultLDAPFilter    = "(&(objectClass=posixGroup)(memberUid={{.Username}}))"
+	DefaultLDAPAttribute = "cn"
+	DefaultLDAPTimeout   = 5 * time.Second
+)
+
+type ldapResolver struct {
+	url          *url.URL
+	tls          *tls.Config
+	startTLS     bool
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	filter       *template.Template
+	attribute    string
+	timeout      time.Duration
+}
+
+// An LDAPOption represents an optional argument to NewLDAP.
+type LDAPOption func(*ldapResolver) error
+
+// Bind to the LDAP server with the supplied DN and password before searching.
+// The resolver searches anonymously by default. Binding requires either an
+// ldaps:// URL or StartTLS, so that the password is never sent in the clear.
+func Bind(dn, password string) LDAPOption {
+	return func(r *ldapResolver) error {
+		r.bindDN = dn
+		r.bindPassword = password
+		return nil
+	}
+}
+
+// StartTLS upgrades ldap:// connections to TLS before binding or searching.
+func StartTLS() LDAPOption {
+	return func(r *ldapResolver) error {
+		r.startTLS = true
+		return nil
+	}
+}
+
+// Filter used to search for the groups of which a user is a member. The filter
+// is a text/template rendered with the escaped username, e.g.
+// (&(objectClass=groupOfNames)(member=uid={{.Username}},ou=people,dc=example,dc=org))
+func Filter(f string) LDAPOption {
+	return func(r *ldapResolver) error {
+		t, err := template.New("filter").Option("missingkey=error").Parse(f)
+		if err != nil {
+			return errors.Wrap(err, "cannot parse LDAP filter template")
+		}
+		r.filter = t
+		return nil
+	}
+}
+
+// Attribute of each group entry that contains the group's name.
+func Attribute(a string) LDAPOption {
+	return func(r *ldapResolver) error {
+		r.attribute = a
+		return nil
+	}
+}
+
+// Timeout of each LDAP request.
+func Timeout(t time.Duration) LDAPOption {
+	return func(r *ldapResolver) error {
+		r.timeout = t
+		return nil
+	}
+}
+
+// CA certificates used to verify the LDAP server, in PEM format. The system's
+// certificates are used by default.
+func CA(pem []byte) LDAPOption {
+	return func(r *ldapResolver) error {
+		p := x509.NewCertPool()
+		if !p.AppendCertsFromPEM(pem) {
+			return errors.New("cannot parse LDAP CA certificates")
+		}
+		r.tls.RootCAs = p
+		return nil
+	}
+}
+
+// NewLDAP returns a GroupResolver that searches the supplied base DN of the
+// LDAP server at the supplied ldap:// or ldaps:// URL for the groups of which a
+// user is a member.
+func NewLDAP(server, baseDN string, o ...LDAPOption) (auth.GroupResolver, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse LDAP URL")
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, errors.Errorf("LDAP URL %s must use ldap or ldaps", server)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("LDAP URL %s has no host", server)
+	}
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	r := &ldapResolver{
+		url:       u,
+		tls:       &tls.Config{ServerName: u.Hostname()},
+		baseDN:    baseDN,
+		attribute: DefaultLDAPAttribute,
+		timeout:   DefaultLDAPTimeout,
+	}
+	if err := Filter(DefaultLDAPFilter)(r); err != nil {
+		return nil, err
+	}
+	for _, fn := range o {
+		if err := fn(r); err != nil {
+			return nil, errors.Wrap(err, "cannot apply LDAP option")
+		}
+	}
+	if r.startTLS && u.Scheme == "ldaps" {
+		return nil, errors.Errorf("cannot StartTLS with ldaps URL %s", server)
+	}
+	if r.bindDN != "" && u.Scheme != "ldaps" && !r.startTLS {
+		return nil, errors.Errorf("refusing to bind to LDAP URL %s without ldaps or StartTLS", server)
+	}
+	if _, err := r.search("user"); err != nil {
+		return nil, errors.Wrap(err, "invalid LDAP filter")
+	}
+	return r, nil
+}
+
+// search returns the search request for the groups of the supplied user.
+func (r *ldapResolver) search(username string) (*ldap.SearchRequest, error) {
+	b := &bytes.Buffer{}
+	if err := r.filter.Execute(b, struct{ Username string }{ldap.EscapeFilter(username)}); err != nil {
+		return nil, err
+	}
+	if _, err := ldap.CompileFilter(b.String()); err != nil {
+		return nil, err
+	}
+	return ldap.NewSearchRequest(r.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(r.timeout/time.Second), false, b.String(), []string{r.attribute}, nil), nil
+}
+
+func (r *ldapResolver) dial() (*ldap.Conn, error) {
+	c, err := net.DialTimeout("tcp", r.url.Host, r.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.url.Scheme == "ldaps" {
+		c = tls.Client(c, r.tls)
+	}
+	l := ldap.NewConn(c, r.url.Scheme == "ldaps")
+	l.SetTimeout(r.timeout)
+	l.Start()
+	if r.startTLS {
+		if err := l.StartTLS(r.tls); err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "cannot StartTLS")
+		}
+	}
+	return l, nil
+}
+
+func (r *ldapResolver) Groups(username string) ([]string, error) {
+	req, err := r.search(username)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot build LDAP search")
+	}
+
+	l, err := r.dial()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot connect to LDAP server %s", r.url.Host)
+	}
+	defer l.Close()
+
+	if r.bindDN != "" {
+		if err := l.Bind(r.bindDN, r.bindPassword); err != nil {
+			return nil, errors.Wrapf(err, "cannot bind to LDAP server as %s", r.bindDN)
+		}
+	}
+	rsp, err := l.Search(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search LDAP server")
+	}
+	gs := make([]string, 0, len(rsp.Entries))
+	for _, e := range rsp.Entries {
+		gs = append(gs, e.GetAttributeValues(r.attribute)...)
+	}
+	return gs, nil
+}
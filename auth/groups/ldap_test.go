@@ -0,0 +1,290 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	baseDN       = "dc=example,dc=org"
+	bindDN       = "cn=kubehook,dc=example,dc=org"
+	bindPassword = "secret"
+)
+
+// ldapServer is a minimal in-process LDAP server. It supports StartTLS, simple
+// binds, and searches whose filter exactly matches one of its results.
+type ldapServer struct {
+	l       net.Listener
+	tls     *tls.Config
+	ca      []byte
+	results map[string][]*ldap.Entry
+}
+
+func newLDAPServer(t *testing.T, results map[string][]*ldap.Entry) *ldapServer {
+	cert, ca := selfSigned(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): %v", err)
+	}
+	s := &ldapServer{l: l, tls: &tls.Config{Certificates: []tls.Certificate{cert}}, ca: ca, results: results}
+	go s.serve()
+	return s
+}
+
+// selfSigned returns a certificate valid for 127.0.0.1, and the same
+// certificate in PEM format for use as a CA.
+func selfSigned(t *testing.T) (tls.Certificate, []byte) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(): %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func (s *ldapServer) URL() string {
+	return "ldap://" + s.l.Addr().String()
+}
+
+func (s *ldapServer) Close() {
+	s.l.Close() // nolint: gosec
+}
+
+func (s *ldapServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *ldapServer) handle(c net.Conn) {
+	defer func() { c.Close() }()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		req := p.Children[1]
+		switch req.Tag {
+		case ldap.ApplicationExtendedRequest:
+			c.Write(response(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes()) // nolint: gosec
+			c = tls.Server(c, s.tls)
+		case ldap.ApplicationBindRequest:
+			code := ldap.LDAPResultSuccess
+			if req.Children[1].Value.(string) != bindDN || req.Children[2].Data.String() != bindPassword {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			c.Write(response(id, ldap.ApplicationBindResponse, code).Bytes()) // nolint: gosec
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(req.Children[6])
+			if err != nil {
+				return
+			}
+			for _, e := range s.results[filter] {
+				c.Write(entry(id, e).Bytes()) // nolint: gosec
+			}
+			c.Write(response(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes()) // nolint: gosec
+		default:
+			return
+		}
+	}
+}
+
+func message(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	p.AppendChild(op)
+	return p
+}
+
+func response(id int64, tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return message(id, op)
+}
+
+func entry(id int64, e *ldap.Entry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, a := range e.Attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a.Name, "Type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range a.Values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return message(id, op)
+}
+
+func TestLDAP(t *testing.T) {
+	s := newLDAPServer(t, map[string][]*ldap.Entry{
+		"(&(objectClass=posixGroup)(memberUid=alice))": {
+			ldap.NewEntry("cn=admins,ou=groups,dc=example,dc=org", map[string][]string{"cn": {"admins"}}),
+			ldap.NewEntry("cn=developers,ou=groups,dc=example,dc=org", map[string][]string{"cn": {"developers"}}),
+		},
+		"(&(objectClass=groupOfNames)(member=uid=bob,ou=people,dc=example,dc=org))": {
+			ldap.NewEntry("cn=sre,ou=groups,dc=example,dc=org", map[string][]string{"cn": {"sre"}}),
+		},
+		`(&(objectClass=posixGroup)(memberUid=\2a))`: {
+			ldap.NewEntry("cn=everyone,ou=groups,dc=example,dc=org", map[string][]string{"cn": {"everyone"}}),
+		},
+	})
+	defer s.Close()
+
+	cases := []struct {
+		name     string
+		opts     []LDAPOption
+		username string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "DefaultFilter",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca), Bind(bindDN, bindPassword)},
+			username: "alice",
+			want:     []string{"admins", "developers"},
+		},
+		{
+			name:     "CustomFilter",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca), Bind(bindDN, bindPassword), Filter("(&(objectClass=groupOfNames)(member=uid={{.Username}},ou=people,dc=example,dc=org))")},
+			username: "bob",
+			want:     []string{"sre"},
+		},
+		{
+			name:     "EscapedUsername",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca), Bind(bindDN, bindPassword)},
+			username: "*",
+			want:     []string{"everyone"},
+		},
+		{
+			name:     "UnknownUser",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca), Bind(bindDN, bindPassword)},
+			username: "carol",
+			want:     []string{},
+		},
+		{
+			name:     "Anonymous",
+			username: "alice",
+			want:     []string{"admins", "developers"},
+		},
+		{
+			name:     "AnonymousStartTLS",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca)},
+			username: "alice",
+			want:     []string{"admins", "developers"},
+		},
+		{
+			name:     "UntrustedServer",
+			opts:     []LDAPOption{StartTLS()},
+			username: "alice",
+			wantErr:  true,
+		},
+		{
+			name:     "InvalidCredentials",
+			opts:     []LDAPOption{StartTLS(), CA(s.ca), Bind(bindDN, "wrong")},
+			username: "alice",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewLDAP(s.URL(), baseDN, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewLDAP(...): %v", err)
+			}
+			got, err := r.Groups(tt.username)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("r.Groups(%q): %v", tt.username, err)
+			}
+			if tt.wantErr {
+				t.Fatalf("r.Groups(%q): want error, got %v", tt.username, got)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("r.Groups(%q): want != got: %v", tt.username, diff)
+			}
+		})
+	}
+}
+
+func TestNewLDAP(t *testing.T) {
+	cases := []struct {
+		name   string
+		server string
+		opts   []LDAPOption
+	}{
+		{name: "NotLDAP", server: "https://ldap.example.org"},
+		{name: "NoHost", server: "ldap://"},
+		{name: "InvalidTemplate", server: "ldap://ldap.example.org", opts: []LDAPOption{Filter("(uid={{.Username)")}},
+		{name: "InvalidFilter", server: "ldap://ldap.example.org", opts: []LDAPOption{Filter("uid={{.Username}}")}},
+		{name: "UnknownField", server: "ldap://ldap.example.org", opts: []LDAPOption{Filter("(uid={{.User}})")}},
+		{name: "BindWithoutTLS", server: "ldap://ldap.example.org", opts: []LDAPOption{Bind(bindDN, bindPassword)}},
+		{name: "StartTLSWithLDAPS", server: "ldaps://ldap.example.org", opts: []LDAPOption{StartTLS()}},
+		{name: "InvalidCA", server: "ldaps://ldap.example.org", opts: []LDAPOption{CA([]byte("not a certificate"))}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewLDAP(tt.server, baseDN, tt.opts...); err == nil {
+				t.Errorf("NewLDAP(%q, ...): want error, got nil", tt.server)
+			}
+		})
+	}
+}
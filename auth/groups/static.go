@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package groups
+
+import (
+	"io/ioutil"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Users maps usernames to the groups to which they belong.
+type Users struct {
+	Users map[string][]string `json:"users"`
+}
+
+type static struct {
+	users map[string][]string
+}
+
+// NewStatic returns a GroupResolver that resolves the groups of the supplied
+// users.
+func NewStatic(u *Users) auth.GroupResolver {
+	return &static{users: u.Users}
+}
+
+// LoadStatic returns a GroupResolver that resolves the groups of the users
+// in the supplied YAML file, e.g. users: {alice: [admins, developers]}
+func LoadStatic(filename string) (auth.GroupResolver, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read users from %v", filename)
+	}
+	u := &Users{}
+	if err := yaml.Unmarshal(b, u); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse users from %v", filename)
+	}
+	return NewStatic(u), nil
+}
+
+func (s *static) Groups(username string) ([]string, error) {
+	return s.users[username], nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package jwt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JWE tokens are encrypted directly with a shared symmetric key using AES GCM,
+// per RFC 7516 and RFC 7518 sections 4.5 and 5.3. The signed JWT is the JWE
+// plaintext; i.e. tokens are signed then encrypted.
+const (
+	jweAlgorithm   = "dir"
+	jweEncryption  = "A256GCM"
+	jweContentType = "JWT"
+	jweParts       = 5
+	jweIVSize      = 12
+	jweTagSize     = 16
+)
+
+// encryptionKeyInfo distinguishes the derived encryption key from the signing
+// secret from which it is derived.
+const encryptionKeyInfo = "github.com/planetlabs/kubehook/jwe/A256GCM"
+
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	ContentType string `json:"cty,omitempty"`
+}
+
+// deriveEncryptionKey derives a 256 bit encryption key from the signing secret,
+// such that the encryption and signing keys are rotated together.
+func deriveEncryptionKey(secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(encryptionKeyInfo)) // nolint: gosec
+	return h.Sum(nil)
+}
+
+func isJWE(token string) bool {
+	return strings.Count(token, ".") == jweParts-1
+}
+
+func encrypt(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := json.Marshal(jweHeader{Algorithm: jweAlgorithm, Encryption: jweEncryption, ContentType: jweContentType})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal JWE header")
+	}
+	protected := base64.RawURLEncoding.EncodeToString(h)
+
+	iv := make([]byte, jweIVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", errors.Wrap(err, "cannot generate JWE initialization vector")
+	}
+
+	sealed := gcm.Seal(nil, iv, []byte(plaintext), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-jweTagSize], sealed[len(sealed)-jweTagSize:]
+
+	// The encrypted key is empty when using direct encryption.
+	return strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+func decrypt(key []byte, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != jweParts {
+		return "", errors.Errorf("JWE must have %d parts", jweParts)
+	}
+	protected, encryptedKey := parts[0], parts[1]
+
+	b, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decode JWE header")
+	}
+	h := &jweHeader{}
+	if err := json.Unmarshal(b, h); err != nil {
+		return "", errors.Wrap(err, "cannot parse JWE header")
+	}
+	if h.Algorithm != jweAlgorithm || h.Encryption != jweEncryption || encryptedKey != "" {
+		return "", errors.Errorf("JWE must use alg %s and enc %s", jweAlgorithm, jweEncryption)
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != jweIVSize {
+		return "", errors.New("invalid JWE initialization vector")
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decode JWE ciphertext")
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(tag) != jweTagSize {
+		return "", errors.New("invalid JWE authentication tag")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(protected))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decrypt JWE")
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create AES cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.Wrap(err, "cannot create AES GCM cipher")
+}
@@ -17,6 +17,8 @@ and limitations under the License.
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"time"
 
@@ -31,13 +33,21 @@ import (
 const (
 	DefaultAudience    = "github.com/planetlabs/kubehook"
 	DefaultMaxLifetime = 7 * 24 * time.Hour
+	DefaultMaxSchedule = 7 * 24 * time.Hour
 )
 
+// idBytes is the number of random bytes in a JWT ID.
+const idBytes = 16
+
 type jwtm struct {
 	log         *zap.Logger
 	secret      []byte
 	audience    string
 	maxLifetime time.Duration
+	maxSchedule time.Duration
+	encryptKey  []byte
+	resolver    auth.GroupResolver
+	failOpen    bool
 }
 
 // An Option represents an optional argument to NewBackend
@@ -67,13 +77,61 @@ func MaxLifetime(d time.Duration) Option {
 	}
 }
 
+// MaxSchedule is how far in the future generated tokens may be scheduled to
+// become valid. Tokens may not be scheduled if it is zero.
+func MaxSchedule(d time.Duration) Option {
+	return func(f *jwtm) error {
+		f.maxSchedule = d
+		return nil
+	}
+}
+
+// Encrypt generated tokens using JSON Web Encryption (JWE), such that their
+// bearers cannot read their claims. The encryption key is derived from the
+// signing secret, and is thus rotated along with it. Tokens that are signed but
+// not encrypted continue to be authenticated, to allow tokens issued before
+// encryption was enabled to be used until they expire.
+func Encrypt() Option {
+	return func(f *jwtm) error {
+		f.encryptKey = deriveEncryptionKey(f.secret)
+		return nil
+	}
+}
+
+// ResolveGroups re-resolves the current groups of each token's subject using
+// the supplied resolver at authentication time. Authenticated users lose any
+// group in their token that the resolver confirmed when the token was generated
+// but no longer resolves, such that users removed from a group lose it before
+// their tokens expire. Groups the resolver did not confirm, i.e. those supplied
+// only by the identity proxy, are kept. Subjects are
+// resolved by the name their groups were resolved by when the token was
+// generated, which may differ from their normalized username. Tokens with a
+// source, such as those exchanged for service account tokens, are not
+// re-resolved because their groups were not resolved. The resolver is consulted
+// for every request, and should typically be cached.
+func ResolveGroups(r auth.GroupResolver) Option {
+	return func(f *jwtm) error {
+		f.resolver = r
+		return nil
+	}
+}
+
+// FailOpen authenticates users with the groups in their token when their
+// current groups cannot be resolved. Authentication fails by default.
+func FailOpen() Option {
+	return func(f *jwtm) error {
+		f.failOpen = true
+		return nil
+	}
+}
+
 // NewManager generates and authenticates JSON Web Tokens (JWTs).
 func NewManager(secret []byte, mo ...Option) (auth.Manager, error) {
 	l, err := zap.NewProduction()
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot create default logger")
 	}
-	m := &jwtm{log: l, secret: secret, audience: DefaultAudience, maxLifetime: DefaultMaxLifetime}
+	m := &jwtm{log: l, secret: secret, audience: DefaultAudience, maxLifetime: DefaultMaxLifetime, maxSchedule: DefaultMaxSchedule}
 	for _, o := range mo {
 		if err := o(m); err != nil {
 			return nil, errors.Wrap(err, "cannot apply JWT manager option")
@@ -83,11 +141,31 @@ func NewManager(secret []byte, mo ...Option) (auth.Manager, error) {
 }
 
 type claims struct {
-	Groups []string `json:"grp,omitempty"`
+	UserID    string   `json:"uid,omitempty"`
+	Groups    []string `json:"grp,omitempty"`
+	Label     string   `json:"lbl,omitempty"`
+	Reason    string   `json:"rsn,omitempty"`
+	Directory string   `json:"dir,omitempty"`
+	Resolved  []string `json:"rgp,omitempty"`
+	Source    string   `json:"src,omitempty"`
 	jwt.StandardClaims
 }
 
+// DirectoryUsername returns the name by which the token's subject is known to
+// the directory from which their groups are resolved.
+func (c *claims) DirectoryUsername() string {
+	if c.Directory != "" {
+		return c.Directory
+	}
+	return c.Subject
+}
+
+// UID returns the user's UID, if one was supplied when the token was generated,
+// or otherwise a UID derived from the token's audience and subject.
 func (c *claims) UID() string {
+	if c.UserID != "" {
+		return c.UserID
+	}
 	return fmt.Sprintf("%s/%s", c.Audience, c.Subject)
 }
 
@@ -99,6 +177,15 @@ func isHMACSigned(t *jwt.Token) bool {
 func (m *jwtm) Authenticate(token string) (*auth.User, error) {
 	log := m.log.With(zap.String("jwt", token))
 
+	if m.encryptKey != nil && isJWE(token) {
+		var err error
+		token, err = decrypt(m.encryptKey, token)
+		if err != nil {
+			log.Info("auth", zap.Bool("success", false))
+			return nil, errors.Wrap(err, "invalid JWE token")
+		}
+	}
+
 	t, err := jwt.ParseWithClaims(token, &claims{}, func(t *jwt.Token) (interface{}, error) {
 		if !isHMACSigned(t) {
 			return nil, errors.Errorf("token must be HMAC signed JWT")
@@ -120,37 +207,165 @@ func (m *jwtm) Authenticate(token string) (*auth.User, error) {
 		return nil, errors.Errorf("invalid JWT audience %s - audience %s is required", c.Audience, m.audience)
 	}
 
+	groups := c.Groups
+	if m.resolver != nil && c.Source == "" && len(c.Resolved) > 0 {
+		groups, err = m.currentGroups(log, c.DirectoryUsername(), c.Groups, c.Resolved)
+		if err != nil {
+			log.Info("auth", zap.Bool("success", false), zap.Error(err))
+			return nil, err
+		}
+	}
+
 	log.Info("auth", zap.Bool("success", true))
-	return &auth.User{Username: c.Subject, UID: c.UID(), Groups: c.Groups}, nil
+	return &auth.User{Username: c.Subject, UID: c.UID(), Groups: groups, Extra: c.token().Extra()}, nil
+}
+
+// currentGroups returns the supplied groups, omitting those that were resolved
+// when the token was generated but of which the supplied user is no longer a
+// member.
+func (m *jwtm) currentGroups(log *zap.Logger, username string, groups, resolvedAtGenerate []string) ([]string, error) {
+	resolved, err := m.resolver.Groups(username)
+	if err != nil {
+		if m.failOpen {
+			log.Info("cannot resolve current groups - using token groups", zap.Error(err))
+			return groups, nil
+		}
+		return nil, errors.Wrapf(err, "cannot resolve current groups of user %s", username)
+	}
+
+	current := make(map[string]bool, len(resolved))
+	for _, g := range resolved {
+		current[g] = true
+	}
+	recheck := make(map[string]bool, len(resolvedAtGenerate))
+	for _, g := range resolvedAtGenerate {
+		recheck[g] = true
+	}
+	kept := make([]string, 0, len(groups))
+	removed := make([]string, 0)
+	for _, g := range groups {
+		if !recheck[g] || current[g] {
+			kept = append(kept, g)
+			continue
+		}
+		removed = append(removed, g)
+	}
+	if len(removed) > 0 {
+		log.Info("groups revoked since token was generated", zap.Strings("removedGroups", removed))
+	}
+	return kept, nil
 }
 
-func (m *jwtm) Generate(u *auth.User, lifetime time.Duration) (string, error) {
+func (m *jwtm) Generate(u *auth.User, lifetime time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	opts := auth.NewGenerateOptions(o...)
+	aud := m.audience
+	if opts.Audience != "" {
+		aud = opts.Audience
+	}
+
+	now := time.Now().UTC()
+	nbf := now
+	if opts.NotBefore.After(now) {
+		nbf = opts.NotBefore.UTC()
+	}
+
 	log := m.log.With(
 		zap.String("user", u.Username),
 		zap.String("uid", u.UID),
 		zap.Strings("groups", u.Groups),
-		zap.Duration("lifetime", lifetime))
+		zap.Strings("omittedGroups", opts.OmittedGroups),
+		zap.String("label", opts.Label),
+		zap.String("reason", opts.Reason),
+		zap.String("source", opts.Source),
+		zap.Duration("lifetime", lifetime),
+		zap.String("audience", aud),
+		zap.Time("notBefore", nbf))
 
 	if lifetime > m.maxLifetime {
 		log.Info("generate", zap.Bool("success", false))
-		return "", errors.Errorf("requested JWT lifetime %s is greater than maximum allowed lifetime %s", lifetime, m.maxLifetime)
+		return "", nil, auth.Invalid(errors.Errorf("requested JWT lifetime %s is greater than maximum allowed lifetime %s", lifetime, m.maxLifetime))
+	}
+	if nbf.Sub(now) > m.maxSchedule {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, auth.Invalid(errors.Errorf("requested JWT not-before time %s is more than the maximum allowed %s in the future", nbf.Format(time.RFC3339), m.maxSchedule))
+	}
+
+	id, err := newID()
+	if err != nil {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, errors.Wrap(err, "cannot generate JWT ID")
 	}
 
 	c := &claims{
 		StandardClaims: jwt.StandardClaims{
-			Audience:  m.audience,
+			Id:        id,
+			Audience:  aud,
 			Subject:   u.Username,
-			NotBefore: time.Now().UTC().Unix(),
-			ExpiresAt: time.Now().UTC().Add(lifetime).Unix(),
+			IssuedAt:  now.Unix(),
+			NotBefore: nbf.Unix(),
+			ExpiresAt: nbf.Add(lifetime).Unix(),
 		},
+		UserID: u.UID,
 		Groups: u.Groups,
+		Label:  opts.Label,
+		Reason: opts.Reason,
+		Source: opts.Source,
 	}
+	if opts.DirectoryUsername != u.Username {
+		c.Directory = opts.DirectoryUsername
+	}
+	c.Resolved = intersect(opts.ResolvedGroups, u.Groups)
 
 	ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(m.secret)
 	if err != nil {
 		log.Info("generate", zap.Bool("success", false))
-		return "", errors.Wrap(err, "cannot generate JWT")
+		return "", nil, errors.Wrap(err, "cannot generate JWT")
+	}
+	if m.encryptKey != nil {
+		ss, err = encrypt(m.encryptKey, ss)
+		if err != nil {
+			log.Info("generate", zap.Bool("success", false))
+			return "", nil, errors.Wrap(err, "cannot encrypt JWT")
+		}
+	}
+	log.Info("generate", zap.Bool("success", true), zap.String("id", id))
+	return ss, c.token(), nil
+}
+
+// token describes the token with these claims.
+func (c *claims) token() *auth.Token {
+	return &auth.Token{
+		ID:        c.Id,
+		User:      auth.User{Username: c.Subject, UID: c.UID(), Groups: c.Groups},
+		Audience:  c.Audience,
+		IssuedAt:  time.Unix(c.IssuedAt, 0).UTC(),
+		NotBefore: time.Unix(c.NotBefore, 0).UTC(),
+		ExpiresAt: time.Unix(c.ExpiresAt, 0).UTC(),
+		Label:     c.Label,
+		Reason:    c.Reason,
+	}
+}
+
+// intersect returns the groups in a that are also in b.
+func intersect(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, g := range b {
+		in[g] = true
+	}
+	var out []string
+	for _, g := range a {
+		if in[g] {
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// newID returns a random JWT ID.
+func newID() (string, error) {
+	b := make([]byte, idBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	log.Info("generate", zap.Bool("success", true))
-	return ss, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
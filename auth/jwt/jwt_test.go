@@ -18,12 +18,16 @@ package jwt
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
 	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
+	"github.com/planetlabs/kubehook/auth/normalize"
 )
 
 var secret = []byte("secret!")
@@ -131,6 +135,13 @@ func TestGenerate(t *testing.T) {
 			lifetime: DefaultMaxLifetime,
 			wantErr:  false,
 		},
+		{
+			name:     "SuppliedUID",
+			secret:   secret,
+			user:     &auth.User{Username: "negz", UID: "00u1a2b3c4"},
+			lifetime: DefaultMaxLifetime,
+			wantErr:  false,
+		},
 		{
 			name:     "LifetimeTooLong",
 			secret:   secret,
@@ -143,7 +154,7 @@ func TestGenerate(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			m, _ := NewManager(tt.secret, tt.opts...)
-			token, err := m.Generate(tt.user, tt.lifetime)
+			token, _, err := m.Generate(tt.user, tt.lifetime)
 			if err != nil {
 				if tt.wantErr {
 					return
@@ -162,3 +173,290 @@ func TestGenerate(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateAudience(t *testing.T) {
+	u := &auth.User{Username: "negz"}
+
+	m, _ := NewManager(secret)
+	token, _, err := m.Generate(u, time.Hour, auth.Audience("prod"))
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+	if _, err := m.Authenticate(token); err == nil {
+		t.Errorf("m.Authenticate(...): want error for token generated for another audience, got nil")
+	}
+
+	prod, _ := NewManager(secret, Audience("prod"))
+	got, err := prod.Authenticate(token)
+	if err != nil {
+		t.Fatalf("prod.Authenticate(...): %v", err)
+	}
+	if want := (&auth.User{Username: "negz", UID: "prod/negz"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("prod.Authenticate(...): want %+v, got %+v", want, got)
+	}
+}
+
+func TestGenerateNotBefore(t *testing.T) {
+	u := &auth.User{Username: "negz"}
+	m, _ := NewManager(secret, MaxSchedule(24*time.Hour))
+
+	token, _, err := m.Generate(u, time.Hour, auth.NotBefore(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+	if _, err := m.Authenticate(token); err == nil {
+		t.Errorf("m.Authenticate(...): want error for token that is not yet valid, got nil")
+	}
+
+	if _, _, err := m.Generate(u, time.Hour, auth.NotBefore(time.Now().Add(48*time.Hour))); err == nil {
+		t.Errorf("m.Generate(...): want error for not-before time exceeding maximum schedule, got nil")
+	}
+
+	// Not-before times in the past are ignored.
+	token, _, err = m.Generate(u, time.Hour, auth.NotBefore(time.Now().Add(-time.Hour)))
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+	if _, err := m.Authenticate(token); err != nil {
+		t.Errorf("m.Authenticate(...): %v", err)
+	}
+}
+
+func TestGenerateLabel(t *testing.T) {
+	u := &auth.User{Username: "negz"}
+	m, _ := NewManager(secret)
+
+	token, desc, err := m.Generate(u, time.Hour, auth.Label("laptop"), auth.Reason("incident 42"))
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+	if desc.Label != "laptop" || desc.Reason != "incident 42" {
+		t.Errorf("m.Generate(...): want label laptop and reason incident 42, got %q and %q", desc.Label, desc.Reason)
+	}
+
+	got, err := m.Authenticate(token)
+	if err != nil {
+		t.Fatalf("m.Authenticate(...): %v", err)
+	}
+	want := map[string][]string{auth.ExtraLabel: {"laptop"}, auth.ExtraReason: {"incident 42"}}
+	if diff := deep.Equal(want, got.Extra); diff != nil {
+		t.Errorf("m.Authenticate(...).Extra: want != got: %v", diff)
+	}
+}
+
+type resolver struct {
+	groups []string
+	err    error
+}
+
+func (r resolver) Groups(_ string) ([]string, error) {
+	return r.groups, r.err
+}
+
+func TestResolveGroups(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []Option
+		resolved []string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "NotResolved",
+			resolved: []string{"a", "b"},
+			want:     []string{"a", "b", "proxy"},
+		},
+		{
+			name:     "StillMember",
+			opts:     []Option{ResolveGroups(resolver{groups: []string{"b", "a", "c"}})},
+			resolved: []string{"a", "b"},
+			want:     []string{"a", "b", "proxy"},
+		},
+		{
+			name:     "RemovedFromGroup",
+			opts:     []Option{ResolveGroups(resolver{groups: []string{"b", "c"}})},
+			resolved: []string{"a", "b"},
+			want:     []string{"b", "proxy"},
+		},
+		{
+			name:     "UnknownUser",
+			opts:     []Option{ResolveGroups(resolver{})},
+			resolved: []string{"a", "b"},
+			want:     []string{"proxy"},
+		},
+		{
+			// Groups supplied by the identity proxy were never resolved, so
+			// there is nothing to re-resolve.
+			name: "OnlyProxyGroups",
+			opts: []Option{ResolveGroups(resolver{err: errors.New("boom")})},
+			want: []string{"a", "b", "proxy"},
+		},
+		{
+			name:     "FailClosed",
+			opts:     []Option{ResolveGroups(resolver{err: errors.New("boom")})},
+			resolved: []string{"a", "b"},
+			wantErr:  true,
+		},
+		{
+			name:     "FailOpen",
+			opts:     []Option{ResolveGroups(resolver{err: errors.New("boom")}), FailOpen()},
+			resolved: []string{"a", "b"},
+			want:     []string{"a", "b", "proxy"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewManager(secret, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+			u := &auth.User{Username: "negz", Groups: []string{"a", "b", "proxy"}}
+			token, _, err := m.Generate(u, time.Hour, auth.ResolvedGroups(tt.resolved...))
+			if err != nil {
+				t.Fatalf("m.Generate(...): %v", err)
+			}
+			got, err := m.Authenticate(token)
+			if err != nil {
+				if !tt.wantErr {
+					t.Fatalf("m.Authenticate(...): %v", err)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatalf("m.Authenticate(...): want error, got nil")
+			}
+			if diff := deep.Equal(tt.want, got.Groups); diff != nil {
+				t.Errorf("m.Authenticate(...).Groups: want != got: %v", diff)
+			}
+		})
+	}
+}
+
+// directory resolves only the groups of the users it knows.
+type directory map[string][]string
+
+func (d directory) Groups(username string) ([]string, error) {
+	return d[username], nil
+}
+
+func TestResolveGroupsAlsoSuppliedByProxy(t *testing.T) {
+	d := directory{"negz": {"cluster-admins", "developers"}}
+	m, err := NewManager(secret, ResolveGroups(d))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+
+	// The proxy also supplies cluster-admins, which the directory confirms.
+	u := &auth.User{Username: "negz", Groups: []string{"cluster-admins", "proxy"}}
+	resolved, err := groups.Enricher{Resolver: d}.Enrich(u)
+	if err != nil {
+		t.Fatalf("Enrich(...): %v", err)
+	}
+	token, _, err := m.Generate(u, time.Hour, auth.ResolvedGroups(resolved...))
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+
+	d["negz"] = []string{"developers"}
+	got, err := m.Authenticate(token)
+	if err != nil {
+		t.Fatalf("m.Authenticate(...): %v", err)
+	}
+	want := []string{"proxy", "developers"}
+	if diff := deep.Equal(want, got.Groups); diff != nil {
+		t.Errorf("m.Authenticate(...).Groups: want != got: %v", diff)
+	}
+}
+
+func TestResolveGroupsNormalized(t *testing.T) {
+	d := directory{"Negz@example.org": {"a"}}
+	m, err := NewManager(secret, ResolveGroups(d))
+	if err != nil {
+		t.Fatalf("NewManager(...): %v", err)
+	}
+	n, err := normalize.New(normalize.Lowercase(), normalize.StripDomains(normalize.AnyDomain), normalize.Prefix("corp:"))
+	if err != nil {
+		t.Fatalf("normalize.New(...): %v", err)
+	}
+	g := normalize.Generator(m, n)
+
+	cases := []struct {
+		name string
+		o    []auth.GenerateOption
+		want *auth.User
+	}{
+		{
+			name: "ResolvedBySuppliedUsername",
+			o:    []auth.GenerateOption{auth.ResolvedGroups("a", "b")},
+			want: &auth.User{Username: "corp:negz", UID: "github.com/planetlabs/kubehook/corp:negz", Groups: []string{"a"}},
+		},
+		{
+			name: "ExchangedNotResolved",
+			o:    []auth.GenerateOption{auth.ResolvedGroups("a", "b"), auth.Source(auth.SourceExchange)},
+			want: &auth.User{Username: "corp:negz", UID: "github.com/planetlabs/kubehook/corp:negz", Groups: []string{"a", "b"}},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _, err := g.Generate(&auth.User{Username: "Negz@example.org", Groups: []string{"a", "b"}}, time.Hour, tt.o...)
+			if err != nil {
+				t.Fatalf("g.Generate(...): %v", err)
+			}
+			got, err := m.Authenticate(token)
+			if err != nil {
+				t.Fatalf("m.Authenticate(...): %v", err)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("m.Authenticate(...): want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	u := &auth.User{Username: "negz", UID: "github.com/planetlabs/kubehook/negz", Groups: []string{"secret-group"}}
+
+	m, _ := NewManager(secret, Encrypt())
+	jwe, _, err := m.Generate(u, DefaultMaxLifetime)
+	if err != nil {
+		t.Fatalf("m.Generate(...): %v", err)
+	}
+	if !isJWE(jwe) {
+		t.Fatalf("m.Generate(...): want JWE, got %s", jwe)
+	}
+
+	got, err := m.Authenticate(jwe)
+	if err != nil {
+		t.Fatalf("m.Authenticate(...): %v", err)
+	}
+	if diff := deep.Equal(got, u); diff != nil {
+		t.Errorf("m.Authenticate(...): got != want: %v", diff)
+	}
+
+	parts := strings.Split(jwe, ".")
+	flipped := "A"
+	if parts[3][0] == 'A' {
+		flipped = "B"
+	}
+	parts[3] = flipped + parts[3][1:]
+	if _, err := m.Authenticate(strings.Join(parts, ".")); err == nil {
+		t.Errorf("m.Authenticate(...): want error for tampered JWE, got nil")
+	}
+
+	other, _ := NewManager([]byte("notsecret"), Encrypt())
+	if _, err := other.Authenticate(jwe); err == nil {
+		t.Errorf("other.Authenticate(...): want error for JWE encrypted with another key, got nil")
+	}
+
+	unencrypted, _ := NewManager(secret)
+	if _, err := unencrypted.Authenticate(jwe); err == nil {
+		t.Errorf("unencrypted.Authenticate(...): want error for JWE, got nil")
+	}
+
+	signed := token(secret, DefaultAudience, "negz", tenMinsAgo, tenMinsFromNow)
+	if _, err := m.Authenticate(signed); err != nil {
+		t.Errorf("m.Authenticate(...): want signed but unencrypted token to be valid, got %v", err)
+	}
+}
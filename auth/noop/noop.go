@@ -69,7 +69,16 @@ func (n *noop) Authenticate(token string) (*auth.User, error) {
 	return &auth.User{Username: token, UID: fmt.Sprintf("noop/%s", token), Groups: n.groups}, nil
 }
 
-func (n *noop) Generate(u *auth.User, _ time.Duration) (string, error) {
-	n.log.Info("generate", zap.String("uid", u.UID), zap.String("token", u.Username))
-	return u.Username, nil
+func (n *noop) Generate(u *auth.User, lifetime time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	opts := auth.NewGenerateOptions(o...)
+	n.log.Info("generate", zap.String("uid", u.UID), zap.String("token", u.Username), zap.Strings("omittedGroups", opts.OmittedGroups), zap.String("label", opts.Label), zap.String("reason", opts.Reason))
+	now := time.Now().UTC()
+	t := &auth.Token{
+		User:      auth.User{Username: u.Username, UID: fmt.Sprintf("noop/%s", u.Username), Groups: n.groups},
+		IssuedAt:  now,
+		ExpiresAt: now.Add(lifetime),
+		Label:     opts.Label,
+		Reason:    opts.Reason,
+	}
+	return u.Username, t, nil
 }
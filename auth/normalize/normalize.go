@@ -0,0 +1,237 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package normalize
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// AnyDomain may be passed to StripDomains to strip every domain.
+const AnyDomain = "*"
+
+// A Normalizer normalizes usernames, so that differently formatted usernames
+// that identify the same user result in the same Kubernetes user.
+type Normalizer struct {
+	log        *zap.Logger
+	lowercase  bool
+	domains    map[string]string
+	strip      map[string]bool
+	prefix     string
+	maxLength  int
+	disallowed string
+}
+
+// An Option represents an optional argument to New.
+type Option func(*Normalizer) error
+
+// Logger allows the use of a custom Zap logger.
+func Logger(l *zap.Logger) Option {
+	return func(n *Normalizer) error {
+		n.log = l
+		return nil
+	}
+}
+
+// Lowercase usernames.
+func Lowercase() Option {
+	return func(n *Normalizer) error {
+		n.lowercase = true
+		return nil
+	}
+}
+
+// MapDomains replaces the domain of usernames of the form user@domain per the
+// supplied map of old to new domains. Domains are matched case-insensitively.
+func MapDomains(m map[string]string) Option {
+	return func(n *Normalizer) error {
+		for from, to := range m {
+			if from == "" || to == "" {
+				return errors.Errorf("cannot map domain %q to %q", from, to)
+			}
+			n.domains[strings.ToLower(from)] = to
+		}
+		return nil
+	}
+}
+
+// StripDomains removes the supplied domains, or any domain if AnyDomain is
+// supplied, from usernames of the form user@domain. Domains are matched
+// case-insensitively after they are mapped.
+func StripDomains(d ...string) Option {
+	return func(n *Normalizer) error {
+		for _, domain := range d {
+			if domain == "" {
+				return errors.New("cannot strip empty domain")
+			}
+			n.strip[strings.ToLower(domain)] = true
+		}
+		return nil
+	}
+}
+
+// Prefix usernames with the supplied string, e.g. oidc:
+func Prefix(p string) Option {
+	return func(n *Normalizer) error {
+		n.prefix = p
+		return nil
+	}
+}
+
+// MaxLength rejects normalized usernames longer than the supplied number of
+// characters. Usernames of any length are allowed if it is zero.
+func MaxLength(l int) Option {
+	return func(n *Normalizer) error {
+		if l < 0 {
+			return errors.Errorf("maximum length %d is negative", l)
+		}
+		n.maxLength = l
+		return nil
+	}
+}
+
+// Disallow rejects normalized usernames containing any of the supplied
+// characters.
+func Disallow(chars string) Option {
+	return func(n *Normalizer) error {
+		n.disallowed = chars
+		return nil
+	}
+}
+
+// New returns a Normalizer. Usernames are lowercased, then their domains are
+// mapped and stripped, then they are prefixed. Finally usernames that are too
+// long or contain disallowed characters are rejected.
+func New(o ...Option) (*Normalizer, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+	n := &Normalizer{log: l, domains: make(map[string]string), strip: make(map[string]bool)}
+	for _, fn := range o {
+		if err := fn(n); err != nil {
+			return nil, errors.Wrap(err, "cannot apply normalizer option")
+		}
+	}
+	if strings.ContainsAny(n.prefix, n.disallowed) {
+		return nil, errors.Errorf("prefix %q contains disallowed characters", n.prefix)
+	}
+	return n, nil
+}
+
+// Username returns the normalized form of the supplied username.
+func (n *Normalizer) Username(username string) (string, error) {
+	u := username
+	if n.lowercase {
+		u = strings.ToLower(u)
+	}
+	if i := strings.LastIndex(u, "@"); i >= 0 {
+		name, domain := u[:i], u[i+1:]
+		if d, ok := n.domains[strings.ToLower(domain)]; ok {
+			domain = d
+		}
+		u = name + "@" + domain
+		if n.strip[AnyDomain] || n.strip[strings.ToLower(domain)] {
+			u = name
+		}
+	}
+	if u == "" {
+		return "", errors.Errorf("invalid username %q: username is empty when normalized", username)
+	}
+	u = n.prefix + u
+	if n.maxLength > 0 && utf8.RuneCountInString(u) > n.maxLength {
+		return "", errors.Errorf("invalid username %q: normalized username %q is longer than %d characters", username, u, n.maxLength)
+	}
+	if i := strings.IndexAny(u, n.disallowed); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(u[i:])
+		return "", errors.Errorf("invalid username %q: username contains disallowed character %q", username, r)
+	}
+	return u, nil
+}
+
+type generator struct {
+	auth.Generator
+	n *Normalizer
+}
+
+// Generator returns a Generator that normalizes the usernames of the users for
+// whom the supplied Generator generates tokens.
+func Generator(g auth.Generator, n *Normalizer) auth.Generator {
+	return &generator{Generator: g, n: n}
+}
+
+func (g *generator) Generate(u *auth.User, lifetime time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	username, err := g.n.Username(u.Username)
+	if err != nil {
+		g.n.log.Info("normalize", zap.String("user", u.Username), zap.Bool("success", false))
+		return "", nil, err
+	}
+	if username != u.Username {
+		g.n.log.Info("normalize", zap.String("user", u.Username), zap.String("normalized", username), zap.Bool("success", true))
+	}
+	nu := *u
+	nu.Username = username
+
+	// Groups are resolved using the username as supplied, so it must be
+	// recorded in order to re-resolve them.
+	o = append([]auth.GenerateOption{auth.DirectoryUsername(u.Username)}, o...)
+	return g.Generator.Generate(&nu, lifetime, o...)
+}
+
+type lister struct {
+	auth.Lister
+	n *Normalizer
+}
+
+// Lister returns a Lister that normalizes usernames before listing their
+// tokens, so that users may list the tokens generated by a Generator.
+func Lister(l auth.Lister, n *Normalizer) auth.Lister {
+	return &lister{Lister: l, n: n}
+}
+
+func (l *lister) List(username string) ([]auth.Token, error) {
+	u, err := l.n.Username(username)
+	if err != nil {
+		return nil, err
+	}
+	return l.Lister.List(u)
+}
+
+type revoker struct {
+	auth.Revoker
+	n *Normalizer
+}
+
+// Revoker returns a Revoker that normalizes usernames before revoking their
+// tokens, so that users may revoke the tokens generated by a Generator.
+func Revoker(rv auth.Revoker, n *Normalizer) auth.Revoker {
+	return &revoker{Revoker: rv, n: n}
+}
+
+func (rv *revoker) Revoke(username, id string) error {
+	u, err := rv.n.Username(username)
+	if err != nil {
+		return err
+	}
+	return rv.Revoker.Revoke(u, id)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package normalize
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth"
+)
+
+func TestUsername(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     []Option
+		username string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "Unchanged",
+			username: "Alice@Corp.com",
+			want:     "Alice@Corp.com",
+		},
+		{
+			name:     "Lowercase",
+			opts:     []Option{Lowercase()},
+			username: "Alice@Corp.com",
+			want:     "alice@corp.com",
+		},
+		{
+			name:     "MapDomain",
+			opts:     []Option{MapDomains(map[string]string{"corp.com": "example.org"})},
+			username: "alice@Corp.com",
+			want:     "alice@example.org",
+		},
+		{
+			name:     "StripDomain",
+			opts:     []Option{Lowercase(), StripDomains("corp.com")},
+			username: "Alice@Corp.com",
+			want:     "alice",
+		},
+		{
+			name:     "StripOtherDomain",
+			opts:     []Option{StripDomains("corp.com")},
+			username: "alice@example.org",
+			want:     "alice@example.org",
+		},
+		{
+			name:     "StripMappedDomain",
+			opts:     []Option{MapDomains(map[string]string{"old.corp.com": "corp.com"}), StripDomains("corp.com")},
+			username: "alice@old.corp.com",
+			want:     "alice",
+		},
+		{
+			name:     "StripAnyDomain",
+			opts:     []Option{StripDomains(AnyDomain)},
+			username: "alice@example.org",
+			want:     "alice",
+		},
+		{
+			name:     "StripToEmpty",
+			opts:     []Option{StripDomains(AnyDomain)},
+			username: "@example.org",
+			wantErr:  true,
+		},
+		{
+			name:     "Prefix",
+			opts:     []Option{Lowercase(), StripDomains("corp.com"), Prefix("corp:")},
+			username: "Alice@corp.com",
+			want:     "corp:alice",
+		},
+		{
+			name:     "MaxLength",
+			opts:     []Option{Prefix("corp:"), MaxLength(10)},
+			username: "alice",
+			want:     "corp:alice",
+		},
+		{
+			name:     "TooLong",
+			opts:     []Option{Prefix("corp:"), MaxLength(10)},
+			username: "alicia",
+			wantErr:  true,
+		},
+		{
+			name:     "Disallowed",
+			opts:     []Option{Disallow(" /:")},
+			username: "alice smith",
+			wantErr:  true,
+		},
+		{
+			name:     "Allowed",
+			opts:     []Option{Disallow(" /:")},
+			username: "alice.smith",
+			want:     "alice.smith",
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := New(tt.opts...)
+			if err != nil {
+				t.Fatalf("New(...): %v", err)
+			}
+			got, err := n.Username(tt.username)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("n.Username(%q): %v", tt.username, err)
+			}
+			if tt.wantErr {
+				t.Fatalf("n.Username(%q): want error, got %q", tt.username, got)
+			}
+			if got != tt.want {
+				t.Errorf("n.Username(%q): want %q, got %q", tt.username, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNewDisallowedPrefix(t *testing.T) {
+	if _, err := New(Prefix("corp:"), Disallow(":")); err == nil {
+		t.Errorf("New(...): want error for prefix containing disallowed characters, got nil")
+	}
+}
+
+type recorder struct {
+	users     []string
+	directory string
+}
+
+func (r *recorder) Generate(u *auth.User, lifetime time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	r.users = append(r.users, u.Username)
+	r.directory = auth.NewGenerateOptions(o...).DirectoryUsername
+	return u.Username, &auth.Token{User: *u}, nil
+}
+
+func (r *recorder) List(username string) ([]auth.Token, error) {
+	r.users = append(r.users, username)
+	return nil, nil
+}
+
+func (r *recorder) Revoke(username, id string) error {
+	r.users = append(r.users, username)
+	return nil
+}
+
+func TestDecorators(t *testing.T) {
+	n, err := New(Lowercase(), StripDomains("corp.com"), Disallow(" "))
+	if err != nil {
+		t.Fatalf("New(...): %v", err)
+	}
+	r := &recorder{}
+
+	u := &auth.User{Username: "Alice@Corp.com", UID: "1234", Groups: []string{"a"}}
+	token, desc, err := Generator(r, n).Generate(u, time.Hour)
+	if err != nil {
+		t.Fatalf("Generator(...).Generate(...): %v", err)
+	}
+	want := auth.User{Username: "alice", UID: "1234", Groups: []string{"a"}}
+	if diff := deep.Equal(want, desc.User); diff != nil {
+		t.Errorf("Generator(...).Generate(...): want != got: %v", diff)
+	}
+	if token != "alice" {
+		t.Errorf("Generator(...).Generate(...): want token alice, got %s", token)
+	}
+	if u.Username != "Alice@Corp.com" {
+		t.Errorf("Generator(...).Generate(...): supplied user was modified: %+v", u)
+	}
+	if r.directory != "Alice@Corp.com" {
+		t.Errorf("Generator(...).Generate(...): want directory username Alice@Corp.com, got %s", r.directory)
+	}
+	if _, _, err := Generator(r, n).Generate(&auth.User{Username: "alice smith"}, time.Hour); err == nil {
+		t.Errorf("Generator(...).Generate(...): want error for disallowed username, got nil")
+	}
+
+	if _, err := Lister(r, n).List("ALICE@corp.com"); err != nil {
+		t.Fatalf("Lister(...).List(...): %v", err)
+	}
+	if err := Revoker(r, n).Revoke("Alice@CORP.COM", "id"); err != nil {
+		t.Fatalf("Revoker(...).Revoke(...): %v", err)
+	}
+	if diff := deep.Equal([]string{"alice", "alice", "alice"}, r.users); diff != nil {
+		t.Errorf("normalized users: want != got: %v", diff)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package opaque
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var tokensBucket = []byte("tokens")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore returns a Store that persists tokens to a BoltDB database file,
+// which is created if it does not exist. Only one kubehook instance may open
+// the file at a time.
+func NewBoltStore(filename string) (Store, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open bolt database %s", filename)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokensBucket)
+		return err
+	})
+	return &boltStore{db: db}, errors.Wrap(err, "cannot create tokens bucket")
+}
+
+func (b *boltStore) Put(hash string, t *auth.Token) error {
+	v, err := json.Marshal(t)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal token")
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(hash), v)
+	})
+}
+
+func (b *boltStore) Get(hash string) (*auth.Token, error) {
+	t := &auth.Token{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(tokensBucket).Get([]byte(hash))
+		if v == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(v, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (b *boltStore) Touch(hash string, used time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(tokensBucket)
+		v := bkt.Get([]byte(hash))
+		if v == nil {
+			return ErrNotFound
+		}
+		t := &auth.Token{}
+		if err := json.Unmarshal(v, t); err != nil {
+			return errors.Wrap(err, "cannot unmarshal token")
+		}
+		t.LastUsed = used
+		v, err := json.Marshal(t)
+		if err != nil {
+			return errors.Wrap(err, "cannot marshal token")
+		}
+		return bkt.Put([]byte(hash), v)
+	})
+}
+
+// each calls fn for every token in the store. It must be called within a
+// transaction.
+func each(tx *bolt.Tx, fn func(hash []byte, t *auth.Token) error) error {
+	return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+		t := &auth.Token{}
+		if err := json.Unmarshal(v, t); err != nil {
+			return errors.Wrapf(err, "cannot unmarshal token %x", k)
+		}
+		return fn(k, t)
+	})
+}
+
+func (b *boltStore) List(username string) ([]auth.Token, error) {
+	ts := []auth.Token{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return each(tx, func(_ []byte, t *auth.Token) error {
+			if t.User.Username == username {
+				ts = append(ts, *t)
+			}
+			return nil
+		})
+	})
+	sort.Slice(ts, func(i, j int) bool { return ts[i].IssuedAt.Before(ts[j].IssuedAt) })
+	return ts, err
+}
+
+func (b *boltStore) Delete(username, id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		var hash []byte
+		err := each(tx, func(k []byte, t *auth.Token) error {
+			if t.User.Username == username && t.ID == id {
+				hash = append([]byte{}, k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if hash == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(tokensBucket).Delete(hash)
+	})
+}
+
+func (b *boltStore) Prune(before time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		expired := [][]byte{}
+		err := each(tx, func(k []byte, t *auth.Token) error {
+			if t.ExpiresAt.Before(before) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := tx.Bucket(tokensBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package opaque
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+)
+
+type memory struct {
+	mx     sync.RWMutex
+	tokens map[string]auth.Token
+}
+
+// NewMemoryStore returns a Store that holds tokens in memory. Tokens are lost
+// when kubehook restarts, and are not shared between kubehook instances.
+func NewMemoryStore() Store {
+	return &memory{tokens: make(map[string]auth.Token)}
+}
+
+func (m *memory) Put(hash string, t *auth.Token) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.tokens[hash] = *t
+	return nil
+}
+
+func (m *memory) Get(hash string) (*auth.Token, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	t, ok := m.tokens[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (m *memory) Touch(hash string, used time.Time) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok {
+		return ErrNotFound
+	}
+	t.LastUsed = used
+	m.tokens[hash] = t
+	return nil
+}
+
+func (m *memory) List(username string) ([]auth.Token, error) {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	ts := []auth.Token{}
+	for _, t := range m.tokens {
+		if t.User.Username == username {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].IssuedAt.Before(ts[j].IssuedAt) })
+	return ts, nil
+}
+
+func (m *memory) Delete(username, id string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for h, t := range m.tokens {
+		if t.User.Username == username && t.ID == id {
+			delete(m.tokens, h)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *memory) Prune(before time.Time) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	for h, t := range m.tokens {
+		if t.ExpiresAt.Before(before) {
+			delete(m.tokens, h)
+		}
+	}
+	return nil
+}
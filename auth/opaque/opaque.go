@@ -0,0 +1,263 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package opaque
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Defaults for opaque tokens.
+const (
+	DefaultMaxLifetime = 7 * 24 * time.Hour
+
+	// DefaultTouchInterval is the minimum interval between updates of the time
+	// a token was last used, to avoid writing to the store on every request.
+	DefaultTouchInterval = time.Minute
+)
+
+const (
+	tokenPrefix = "kh1."
+	tokenBytes  = 32
+	idBytes     = 8
+)
+
+// ErrNotFound is returned by a Store when the requested token does not exist.
+var ErrNotFound = errors.New("token not found")
+
+// A Store persists tokens, keyed by a hash of the token itself.
+type Store interface {
+	// Put stores the supplied token under the supplied hash.
+	Put(hash string, t *auth.Token) error
+
+	// Get returns the token stored under the supplied hash, or ErrNotFound.
+	Get(hash string) (*auth.Token, error)
+
+	// Touch records that the token stored under the supplied hash was used.
+	Touch(hash string, used time.Time) error
+
+	// List returns all tokens issued to the supplied username.
+	List(username string) ([]auth.Token, error)
+
+	// Delete the token with the supplied ID issued to the supplied username,
+	// or return ErrNotFound.
+	Delete(username, id string) error
+
+	// Prune deletes all tokens that expired before the supplied time.
+	Prune(before time.Time) error
+}
+
+type opaque struct {
+	log           *zap.Logger
+	secret        []byte
+	store         Store
+	maxLifetime   time.Duration
+	touchInterval time.Duration
+	now           func() time.Time
+}
+
+// An Option represents an optional argument to NewManager.
+type Option func(*opaque) error
+
+// Logger allows the use of a custom Zap logger.
+func Logger(l *zap.Logger) Option {
+	return func(o *opaque) error {
+		o.log = l
+		return nil
+	}
+}
+
+// MaxLifetime is the maximum allowed expiry time for generated tokens.
+func MaxLifetime(d time.Duration) Option {
+	return func(o *opaque) error {
+		o.maxLifetime = d
+		return nil
+	}
+}
+
+// TouchInterval is the minimum interval between updates of the time a token
+// was last used.
+func TouchInterval(d time.Duration) Option {
+	return func(o *opaque) error {
+		o.touchInterval = d
+		return nil
+	}
+}
+
+// NewManager generates and authenticates random opaque tokens. Only a keyed
+// hash of each token is persisted to the supplied store, along with the user
+// to whom it was issued. The secret keys the hash.
+func NewManager(secret []byte, s Store, mo ...Option) (auth.Manager, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+	m := &opaque{
+		log:           l,
+		secret:        secret,
+		store:         s,
+		maxLifetime:   DefaultMaxLifetime,
+		touchInterval: DefaultTouchInterval,
+		now:           time.Now,
+	}
+	for _, o := range mo {
+		if err := o(m); err != nil {
+			return nil, errors.Wrap(err, "cannot apply opaque manager option")
+		}
+	}
+	return m, nil
+}
+
+func (m *opaque) hash(token string) string {
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte(token)) // nolint: gosec
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (m *opaque) Authenticate(token string) (*auth.User, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		m.log.Info("auth", zap.Bool("success", false))
+		return nil, errors.New("invalid opaque token")
+	}
+
+	hash := m.hash(token)
+	log := m.log.With(zap.String("hash", hash))
+
+	t, err := m.store.Get(hash)
+	if err == ErrNotFound {
+		log.Info("auth", zap.Bool("success", false))
+		return nil, errors.New("unknown or revoked token")
+	}
+	if err != nil {
+		log.Info("auth", zap.Bool("success", false), zap.Error(err))
+		return nil, errors.Wrap(err, "cannot look up token")
+	}
+	log = log.With(zap.String("id", t.ID))
+
+	now := m.now().UTC()
+	if !now.Before(t.ExpiresAt) {
+		log.Info("auth", zap.Bool("success", false))
+		return nil, errors.Errorf("token expired at %s", t.ExpiresAt)
+	}
+
+	if now.Sub(t.LastUsed) >= m.touchInterval {
+		if err := m.store.Touch(hash, now); err != nil {
+			log.Debug("cannot record token use", zap.Error(err))
+		}
+	}
+
+	log.Info("auth", zap.Bool("success", true))
+	u := t.User
+	u.Extra = t.Extra()
+	return &u, nil
+}
+
+func (m *opaque) Generate(u *auth.User, lifetime time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	opts := auth.NewGenerateOptions(o...)
+	log := m.log.With(
+		zap.String("user", u.Username),
+		zap.String("uid", u.UID),
+		zap.Strings("groups", u.Groups),
+		zap.Strings("omittedGroups", opts.OmittedGroups),
+		zap.String("label", opts.Label),
+		zap.String("reason", opts.Reason),
+		zap.Duration("lifetime", lifetime))
+
+	// Opaque tokens are only valid for the store in which they are kept.
+	if opts.Audience != "" {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, auth.Invalid(errors.New("opaque tokens do not support audiences"))
+	}
+	if opts.NotBefore.After(m.now()) {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, auth.Invalid(errors.New("opaque tokens do not support not-before times"))
+	}
+
+	if lifetime > m.maxLifetime {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, auth.Invalid(errors.Errorf("requested token lifetime %s is greater than maximum allowed lifetime %s", lifetime, m.maxLifetime))
+	}
+
+	token, err := random(tokenBytes)
+	if err != nil {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, errors.Wrap(err, "cannot generate token")
+	}
+	token = tokenPrefix + token
+	id, err := random(idBytes)
+	if err != nil {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, errors.Wrap(err, "cannot generate token ID")
+	}
+
+	now := m.now().UTC()
+	t := &auth.Token{ID: id, User: *u, IssuedAt: now, ExpiresAt: now.Add(lifetime), Label: opts.Label, Reason: opts.Reason}
+	if err := m.store.Put(m.hash(token), t); err != nil {
+		log.Info("generate", zap.Bool("success", false))
+		return "", nil, errors.Wrap(err, "cannot store token")
+	}
+
+	if err := m.store.Prune(now); err != nil {
+		log.Debug("cannot prune expired tokens", zap.Error(err))
+	}
+
+	log.Info("generate", zap.Bool("success", true), zap.String("id", id))
+	return token, t, nil
+}
+
+func (m *opaque) List(username string) ([]auth.Token, error) {
+	ts, err := m.store.List(username)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot list tokens for user %s", username)
+	}
+	now := m.now().UTC()
+	unexpired := make([]auth.Token, 0, len(ts))
+	for _, t := range ts {
+		if now.Before(t.ExpiresAt) {
+			unexpired = append(unexpired, t)
+		}
+	}
+	return unexpired, nil
+}
+
+func (m *opaque) Revoke(username, id string) error {
+	log := m.log.With(zap.String("user", username), zap.String("id", id))
+	if err := m.store.Delete(username, id); err != nil {
+		log.Info("revoke", zap.Bool("success", false))
+		return errors.Wrapf(err, "cannot revoke token %s", id)
+	}
+	log.Info("revoke", zap.Bool("success", true))
+	return nil
+}
+
+func random(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
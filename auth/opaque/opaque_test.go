@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package opaque
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/planetlabs/kubehook/auth"
+)
+
+var secret = []byte("secret!")
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func stores(t *testing.T) (map[string]Store, func()) {
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	b, err := NewBoltStore(filepath.Join(dir, "tokens.db"))
+	if err != nil {
+		t.Fatalf("NewBoltStore(): %v", err)
+	}
+	s, err := NewSQLStore("sqlite3", filepath.Join(dir, "tokens.sqlite"))
+	if err != nil {
+		t.Fatalf("NewSQLStore(): %v", err)
+	}
+	return map[string]Store{"Memory": NewMemoryStore(), "Bolt": b, "SQL": s}, func() { os.RemoveAll(dir) }
+}
+
+func TestManager(t *testing.T) {
+	ss, cleanup := stores(t)
+	defer cleanup()
+
+	for name, s := range ss {
+		t.Run(name, func(t *testing.T) {
+			clk := &clock{t: time.Unix(1000000, 0).UTC()}
+			m, err := NewManager(secret, s, MaxLifetime(24*time.Hour))
+			if err != nil {
+				t.Fatalf("NewManager(...): %v", err)
+			}
+			m.(*opaque).now = clk.now
+
+			u := &auth.User{Username: "negz", UID: "negz", Groups: []string{"a", "b"}}
+			if _, _, err := m.Generate(u, 48*time.Hour); err == nil {
+				t.Errorf("m.Generate(...): want error for lifetime exceeding maximum, got nil")
+			}
+			if _, _, err := m.Generate(u, time.Hour, auth.Audience("prod")); err == nil {
+				t.Errorf("m.Generate(...): want error for audience, got nil")
+			}
+			if _, _, err := m.Generate(u, time.Hour, auth.NotBefore(clk.t.Add(time.Hour))); err == nil {
+				t.Errorf("m.Generate(...): want error for not-before time, got nil")
+			}
+
+			issued := clk.t
+			token, _, err := m.Generate(u, time.Hour)
+			if err != nil {
+				t.Fatalf("m.Generate(...): %v", err)
+			}
+			clk.t = clk.t.Add(time.Minute)
+			other, _, err := m.Generate(u, 2*time.Hour, auth.Label("laptop"))
+			if err != nil {
+				t.Fatalf("m.Generate(...): %v", err)
+			}
+
+			got, err := m.Authenticate(token)
+			if err != nil {
+				t.Fatalf("m.Authenticate(...): %v", err)
+			}
+			if diff := deep.Equal(got, u); diff != nil {
+				t.Errorf("m.Authenticate(...): got != want: %v", diff)
+			}
+
+			labelled, err := m.Authenticate(other)
+			if err != nil {
+				t.Fatalf("m.Authenticate(...): %v", err)
+			}
+			if diff := deep.Equal(labelled.Extra, map[string][]string{auth.ExtraLabel: {"laptop"}}); diff != nil {
+				t.Errorf("m.Authenticate(...).Extra: got != want: %v", diff)
+			}
+
+			if _, err := m.Authenticate(token + "x"); err == nil {
+				t.Errorf("m.Authenticate(...): want error for unknown token, got nil")
+			}
+			if _, err := m.Authenticate("notatoken"); err == nil {
+				t.Errorf("m.Authenticate(...): want error for malformed token, got nil")
+			}
+
+			ts, err := m.(auth.Lister).List(u.Username)
+			if err != nil {
+				t.Fatalf("m.List(%s): %v", u.Username, err)
+			}
+			if len(ts) != 2 {
+				t.Fatalf("m.List(%s): want 2 tokens, got %d", u.Username, len(ts))
+			}
+			want := auth.Token{ID: ts[0].ID, User: *u, IssuedAt: issued, ExpiresAt: issued.Add(time.Hour), LastUsed: clk.t}
+			if diff := deep.Equal(ts[0], want); diff != nil {
+				t.Errorf("m.List(%s): got != want: %v", u.Username, diff)
+			}
+
+			if ts[1].Label != "laptop" {
+				t.Errorf("m.List(%s): want label laptop, got %q", u.Username, ts[1].Label)
+			}
+
+			if err := m.(auth.Revoker).Revoke(u.Username, ts[1].ID); err != nil {
+				t.Fatalf("m.Revoke(%s, %s): %v", u.Username, ts[1].ID, err)
+			}
+			if _, err := m.Authenticate(other); err == nil {
+				t.Errorf("m.Authenticate(...): want error for revoked token, got nil")
+			}
+			if err := m.(auth.Revoker).Revoke("someoneelse", ts[0].ID); err == nil {
+				t.Errorf("m.Revoke(...): want error revoking another user's token, got nil")
+			}
+
+			clk.t = clk.t.Add(2 * time.Hour)
+			if _, err := m.Authenticate(token); err == nil {
+				t.Errorf("m.Authenticate(...): want error for expired token, got nil")
+			}
+			ts, err = m.(auth.Lister).List(u.Username)
+			if err != nil {
+				t.Fatalf("m.List(%s): %v", u.Username, err)
+			}
+			if len(ts) != 0 {
+				t.Errorf("m.List(%s): want no unexpired tokens, got %d", u.Username, len(ts))
+			}
+		})
+	}
+}
+
+func TestBind(t *testing.T) {
+	cases := []struct {
+		name   string
+		dollar bool
+		want   string
+	}{
+		{name: "QuestionMark", want: "UPDATE t SET a = ? WHERE b = ?"},
+		{name: "Dollar", dollar: true, want: "UPDATE t SET a = $1 WHERE b = $2"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &sqlStore{dollar: tt.dollar}
+			if got := s.bind("UPDATE t SET a = ? WHERE b = ?"); got != tt.want {
+				t.Errorf("s.bind(...): want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package opaque
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+)
+
+// Timestamps are stored as Unix nanoseconds and groups as a JSON array to
+// avoid depending on any SQL dialect's time or array types.
+const createTable = `CREATE TABLE IF NOT EXISTS kubehook_tokens (
+	hash VARCHAR(64) PRIMARY KEY,
+	id VARCHAR(32) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	uid VARCHAR(255) NOT NULL,
+	group_names TEXT NOT NULL,
+	issued_at BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	last_used BIGINT NOT NULL,
+	label VARCHAR(63) NOT NULL,
+	reason VARCHAR(256) NOT NULL
+)`
+
+const selectColumns = `SELECT id, username, uid, group_names, issued_at, expires_at, last_used, label, reason FROM kubehook_tokens`
+
+type sqlStore struct {
+	db     *sql.DB
+	dollar bool
+}
+
+// NewSQLStore returns a Store that persists tokens to a SQL database using the
+// supplied driver, which must already be registered. The kubehook_tokens table
+// is created if it does not exist.
+func NewSQLStore(driver, dsn string) (Store, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open %s database", driver)
+	}
+	if _, err := db.Exec(createTable); err != nil {
+		return nil, errors.Wrap(err, "cannot create kubehook_tokens table")
+	}
+	// PostgreSQL uses numbered rather than question mark placeholders.
+	return &sqlStore{db: db, dollar: driver == "postgres"}, nil
+}
+
+// bind rewrites question mark placeholders for the store's SQL dialect.
+func (s *sqlStore) bind(q string) string {
+	if !s.dollar {
+		return q
+	}
+	b := &strings.Builder{}
+	n := 0
+	for _, r := range q {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnix(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+func (s *sqlStore) Put(hash string, t *auth.Token) error {
+	groups, err := json.Marshal(t.User.Groups)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal groups")
+	}
+	_, err = s.db.Exec(s.bind(`INSERT INTO kubehook_tokens (hash, id, username, uid, group_names, issued_at, expires_at, last_used, label, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		hash, t.ID, t.User.Username, t.User.UID, string(groups), toUnix(t.IssuedAt), toUnix(t.ExpiresAt), toUnix(t.LastUsed), t.Label, t.Reason)
+	return errors.Wrap(err, "cannot insert token")
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (*auth.Token, error) {
+	var (
+		t                         = &auth.Token{}
+		groups                    string
+		issued, expires, lastUsed int64
+	)
+	if err := row.Scan(&t.ID, &t.User.Username, &t.User.UID, &groups, &issued, &expires, &lastUsed, &t.Label, &t.Reason); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(groups), &t.User.Groups); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal groups")
+	}
+	t.IssuedAt, t.ExpiresAt, t.LastUsed = fromUnix(issued), fromUnix(expires), fromUnix(lastUsed)
+	return t, nil
+}
+
+func (s *sqlStore) Get(hash string) (*auth.Token, error) {
+	t, err := scanToken(s.db.QueryRow(s.bind(selectColumns+` WHERE hash = ?`), hash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return t, errors.Wrap(err, "cannot select token")
+}
+
+func (s *sqlStore) Touch(hash string, used time.Time) error {
+	_, err := s.db.Exec(s.bind(`UPDATE kubehook_tokens SET last_used = ? WHERE hash = ?`), toUnix(used), hash)
+	return errors.Wrap(err, "cannot update token")
+}
+
+func (s *sqlStore) List(username string) ([]auth.Token, error) {
+	rows, err := s.db.Query(s.bind(selectColumns+` WHERE username = ? ORDER BY issued_at`), username)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot select tokens")
+	}
+	defer rows.Close()
+
+	ts := []auth.Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot scan token")
+		}
+		ts = append(ts, *t)
+	}
+	return ts, errors.Wrap(rows.Err(), "cannot select tokens")
+}
+
+func (s *sqlStore) Delete(username, id string) error {
+	r, err := s.db.Exec(s.bind(`DELETE FROM kubehook_tokens WHERE username = ? AND id = ?`), username, id)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete token")
+	}
+	if n, err := r.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Prune(before time.Time) error {
+	_, err := s.db.Exec(s.bind(`DELETE FROM kubehook_tokens WHERE expires_at < ?`), toUnix(before))
+	return errors.Wrap(err, "cannot delete expired tokens")
+}
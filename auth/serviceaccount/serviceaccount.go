@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package serviceaccount
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	authv1         = "authentication.k8s.io/v1"
+	tokenReview    = "TokenReview"
+	tokenReviewAPI = "/apis/authentication.k8s.io/v1/tokenreviews"
+
+	saPrefix = "system:serviceaccount:"
+)
+
+// DefaultTimeout is the default time to wait for a TokenReview response.
+const DefaultTimeout = 10 * time.Second
+
+type reviewer struct {
+	log       *zap.Logger
+	cluster   string
+	host      string
+	client    *http.Client
+	groups    []string
+	audiences []string
+}
+
+// An Option represents an optional argument to NewAuthenticator.
+type Option func(*reviewer) error
+
+// Logger allows the use of a custom Zap logger.
+func Logger(l *zap.Logger) Option {
+	return func(r *reviewer) error {
+		r.log = l
+		return nil
+	}
+}
+
+// Groups granted to all service accounts authenticated by this cluster.
+func Groups(g []string) Option {
+	return func(r *reviewer) error {
+		r.groups = g
+		return nil
+	}
+}
+
+// Audiences the presented service account token must be valid for. At least one
+// audience is required, so that tokens minted for the source cluster's own API
+// server, including legacy secret-based tokens, cannot be exchanged. Tokens are
+// rejected unless the source cluster confirms they are valid for at least one
+// of the supplied audiences.
+func Audiences(a []string) Option {
+	return func(r *reviewer) error {
+		r.audiences = a
+		return nil
+	}
+}
+
+// Timeout for TokenReview requests to the source cluster.
+func Timeout(t time.Duration) Option {
+	return func(r *reviewer) error {
+		r.client.Timeout = t
+		return nil
+	}
+}
+
+// NewAuthenticator returns an authenticator that validates Kubernetes service
+// account tokens by submitting a TokenReview to the API server of the named
+// source cluster. Audiences must be supplied. Authenticated service accounts are represented by users named
+// sa:<cluster>:<namespace>:<name>.
+func NewAuthenticator(cluster string, cfg *rest.Config, ao ...Option) (auth.Authenticator, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+	rt, err := rest.TransportFor(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create transport for cluster %s", cluster)
+	}
+	r := &reviewer{
+		log:     l,
+		cluster: cluster,
+		host:    strings.TrimSuffix(cfg.Host, "/"),
+		client:  &http.Client{Transport: rt, Timeout: DefaultTimeout},
+	}
+	for _, o := range ao {
+		if err := o(r); err != nil {
+			return nil, errors.Wrap(err, "cannot apply service account authenticator option")
+		}
+	}
+	if len(r.audiences) == 0 {
+		return nil, errors.Errorf("must specify at least one audience for cluster %s", cluster)
+	}
+	return r, nil
+}
+
+func (r *reviewer) Authenticate(token string) (*auth.User, error) {
+	log := r.log.With(zap.String("cluster", r.cluster))
+
+	s, err := r.review(token)
+	if err != nil {
+		log.Info("auth", zap.Bool("success", false), zap.Error(err))
+		return nil, errors.Wrapf(err, "cannot review token with cluster %s", r.cluster)
+	}
+	if !s.Authenticated {
+		log.Info("auth", zap.Bool("success", false), zap.String("error", s.Error))
+		return nil, errors.Errorf("cluster %s did not authenticate token: %s", r.cluster, s.Error)
+	}
+
+	// API servers that do not support audiences ignore those we request, so
+	// we must confirm the token is valid for at least one of them.
+	if len(r.audiences) > 0 && !intersects(r.audiences, s.Audiences) {
+		log.Info("auth", zap.Bool("success", false), zap.Strings("audiences", s.Audiences))
+		return nil, errors.Errorf("cluster %s did not authenticate token for any of audiences %v", r.cluster, r.audiences)
+	}
+
+	ns, name, err := splitUsername(s.User.Username)
+	if err != nil {
+		log.Info("auth", zap.Bool("success", false), zap.Error(err))
+		return nil, err
+	}
+
+	u := &auth.User{
+		Username: fmt.Sprintf("sa:%s:%s:%s", r.cluster, ns, name),
+		UID:      fmt.Sprintf("%s/%s", r.cluster, s.User.UID),
+		Groups:   r.groups,
+	}
+	log.Info("auth", zap.Bool("success", true), zap.String("user", u.Username))
+	return u, nil
+}
+
+func (r *reviewer) review(token string) (*v1.TokenReviewStatus, error) {
+	b, err := json.Marshal(&v1.TokenReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: authv1, Kind: tokenReview},
+		Spec:     v1.TokenReviewSpec{Token: token, Audiences: r.audiences},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal TokenReview")
+	}
+
+	req, err := http.NewRequest("POST", r.host+tokenReviewAPI, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create TokenReview request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot submit TokenReview")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusCreated && rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected TokenReview response status %s", rsp.Status)
+	}
+
+	tr := &v1.TokenReview{}
+	if err := json.NewDecoder(rsp.Body).Decode(tr); err != nil {
+		return nil, errors.Wrap(err, "cannot parse TokenReview response")
+	}
+	return &tr.Status, nil
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitUsername splits a service account username of the form
+// system:serviceaccount:<namespace>:<name> into its namespace and name.
+func splitUsername(u string) (string, string, error) {
+	if !strings.HasPrefix(u, saPrefix) {
+		return "", "", errors.Errorf("user %s is not a service account", u)
+	}
+	parts := strings.Split(strings.TrimPrefix(u, saPrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid service account username %s", u)
+	}
+	return parts[0], parts[1], nil
+}
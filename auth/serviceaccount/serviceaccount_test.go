@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package serviceaccount
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth"
+
+	"k8s.io/api/authentication/v1"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	cluster = "source"
+	token   = "sa-token"
+)
+
+// apiServer returns a fake API server that authenticates the supplied token as
+// the supplied user, for the supplied audiences.
+func apiServer(t *testing.T, valid string, u v1.UserInfo, auds []string, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != tokenReviewAPI || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		tr := &v1.TokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+			t.Fatalf("json.Decode(...): %v", err)
+		}
+		if tr.Spec.Token == valid {
+			tr.Status = v1.TokenReviewStatus{Authenticated: true, User: u, Audiences: auds}
+		} else {
+			tr.Status = v1.TokenReviewStatus{Error: "invalid token"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(tr) // nolint: gosec
+	}))
+}
+
+func TestAuthenticate(t *testing.T) {
+	cases := []struct {
+		name    string
+		token   string
+		user    v1.UserInfo
+		auds    []string
+		status  int
+		opts    []Option
+		want    *auth.User
+		wantErr bool
+	}{
+		{
+			name:   "ValidToken",
+			token:  token,
+			user:   v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			status: http.StatusCreated,
+			opts:   []Option{Groups([]string{"remote-deployers"})},
+			want: &auth.User{
+				Username: "sa:source:default:deployer",
+				UID:      "source/1234",
+				Groups:   []string{"remote-deployers"},
+			},
+		},
+		{
+			name:   "ValidAudience",
+			token:  token,
+			user:   v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			auds:   []string{"kubehook", "other"},
+			status: http.StatusCreated,
+			opts:   []Option{Audiences([]string{"kubehook"})},
+			want: &auth.User{
+				Username: "sa:source:default:deployer",
+				UID:      "source/1234",
+			},
+		},
+		{
+			name:    "OtherAudience",
+			token:   token,
+			user:    v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			auds:    []string{"https://kubernetes.default.svc"},
+			status:  http.StatusCreated,
+			opts:    []Option{Audiences([]string{"kubehook"})},
+			wantErr: true,
+		},
+		{
+			// API servers that predate audience support ignore the requested
+			// audiences, and return none.
+			name:    "AudiencesIgnored",
+			token:   token,
+			user:    v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			auds:    []string{},
+			status:  http.StatusCreated,
+			opts:    []Option{Audiences([]string{"kubehook"})},
+			wantErr: true,
+		},
+		{
+			name:    "InvalidToken",
+			token:   "not" + token,
+			user:    v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			status:  http.StatusCreated,
+			wantErr: true,
+		},
+		{
+			name:    "NotServiceAccount",
+			token:   token,
+			user:    v1.UserInfo{Username: "negz", UID: "1234"},
+			status:  http.StatusCreated,
+			wantErr: true,
+		},
+		{
+			name:    "MalformedServiceAccount",
+			token:   token,
+			user:    v1.UserInfo{Username: "system:serviceaccount:default", UID: "1234"},
+			status:  http.StatusCreated,
+			wantErr: true,
+		},
+		{
+			name:    "APIServerError",
+			token:   token,
+			user:    v1.UserInfo{Username: "system:serviceaccount:default:deployer", UID: "1234"},
+			status:  http.StatusForbidden,
+			wantErr: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			auds := tt.auds
+			if auds == nil {
+				auds = []string{"kubehook"}
+			}
+			s := apiServer(t, token, tt.user, auds, tt.status)
+			defer s.Close()
+
+			opts := append([]Option{Audiences([]string{"kubehook"})}, tt.opts...)
+			a, err := NewAuthenticator(cluster, &rest.Config{Host: s.URL}, opts...)
+			if err != nil {
+				t.Fatalf("NewAuthenticator(...): %v", err)
+			}
+			got, err := a.Authenticate(tt.token)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("a.Authenticate(...): %v", err)
+			}
+			if tt.wantErr {
+				t.Fatalf("a.Authenticate(...): want error, got %v", got)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("a.Authenticate(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorRequiresAudiences(t *testing.T) {
+	if _, err := NewAuthenticator(cluster, &rest.Config{Host: "https://example.org"}); err == nil {
+		t.Errorf("NewAuthenticator(...): want error without audiences, got nil")
+	}
+}
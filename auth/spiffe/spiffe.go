@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package spiffe
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/planetlabs/kubehook/auth"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+const scheme = "spiffe"
+
+// An ID is a SPIFFE ID, e.g. spiffe://example.org/ns/default/sa/deployer.
+type ID struct {
+	TrustDomain string   // TrustDomain is the authority of the ID.
+	Path        string   // Path is the workload path, including a leading slash.
+	Segments    []string // Segments are the slash separated elements of Path.
+}
+
+// String returns the URI representation of a SPIFFE ID.
+func (id ID) String() string {
+	return (&url.URL{Scheme: scheme, Host: id.TrustDomain, Path: id.Path}).String()
+}
+
+// ParseID parses a SPIFFE ID from a URI.
+func ParseID(u *url.URL) (ID, error) {
+	switch {
+	case u.Scheme != scheme:
+		return ID{}, errors.Errorf("URI %s does not use the %s scheme", u, scheme)
+	case u.Host == "":
+		return ID{}, errors.Errorf("SPIFFE ID %s has no trust domain", u)
+	case u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "":
+		return ID{}, errors.Errorf("SPIFFE ID %s must not contain a userinfo, port, query, or fragment", u)
+	}
+	id := ID{TrustDomain: strings.ToLower(u.Host), Path: u.Path}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		id.Segments = strings.Split(p, "/")
+	}
+	return id, nil
+}
+
+// IDFromSVID extracts the SPIFFE ID from an X.509-SVID leaf certificate. The
+// certificate's chain of trust must already have been verified.
+func IDFromSVID(c *x509.Certificate) (ID, error) {
+	if c.IsCA {
+		return ID{}, errors.New("X.509-SVID leaf certificate must not be a CA")
+	}
+	if len(c.URIs) != 1 {
+		return ID{}, errors.Errorf("X.509-SVID must contain exactly one URI SAN, found %d", len(c.URIs))
+	}
+	return ParseID(c.URIs[0])
+}
+
+// A Rule maps SPIFFE IDs matching a pattern to a user.
+type Rule struct {
+	// ID is a path.Match pattern matched against the SPIFFE ID URI, e.g.
+	// spiffe://example.org/ns/*/sa/*
+	ID string `json:"id"`
+
+	// Username is a text/template rendered with the matching ID to produce a
+	// username, e.g. spiffe:{{index .Segments 1}}:{{index .Segments 3}}. The
+	// URI of the SPIFFE ID is used if no template is supplied.
+	Username string `json:"username,omitempty"`
+
+	// Groups granted to users matching this rule.
+	Groups []string `json:"groups,omitempty"`
+}
+
+// Rules for mapping SPIFFE IDs to users. The first matching rule applies.
+type Rules struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadRules loads SPIFFE ID mapping rules from a YAML file.
+func LoadRules(filename string) (*Rules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read SPIFFE rules from %v", filename)
+	}
+	r := &Rules{}
+	if err := yaml.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse SPIFFE rules from %v", filename)
+	}
+	if _, err := r.compile(); err != nil {
+		return nil, errors.Wrapf(err, "invalid SPIFFE rules in %v", filename)
+	}
+	return r, nil
+}
+
+type rule struct {
+	Rule
+	username *template.Template
+}
+
+func (r *Rules) compile() ([]rule, error) {
+	compiled := make([]rule, 0, len(r.Rules))
+	for i, rl := range r.Rules {
+		if _, err := path.Match(rl.ID, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid ID pattern %q in rule %d", rl.ID, i)
+		}
+		c := rule{Rule: rl}
+		if rl.Username != "" {
+			t, err := template.New("username").Option("missingkey=error").Parse(rl.Username)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid username template in rule %d", i)
+			}
+			c.username = t
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// A Mapper maps SPIFFE IDs to users.
+type Mapper struct {
+	rules []rule
+}
+
+// NewMapper returns a Mapper that applies the supplied rules.
+func NewMapper(r *Rules) (*Mapper, error) {
+	rules, err := r.compile()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid SPIFFE rules")
+	}
+	return &Mapper{rules: rules}, nil
+}
+
+// User returns the user the supplied SPIFFE ID maps to. An error is returned if
+// no rule matches the ID.
+func (m *Mapper) User(id ID) (*auth.User, error) {
+	s := id.String()
+	for _, r := range m.rules {
+		if ok, _ := path.Match(r.ID, s); !ok {
+			continue
+		}
+		u := &auth.User{Username: s, UID: s, Groups: r.Groups}
+		if r.username != nil {
+			b := &bytes.Buffer{}
+			if err := r.username.Execute(b, id); err != nil {
+				return nil, errors.Wrapf(err, "cannot render username for SPIFFE ID %s", s)
+			}
+			u.Username = b.String()
+		}
+		if u.Username == "" {
+			return nil, errors.Errorf("SPIFFE ID %s maps to an empty username", s)
+		}
+		return u, nil
+	}
+	return nil, errors.Errorf("no rule matches SPIFFE ID %s", s)
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package spiffe
+
+import (
+	"crypto/x509"
+	"net/url"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth"
+)
+
+func mustParse(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func TestIDFromSVID(t *testing.T) {
+	cases := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    ID
+		wantErr bool
+	}{
+		{
+			name: "Valid",
+			cert: &x509.Certificate{URIs: []*url.URL{mustParse("spiffe://Example.org/ns/default/sa/deployer")}},
+			want: ID{
+				TrustDomain: "example.org",
+				Path:        "/ns/default/sa/deployer",
+				Segments:    []string{"ns", "default", "sa", "deployer"},
+			},
+		},
+		{
+			name:    "CA",
+			cert:    &x509.Certificate{IsCA: true, URIs: []*url.URL{mustParse("spiffe://example.org/ns/default/sa/deployer")}},
+			wantErr: true,
+		},
+		{
+			name:    "NoURIs",
+			cert:    &x509.Certificate{},
+			wantErr: true,
+		},
+		{
+			name: "MultipleURIs",
+			cert: &x509.Certificate{URIs: []*url.URL{
+				mustParse("spiffe://example.org/a"),
+				mustParse("spiffe://example.org/b"),
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "NotSPIFFE",
+			cert:    &x509.Certificate{URIs: []*url.URL{mustParse("https://example.org/a")}},
+			wantErr: true,
+		},
+		{
+			name:    "Port",
+			cert:    &x509.Certificate{URIs: []*url.URL{mustParse("spiffe://example.org:443/a")}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IDFromSVID(tt.cert)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("IDFromSVID(...): %v", err)
+			}
+			if tt.wantErr {
+				t.Fatalf("IDFromSVID(...): want error, got %v", got)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("IDFromSVID(...): got != want: %v", diff)
+			}
+		})
+	}
+}
+
+func TestMapperUser(t *testing.T) {
+	rules := &Rules{Rules: []Rule{
+		{
+			ID:       "spiffe://example.org/ns/*/sa/*",
+			Username: "spiffe:{{index .Segments 1}}:{{index .Segments 3}}",
+			Groups:   []string{"mesh"},
+		},
+		{
+			ID: "spiffe://example.org/*",
+		},
+	}}
+
+	cases := []struct {
+		name    string
+		id      string
+		want    *auth.User
+		wantErr bool
+	}{
+		{
+			name: "FirstRule",
+			id:   "spiffe://example.org/ns/default/sa/deployer",
+			want: &auth.User{
+				Username: "spiffe:default:deployer",
+				UID:      "spiffe://example.org/ns/default/sa/deployer",
+				Groups:   []string{"mesh"},
+			},
+		},
+		{
+			name: "DefaultUsername",
+			id:   "spiffe://example.org/billing",
+			want: &auth.User{
+				Username: "spiffe://example.org/billing",
+				UID:      "spiffe://example.org/billing",
+			},
+		},
+		{
+			name:    "NoMatchingRule",
+			id:      "spiffe://example.net/billing",
+			wantErr: true,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMapper(rules)
+			if err != nil {
+				t.Fatalf("NewMapper(...): %v", err)
+			}
+			id, err := ParseID(mustParse(tt.id))
+			if err != nil {
+				t.Fatalf("ParseID(%s): %v", tt.id, err)
+			}
+			got, err := m.User(id)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("m.User(%s): %v", tt.id, err)
+			}
+			if tt.wantErr {
+				t.Fatalf("m.User(%s): want error, got %v", tt.id, got)
+			}
+			if diff := deep.Equal(got, tt.want); diff != nil {
+				t.Errorf("m.User(%s): got != want: %v", tt.id, diff)
+			}
+		})
+	}
+}
+
+func TestNewMapperInvalidRules(t *testing.T) {
+	cases := map[string]*Rules{
+		"BadPattern":  {Rules: []Rule{{ID: "spiffe://example.org/["}}},
+		"BadTemplate": {Rules: []Rule{{ID: "spiffe://example.org/*", Username: "{{.Nope"}}},
+	}
+	for name, r := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewMapper(r); err == nil {
+				t.Errorf("NewMapper(...): want error, got nil")
+			}
+		})
+	}
+}
@@ -20,32 +20,75 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
 	"github.com/planetlabs/kubehook/auth/jwt"
+	"github.com/planetlabs/kubehook/auth/normalize"
+	"github.com/planetlabs/kubehook/auth/opaque"
+	"github.com/planetlabs/kubehook/auth/serviceaccount"
+	"github.com/planetlabs/kubehook/auth/spiffe"
+	cred "github.com/planetlabs/kubehook/credential"
+	"github.com/planetlabs/kubehook/device"
 	"github.com/planetlabs/kubehook/handlers"
 	"github.com/planetlabs/kubehook/handlers/authenticate"
+	hdevice "github.com/planetlabs/kubehook/handlers/device"
+	"github.com/planetlabs/kubehook/handlers/exchange"
 	"github.com/planetlabs/kubehook/handlers/generate"
 	"github.com/planetlabs/kubehook/handlers/kubecfg"
+	"github.com/planetlabs/kubehook/handlers/svid"
+	"github.com/planetlabs/kubehook/handlers/tokens"
+	kcfg "github.com/planetlabs/kubehook/kubeconfig"
+	"github.com/planetlabs/kubehook/lifetime"
 	_ "github.com/planetlabs/kubehook/statik"
 
 	"github.com/dyson/certman"
 	"github.com/julienschmidt/httprouter"
+	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/rakyll/statik/fs"
 	"go.uber.org/zap"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/homedir"
 )
 
 const indexPath = "/index.html"
 
+// Token backends.
+const (
+	backendJWT    = "jwt"
+	backendOpaque = "opaque"
+)
+
+// Opaque token stores.
+const (
+	storeMemory = "memory"
+	storeBolt   = "bolt"
+	storeSQL    = "sql"
+)
+
+// Group resolvers.
+const (
+	resolverLDAP   = "ldap"
+	resolverStatic = "static"
+	resolverHTTP   = "http"
+)
+
 func logRequests(h http.Handler, log *zap.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Info("request",
@@ -84,10 +127,12 @@ func listenAndServe(s *http.Server, tlsCert, tlsKey string) error {
 	return s.ListenAndServe()
 }
 
-func makeTLSConfig(clientCA []byte, clientCASubject string) *tls.Config {
+func makeTLSConfig(clientCA []byte, clientCASubject string, svidBundle []byte) *tls.Config {
 	tlsConfig := &tls.Config{}
 
-	if clientCASubject != "" {
+	// The subject is verified by requireClientCA when workloads presenting an
+	// X.509-SVID share the listener with mutual TLS clients.
+	if clientCASubject != "" && len(svidBundle) == 0 {
 		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 			if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
 				return errors.New("client did not present any TLS certificates")
@@ -97,11 +142,18 @@ func makeTLSConfig(clientCA []byte, clientCASubject string) *tls.Config {
 		}
 	}
 
-	if len(clientCA) > 0 {
+	if len(clientCA) > 0 || len(svidBundle) > 0 {
 		clientCertPool := x509.NewCertPool()
 		clientCertPool.AppendCertsFromPEM(clientCA)
+		clientCertPool.AppendCertsFromPEM(svidBundle)
 
+		// The handshake accepts certificates signed by either the client CA or
+		// the SPIFFE trust bundle. Each handler must thus verify certificates
+		// against only the CA it trusts; see requireClientCA and svid.Handler.
 		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(svidBundle) > 0 {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 		tlsConfig.ClientCAs = clientCertPool
 
 		tlsConfig.BuildNameToCertificate()
@@ -110,53 +162,593 @@ func makeTLSConfig(clientCA []byte, clientCASubject string) *tls.Config {
 	return tlsConfig
 }
 
+// requireClientCA requires that clients of every path except /svid present a
+// certificate signed by the supplied client CA, if any. Workloads calling /svid
+// are verified against the SPIFFE trust bundle by its handler.
+func requireClientCA(h http.Handler, clientCA []byte, clientCASubject string) http.Handler {
+	if len(clientCA) == 0 {
+		return h
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(clientCA)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handlers.RequireClientCert(roots, clientCASubject, h))
+	mux.Handle("/svid", h)
+	return mux
+}
+
+// durationFlag returns a lifetime.Duration parsed from the supplied flag or
+// argument, which accepts days, weeks and ISO 8601 durations.
+func durationFlag(s kingpin.Settings) *lifetime.Duration {
+	d := new(lifetime.Duration)
+	s.SetValue(d)
+	return d
+}
+
+func newOpaqueStore(kind, boltPath, sqlDriver, sqlDSN string) (opaque.Store, error) {
+	switch kind {
+	case storeBolt:
+		return opaque.NewBoltStore(boltPath)
+	case storeSQL:
+		return opaque.NewSQLStore(sqlDriver, sqlDSN)
+	default:
+		return opaque.NewMemoryStore(), nil
+	}
+}
+
+// restConfigs returns a client config for each context in the supplied
+// kubeconfig file, keyed by context name.
+func restConfigs(filename string) (map[string]*rest.Config, error) {
+	cfg, err := clientcmd.LoadFromFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load kubeconfig from %v", filename)
+	}
+
+	rcs := make(map[string]*rest.Config)
+	for name := range cfg.Contexts {
+		rc, err := clientcmd.NewNonInteractiveClientConfig(*cfg, name, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create client config for context %s", name)
+		}
+		rcs[name] = rc
+	}
+	return rcs, nil
+}
+
+// exchangeClusters returns a service account token authenticator for each
+// context in the supplied kubeconfig file, keyed by context name.
+func exchangeClusters(filename string, groups, audiences []string, log *zap.Logger) (map[string]auth.Authenticator, error) {
+	rcs, err := restConfigs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make(map[string]auth.Authenticator)
+	for name, rc := range rcs {
+		a, err := serviceaccount.NewAuthenticator(name, rc,
+			serviceaccount.Groups(groups),
+			serviceaccount.Audiences(audiences),
+			serviceaccount.Logger(log))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create service account authenticator for context %s", name)
+		}
+		clusters[name] = a
+	}
+	return clusters, nil
+}
+
+// parseHeaders parses HTTP headers in 'Name: value' form.
+func parseHeaders(hs []string) (http.Header, error) {
+	h := http.Header{}
+	for _, raw := range hs {
+		kv := strings.SplitN(raw, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, errors.Errorf("header %q must be in 'Name: value' form", raw)
+		}
+		h.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return h, nil
+}
+
+// serverFlags configure the kubehook API server. They are shared by the serve
+// and check-config commands.
+type serverFlags struct {
+	listen           *string
+	debug            *bool
+	grace            *time.Duration
+	audience         *string
+	userHeader       *string
+	groupHeader      *string
+	groupHeaderDelim *string
+	uidHeader        *string
+	userLowercase    *bool
+	userMapDomains   *map[string]string
+	userStripDomains *[]string
+	userPrefix       *string
+	userMaxLength    *int
+	userDisallowed   *string
+	backend          *string
+	opaqueStore      *string
+	opaqueBoltPath   *string
+	opaqueSQLDriver  *string
+	opaqueSQLDSN     *string
+	encrypt          *bool
+	maxlife          *lifetime.Duration
+	maxSchedule      *lifetime.Duration
+	template         *string
+	templateDir      *string
+	discoveryCfg     *string
+	discoveryIval    *time.Duration
+	execDefault      *bool
+	execCommand      *string
+	userName         *string
+	namespaceRules   *string
+	clientCA         *string
+	clientCASubject  *string
+	tlsCert          *string
+	tlsKey           *string
+	exchangeCfg      *string
+	exchangeGroups   *[]string
+	exchangeAuds     *[]string
+	externalURL      *string
+	deviceExpiry     *time.Duration
+	deviceMax        *int
+	deviceMaxClient  *int
+	spiffeBundle     *string
+	spiffeRules      *string
+	resolver         *string
+	groupMerge       *string
+	groupMap         *map[string]string
+	groupTimeout     *time.Duration
+	groupFile        *string
+	groupURL         *string
+	ldapURL          *string
+	ldapBaseDN       *string
+	ldapBindDN       *string
+	ldapStartTLS     *bool
+	ldapBindPassword *string
+	ldapFilter       *string
+	ldapAttribute    *string
+	ldapCA           *string
+	revalidate       *bool
+	revalidateTTL    *time.Duration
+	revalidateOpen   *bool
+	secret           *string
+}
+
+func addServerFlags(app *kingpin.Application, cmd *kingpin.CmdClause) *serverFlags {
+	return &serverFlags{
+		listen:           cmd.Flag("listen", "Address at which to expose HTTP webhook.").Default(":10003").String(),
+		debug:            cmd.Flag("debug", "Run with debug logging.").Short('d').Bool(),
+		grace:            cmd.Flag("shutdown-grace-period", "Wait this long for sessions to end before shutting down.").Default("1m").Duration(),
+		audience:         cmd.Flag("audience", "Audience for JWT HMAC creation and verification.").Default(jwt.DefaultAudience).String(),
+		userHeader:       cmd.Flag("user-header", "HTTP header specifying the authenticated user sending a token generation request.").Default(handlers.DefaultUserHeader).String(),
+		groupHeader:      cmd.Flag("group-header", "HTTP header specifying the authenticated user's groups.").Default(handlers.DefaultGroupHeader).String(),
+		groupHeaderDelim: cmd.Flag("group-header-delimiter", "Delimiter separating group names in the group-header.").Default(handlers.DefaultGroupHeaderDelimiter).String(),
+		userLowercase:    cmd.Flag("username-lowercase", "Lowercase the usernames of generated tokens.").Bool(),
+		userMapDomains:   cmd.Flag("username-map-domain", "Replace a domain of the usernames of generated tokens, e.g. corp.com=example.org. May be repeated.").PlaceHolder("FROM=TO").StringMap(),
+		userStripDomains: cmd.Flag("username-strip-domain", "Strip a domain, or any domain if *, from the usernames of generated tokens. May be repeated.").Strings(),
+		userPrefix:       cmd.Flag("username-prefix", "Prefix the usernames of generated tokens, e.g. oidc:").String(),
+		userMaxLength:    cmd.Flag("username-max-length", "Refuse to generate tokens whose normalized username is longer than this. Zero allows any length.").Default("0").Int(),
+		userDisallowed:   cmd.Flag("username-disallowed-characters", "Refuse to generate tokens whose normalized username contains any of these characters.").String(),
+		uidHeader:        cmd.Flag("uid-header", "HTTP header specifying the authenticated user's immutable ID, which is stored in tokens and used as their UID. Tokens' UIDs are derived from their audience and username if unset.").String(),
+		backend:          cmd.Flag("backend", "Token backend. JWTs are stateless; opaque tokens are stored and may be listed and revoked.").Default(backendJWT).Enum(backendJWT, backendOpaque),
+		opaqueStore:      cmd.Flag("opaque-store", "Where to store opaque tokens (requires --backend=opaque).").Default(storeMemory).Enum(storeMemory, storeBolt, storeSQL),
+		opaqueBoltPath:   cmd.Flag("opaque-bolt-path", "Path to the BoltDB database in which to store opaque tokens (requires --opaque-store=bolt).").Default("kubehook.db").String(),
+		opaqueSQLDriver:  cmd.Flag("opaque-sql-driver", "SQL driver with which to store opaque tokens (requires --opaque-store=sql). Only postgres is built in.").Default("postgres").Enum(sql.Drivers()...),
+		opaqueSQLDSN:     cmd.Flag("opaque-sql-dsn", "SQL data source name at which to store opaque tokens (requires --opaque-store=sql).").String(),
+		encrypt:          cmd.Flag("encrypt", "Encrypt JWTs so that their bearers cannot read their claims (requires --backend=jwt).").Bool(),
+		maxlife:          durationFlag(cmd.Flag("max-lifetime", "Maximum allowed token lifetime, e.g. 168h, 7d or P1W.").Default(jwt.DefaultMaxLifetime.String())),
+		maxSchedule:      durationFlag(cmd.Flag("max-schedule", "How far in the future tokens may be scheduled to become valid. Zero disables scheduling (requires --backend=jwt).").Default(jwt.DefaultMaxSchedule.String())),
+		template:         cmd.Flag("kubecfg-template", "A kubecfg file containing clusters to populate with a user and contexts.").ExistingFile(),
+		templateDir:      cmd.Flag("kubecfg-template-dir", "A directory of kubecfg templates, each named for its file.").ExistingDir(),
+		discoveryCfg:     cmd.Flag("kubecfg-discovery-kubeconfig", "A kubecfg file whose contexts are clusters whose server URL and CA data are discovered from their cluster-info ConfigMap.").ExistingFile(),
+		discoveryIval:    cmd.Flag("kubecfg-discovery-interval", "How often to rediscover clusters.").Default(kubecfg.DefaultDiscoveryInterval.String()).Duration(),
+		execDefault:      cmd.Flag("kubecfg-exec", "Populate kubecfg files with users that run the kubehook credential helper, rather than tokens, by default.").Bool(),
+		execCommand:      cmd.Flag("kubecfg-exec-command", "Command with which the kubehook credential helper is run on users' machines.").Default("kubehook").String(),
+		userName:         cmd.Flag("kubecfg-user-name", "A text/template naming the user for each cluster in kubecfg files, e.g. {{.Username}}@{{.Cluster}}.").Default(kubecfg.DefaultUserName).String(),
+		namespaceRules:   cmd.Flag("kubecfg-namespace-rules", "A YAML file of rules setting the default namespace of kubecfg contexts per user, group and cluster.").ExistingFile(),
+		clientCA:         cmd.Flag("client-ca", "If set, enables mutual TLS and specifies the path to CA file to use when validating client connections (requires --tls-cert).").ExistingFile(),
+		clientCASubject:  cmd.Flag("client-ca-subject", "If set, requires that the client CA matches the provided subject (requires --client-ca).").String(),
+		tlsCert:          cmd.Flag("tls-cert", "If set, enables TLS and specifies the path to TLS certificate to use for HTTPS server (requires --tls-key).").ExistingFile(),
+		tlsKey:           cmd.Flag("tls-key", "Path to TLS key to use for HTTPS server (requires --tls-cert).").ExistingFile(),
+		exchangeCfg:      cmd.Flag("exchange-kubeconfig", "A kubecfg file whose contexts are source clusters from which service account tokens may be exchanged.").ExistingFile(),
+		exchangeGroups:   cmd.Flag("exchange-group", "A group granted to users created by service account token exchange. May be repeated.").Strings(),
+		exchangeAuds:     cmd.Flag("exchange-audience", "An audience service account tokens must be valid for to be exchanged. May be repeated. Defaults to --audience.").Strings(),
+		externalURL:      cmd.Flag("external-url", "URL at which users reach kubehook, used to build device authorization verification URIs and credential helper arguments. Derived from each request if unset.").String(),
+		deviceExpiry:     cmd.Flag("device-code-expiry", "How long device authorization requests remain valid.").Default(device.DefaultExpiry.String()).Duration(),
+		deviceMax:        cmd.Flag("device-code-max-pending", "Maximum number of pending device authorization requests.").Default(strconv.Itoa(device.DefaultMaxPending)).Int(),
+		deviceMaxClient:  cmd.Flag("device-code-max-pending-per-client", "Maximum number of pending device authorization requests from any one client address.").Default(strconv.Itoa(device.DefaultMaxPendingPerClient)).Int(),
+		spiffeBundle:     cmd.Flag("spiffe-trust-bundle", "If set, enables token issuance to workloads presenting an X.509-SVID signed by a CA in this PEM file (requires --tls-cert and --spiffe-rules).").ExistingFile(),
+		spiffeRules:      cmd.Flag("spiffe-rules", "A YAML file of rules mapping SPIFFE IDs to users and groups.").ExistingFile(),
+		resolver:         cmd.Flag("group-resolver", "Resolve the groups of users requesting tokens or kubecfg files from an LDAP directory, a static YAML file, or an HTTP endpoint.").Enum(resolverLDAP, resolverStatic, resolverHTTP),
+		groupMerge:       cmd.Flag("group-resolver-merge", "How resolved groups are merged with those supplied by the group-header.").Default(groups.MergeUnion).Enum(groups.Policies...),
+		groupMap:         cmd.Flag("group-resolver-map", "Rename a resolved group, e.g. cn=admins,ou=groups,dc=example,dc=org=cluster-admins. May be repeated.").PlaceHolder("FROM=TO").StringMap(),
+		groupTimeout:     cmd.Flag("group-resolver-timeout", "Timeout of group resolution requests.").Default(groups.DefaultLDAPTimeout.String()).Duration(),
+		groupFile:        cmd.Flag("group-resolver-file", "A YAML file mapping usernames to groups (requires --group-resolver=static).").ExistingFile(),
+		groupURL:         cmd.Flag("group-resolver-url", "URL from which users' groups are requested (requires --group-resolver=http).").String(),
+		ldapURL:          cmd.Flag("ldap-url", "ldap:// or ldaps:// URL of the LDAP directory (requires --group-resolver=ldap).").String(),
+		ldapBaseDN:       cmd.Flag("ldap-base-dn", "DN under which to search for groups (requires --group-resolver=ldap).").String(),
+		ldapBindDN:       cmd.Flag("ldap-bind-dn", "DN with which to bind to the LDAP directory. Searches are anonymous if unset. Requires an ldaps:// URL or --ldap-start-tls.").String(),
+		ldapStartTLS:     cmd.Flag("ldap-start-tls", "Upgrade ldap:// connections to the LDAP directory using StartTLS.").Bool(),
+		ldapBindPassword: cmd.Flag("ldap-bind-password", "Password with which to bind to the LDAP directory.").Envar(envVarName(app.Name, "ldap-bind-password")).String(),
+		ldapFilter:       cmd.Flag("ldap-group-filter", "A text/template LDAP filter matching the groups of which {{.Username}} is a member.").Default(groups.DefaultLDAPFilter).String(),
+		ldapAttribute:    cmd.Flag("ldap-group-attribute", "Attribute of LDAP group entries containing the group name.").Default(groups.DefaultLDAPAttribute).String(),
+		ldapCA:           cmd.Flag("ldap-ca", "CA certificates with which to verify the LDAP directory. Defaults to the system's.").ExistingFile(),
+		revalidate:       cmd.Flag("revalidate-groups", "Re-resolve users' groups when authenticating JWTs, removing any groups from which they have since been removed (requires --group-resolver and --backend=jwt).").Bool(),
+		revalidateTTL:    cmd.Flag("revalidate-groups-ttl", "How long re-resolved groups are cached.").Default(groups.DefaultCacheTTL.String()).Duration(),
+		revalidateOpen:   cmd.Flag("revalidate-groups-fail-open", "Authenticate users with the groups in their token when their current groups cannot be resolved, rather than failing.").Bool(),
+		secret:           cmd.Arg("secret", "Secret for JWT HMAC signature and verification, or opaque token hashing.").Required().Envar(envVarName(app.Name, "secret")).String(),
+	}
+}
+
+// templates returns a function that loads and validates the configured
+// kubeconfig templates, and the path to watch for changes to them. The function
+// is nil if no templates are configured.
+func (f *serverFlags) templates() (kubecfg.LoadFunc, string, error) {
+	discovered := []string{}
+	if *f.discoveryCfg != "" {
+		cfg, err := clientcmd.LoadFromFile(*f.discoveryCfg)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "cannot load kubeconfig from %v", *f.discoveryCfg)
+		}
+		for name := range cfg.Contexts {
+			discovered = append(discovered, name)
+		}
+	}
+	validate := func(ts kubecfg.Templates, err error) (kubecfg.Templates, error) {
+		if err != nil {
+			return nil, err
+		}
+		// Opaque tokens are only valid for the store in which they are kept.
+		if a := ts.Audiences(); *f.backend == backendOpaque && len(a) > 0 {
+			return nil, errors.Errorf("--backend=opaque does not support kubeconfig template cluster audiences, but templates specify audiences %v", a)
+		}
+		return ts, ts.Validate(discovered...)
+	}
+
+	switch {
+	case *f.template != "" && *f.templateDir != "":
+		return nil, "", errors.New("--kubecfg-template cannot be used with --kubecfg-template-dir")
+	case *f.template != "":
+		load := func() (kubecfg.Templates, error) {
+			t, err := kubecfg.LoadTemplate(*f.template)
+			return validate(kubecfg.Templates{t}, err)
+		}
+		return load, filepath.Dir(*f.template), nil
+	case *f.templateDir != "":
+		load := func() (kubecfg.Templates, error) { return validate(kubecfg.LoadTemplates(*f.templateDir)) }
+		return load, *f.templateDir, nil
+	}
+	return nil, "", nil
+}
+
+// exchangeAudiences returns the audiences service account tokens must be valid
+// for to be exchanged. Only tokens projected for kubehook's own audience are
+// exchanged by default.
+func (f *serverFlags) exchangeAudiences() []string {
+	if len(*f.exchangeAuds) > 0 {
+		return *f.exchangeAuds
+	}
+	return []string{*f.audience}
+}
+
+// normalizer returns a username normalizer per the flags.
+func (f *serverFlags) normalizer(log *zap.Logger) (*normalize.Normalizer, error) {
+	o := []normalize.Option{
+		normalize.Logger(log),
+		normalize.MapDomains(*f.userMapDomains),
+		normalize.StripDomains(*f.userStripDomains...),
+		normalize.Prefix(*f.userPrefix),
+		normalize.MaxLength(*f.userMaxLength),
+		normalize.Disallow(*f.userDisallowed),
+	}
+	if *f.userLowercase {
+		o = append(o, normalize.Lowercase())
+	}
+	return normalize.New(o...)
+}
+
+// groupResolver returns a group resolver per the flags, or nil if groups are
+// not resolved.
+func (f *serverFlags) groupResolver() (auth.GroupResolver, error) {
+	var (
+		r   auth.GroupResolver
+		err error
+	)
+	switch *f.resolver {
+	case "":
+		return nil, nil
+	case resolverStatic:
+		if *f.groupFile == "" {
+			return nil, errors.New("--group-resolver=static requires --group-resolver-file")
+		}
+		r, err = groups.LoadStatic(*f.groupFile)
+	case resolverHTTP:
+		if *f.groupURL == "" {
+			return nil, errors.New("--group-resolver=http requires --group-resolver-url")
+		}
+		r, err = groups.NewHTTP(&http.Client{Timeout: *f.groupTimeout}, *f.groupURL)
+	case resolverLDAP:
+		if *f.ldapURL == "" || *f.ldapBaseDN == "" {
+			return nil, errors.New("--group-resolver=ldap requires --ldap-url and --ldap-base-dn")
+		}
+		o := []groups.LDAPOption{groups.Filter(*f.ldapFilter), groups.Attribute(*f.ldapAttribute), groups.Timeout(*f.groupTimeout)}
+		if *f.ldapStartTLS {
+			o = append(o, groups.StartTLS())
+		}
+		if *f.ldapBindDN != "" {
+			o = append(o, groups.Bind(*f.ldapBindDN, *f.ldapBindPassword))
+		}
+		if *f.ldapCA != "" {
+			ca, err := ioutil.ReadFile(*f.ldapCA)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot read LDAP CA certificates")
+			}
+			o = append(o, groups.CA(ca))
+		}
+		r, err = groups.NewLDAP(*f.ldapURL, *f.ldapBaseDN, o...)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create group resolver")
+	}
+	return groups.Mapped(r, *f.groupMap), nil
+}
+
+// check validates the flags, and the configuration files they refer to,
+// without connecting to anything. Every problem found is returned.
+func (f *serverFlags) check() error {
+	problems := []string{}
+	fail := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if *f.encrypt && *f.backend != backendJWT {
+		fail(errors.New("--encrypt requires --backend=jwt"))
+	}
+	if *f.revalidate && *f.backend != backendJWT {
+		fail(errors.New("--revalidate-groups requires --backend=jwt"))
+	}
+	if *f.revalidate && *f.resolver == "" {
+		fail(errors.New("--revalidate-groups requires --group-resolver"))
+	}
+	if *f.revalidate && *f.groupMerge == groups.MergeFallback {
+		fail(errors.New("--revalidate-groups cannot be used with --group-resolver-merge=fallback, under which the proxy rather than the resolver determines users' groups"))
+	}
+	if *f.revalidateOpen && !*f.revalidate {
+		fail(errors.New("--revalidate-groups-fail-open requires --revalidate-groups"))
+	}
+	if *f.opaqueStore != storeMemory && *f.backend != backendOpaque {
+		fail(errors.New("--opaque-store requires --backend=opaque"))
+	}
+	if *f.opaqueStore == storeSQL && *f.opaqueSQLDSN == "" {
+		fail(errors.New("--opaque-store=sql requires --opaque-sql-dsn"))
+	}
+
+	if *f.deviceMax < 1 || *f.deviceMaxClient < 1 {
+		fail(errors.New("--device-code-max-pending and --device-code-max-pending-per-client must be at least 1"))
+	}
+
+	if (*f.tlsCert == "") != (*f.tlsKey == "") {
+		fail(errors.New("--tls-cert and --tls-key must be used together"))
+	}
+	if *f.tlsCert != "" && *f.tlsKey != "" {
+		_, err := tls.LoadX509KeyPair(*f.tlsCert, *f.tlsKey)
+		fail(errors.Wrap(err, "cannot load TLS certificate"))
+	}
+	if *f.clientCASubject != "" && *f.clientCA == "" {
+		fail(errors.New("--client-ca-subject requires --client-ca"))
+	}
+	if *f.clientCA != "" {
+		// Client certificates can only be presented over TLS; without it every
+		// request would be refused.
+		if *f.tlsCert == "" {
+			fail(errors.New("--client-ca requires --tls-cert"))
+		}
+		fail(errors.Wrap(checkCerts(*f.clientCA), "invalid client CA"))
+	}
+	if *f.spiffeBundle != "" {
+		if *f.tlsCert == "" || *f.spiffeRules == "" {
+			fail(errors.New("--spiffe-trust-bundle requires --tls-cert and --spiffe-rules"))
+		}
+		fail(errors.Wrap(checkCerts(*f.spiffeBundle), "invalid SPIFFE trust bundle"))
+	}
+	if *f.spiffeRules != "" {
+		rules, err := spiffe.LoadRules(*f.spiffeRules)
+		if err == nil {
+			_, err = spiffe.NewMapper(rules)
+		}
+		fail(err)
+	}
+
+	if *f.externalURL != "" {
+		if u, err := url.Parse(*f.externalURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail(errors.Errorf("--external-url %q must be an absolute URL", *f.externalURL))
+		}
+	}
+
+	load, _, err := f.templates()
+	fail(err)
+	if load != nil {
+		_, err := load()
+		fail(err)
+	}
+	_, err = kubecfg.ParseUserName(*f.userName)
+	fail(err)
+	_, err = f.normalizer(zap.NewNop())
+	fail(errors.Wrap(err, "invalid username normalization"))
+	_, err = f.groupResolver()
+	fail(err)
+	if *f.namespaceRules != "" {
+		_, err := kubecfg.LoadNamespaceRules(*f.namespaceRules)
+		fail(err)
+	}
+	if *f.discoveryCfg != "" {
+		_, err := restConfigs(*f.discoveryCfg)
+		fail(errors.Wrap(err, "invalid cluster discovery kubeconfig"))
+	}
+	if *f.exchangeCfg != "" {
+		_, err := restConfigs(*f.exchangeCfg)
+		fail(errors.Wrap(err, "invalid token exchange kubeconfig"))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// checkCerts returns an error unless the supplied file contains at least one
+// PEM encoded certificate.
+func checkCerts(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(b) {
+		return errors.Errorf("%s contains no PEM encoded certificates", filename)
+	}
+	return nil
+}
+
 func main() {
 	var (
-		app              = kingpin.New(filepath.Base(os.Args[0]), "Authenticates Kubernetes users via JWT tokens.").DefaultEnvars()
-		listen           = app.Flag("listen", "Address at which to expose HTTP webhook.").Default(":10003").String()
-		debug            = app.Flag("debug", "Run with debug logging.").Short('d').Bool()
-		grace            = app.Flag("shutdown-grace-period", "Wait this long for sessions to end before shutting down.").Default("1m").Duration()
-		audience         = app.Flag("audience", "Audience for JWT HMAC creation and verification.").Default(jwt.DefaultAudience).String()
-		userHeader       = app.Flag("user-header", "HTTP header specifying the authenticated user sending a token generation request.").Default(handlers.DefaultUserHeader).String()
-		groupHeader      = app.Flag("group-header", "HTTP header specifying the authenticated user's groups.").Default(handlers.DefaultGroupHeader).String()
-		groupHeaderDelim = app.Flag("group-header-delimiter", "Delimiter separating group names in the group-header.").Default(handlers.DefaultGroupHeaderDelimiter).String()
-		maxlife          = app.Flag("max-lifetime", "Maximum allowed JWT lifetime, in Go's time.ParseDuration format.").Default(jwt.DefaultMaxLifetime.String()).Duration()
-		template         = app.Flag("kubecfg-template", "A kubecfg file containing clusters to populate with a user and contexts.").ExistingFile()
-		clientCA         = app.Flag("client-ca", "If set, enables mutual TLS and specifies the path to CA file to use when validating client connections.").File()
-		clientCASubject  = app.Flag("client-ca-subject", "If set, requires that the client CA matches the provided subject (requires --client-ca).").String()
-		tlsCert          = app.Flag("tls-cert", "If set, enables TLS and specifies the path to TLS certificate to use for HTTPS server (requires --tls-key).").ExistingFile()
-		tlsKey           = app.Flag("tls-key", "Path to TLS key to use for HTTPS server (requires --tls-cert).").ExistingFile()
-
-		secret = app.Arg("secret", "Secret for JWT HMAC signature and verification.").Required().Envar(envVarName(app.Name, "secret")).String()
+		app   = kingpin.New(filepath.Base(os.Args[0]), "Authenticates Kubernetes users via JWT tokens.").DefaultEnvars()
+		serve = app.Command("serve", "Serve the kubehook API and UI.").Default()
+		f     = addServerFlags(app, serve)
+
+		check = app.Command("check-config", "Validate flags and configuration files offline, then exit.")
+		cf    = addServerFlags(app, check)
+
+		credential   = app.Command("credential", "Print a kubectl exec credential, approving a new token via kubehook's device flow if necessary.")
+		credServer   = credential.Flag("server", "URL of the kubehook server.").Required().String()
+		credAudience = credential.Flag("audience", "Audience of the requested token.").String()
+		credLifetime = durationFlag(credential.Flag("lifetime", "Lifetime of the requested token.").Default(cred.DefaultLifetime.String()))
+		credCacheDir = credential.Flag("cache-dir", "Directory in which tokens are cached.").Default(filepath.Join(homedir.HomeDir(), ".kube", "cache", "kubehook")).String()
+
+		merge         = app.Command("kubeconfig", "Fetch a kubeconfig from kubehook and merge it into an existing kubeconfig, backing up the original.")
+		mergeServer   = merge.Flag("server", "URL of the kubehook server.").Required().String()
+		mergeLifetime = durationFlag(merge.Flag("lifetime", "Lifetime of generated tokens, e.g. 24h, 7d or P1W. Ignored if --expires-at is set.").Default(kcfg.DefaultLifetime.String()))
+		mergeExpires  = merge.Flag("expires-at", "RFC 3339 time at which generated tokens expire, e.g. 2018-01-02T15:04:05Z.").String()
+		mergeTemplate = merge.Flag("template", "Name of the kubeconfig template to fetch. Defaults to the user's default template.").String()
+		mergeCred     = merge.Flag("credential", "Kind of credential with which merged users authenticate. Defaults to the server's preference, or to token if --expires-at is set.").Enum(kubecfg.CredentialToken, kubecfg.CredentialExec)
+		mergeHeaders  = merge.Flag("header", "An HTTP header, in 'Name: value' form, sent when fetching the kubeconfig. May be repeated.").Short('H').Strings()
+		mergeFilename = merge.Flag("kubeconfig", "Kubeconfig file into which to merge. Defaults to the first file in $KUBECONFIG, or ~/.kube/config.").String()
 	)
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case credential.FullCommand():
+		c := cred.NewClient(*credServer, cred.Audience(*credAudience), cred.Lifetime(time.Duration(*credLifetime)), cred.CacheDir(*credCacheDir))
+		t, expiry, err := c.Token()
+		kingpin.FatalIfError(err, "cannot get token")
+		kingpin.FatalIfError(json.NewEncoder(os.Stdout).Encode(cred.NewExecCredential(t, expiry)), "cannot write credential")
+		return
+	case merge.FullCommand():
+		h, err := parseHeaders(*mergeHeaders)
+		kingpin.FatalIfError(err, "cannot parse headers")
+		q := url.Values{}
+		if *mergeExpires != "" {
+			_, err := time.Parse(time.RFC3339, *mergeExpires)
+			kingpin.FatalIfError(err, "cannot parse expiry time")
+			q.Set("expiresAt", *mergeExpires)
+			// Only embedded tokens can honour an expiry time.
+			if *mergeCred == "" {
+				*mergeCred = kubecfg.CredentialToken
+			}
+		} else {
+			q.Set("lifetime", mergeLifetime.String())
+		}
+		for k, v := range map[string]string{"template": *mergeTemplate, "credential": *mergeCred} {
+			if v != "" {
+				q.Set(k, v)
+			}
+		}
+		fetched, err := kcfg.Fetch(&http.Client{Timeout: kcfg.DefaultTimeout}, *mergeServer, q, h)
+		kingpin.FatalIfError(err, "cannot fetch kubeconfig")
+
+		filename := *mergeFilename
+		if filename == "" {
+			filename = clientcmd.NewDefaultClientConfigLoadingRules().GetDefaultFilename()
+		}
+		existing, err := kcfg.Load(filename)
+		kingpin.FatalIfError(err, "cannot load kubeconfig")
+		merged, err := kcfg.Merge(existing, fetched, *mergeServer)
+		kingpin.FatalIfError(err, "cannot merge kubeconfig")
+		backup, err := kcfg.Write(merged, filename)
+		kingpin.FatalIfError(err, "cannot write kubeconfig")
+		if backup != "" {
+			fmt.Fprintf(os.Stderr, "Backed up %s to %s\n", filename, backup) // nolint: gosec
+		}
+		fmt.Fprintf(os.Stderr, "Merged %d clusters from %s into %s\n", len(fetched.Clusters), *mergeServer, filename) // nolint: gosec
+		return
+	case check.FullCommand():
+		kingpin.FatalIfError(cf.check(), "invalid configuration")
+		fmt.Println("Configuration is valid") // nolint: gosec
+		return
+	}
 
 	var log *zap.Logger
 	log, err := zap.NewProduction()
-	if *debug {
+	if *f.debug {
 		log, err = zap.NewDevelopment()
 	}
 	kingpin.FatalIfError(err, "cannot create log")
+	kingpin.FatalIfError(f.check(), "invalid configuration")
+
+	gr, err := f.groupResolver()
+	kingpin.FatalIfError(err, "cannot configure group resolution")
+	ge := groups.Enricher{Resolver: gr, Policy: *f.groupMerge}
+
+	var m auth.Manager
+	switch *f.backend {
+	case backendOpaque:
+		st, err := newOpaqueStore(*f.opaqueStore, *f.opaqueBoltPath, *f.opaqueSQLDriver, *f.opaqueSQLDSN)
+		kingpin.FatalIfError(err, "cannot create opaque token store")
+		m, err = opaque.NewManager([]byte(*f.secret), st, opaque.MaxLifetime(time.Duration(*f.maxlife)), opaque.Logger(log))
+		kingpin.FatalIfError(err, "cannot create opaque token authenticator")
+	default:
+		jo := []jwt.Option{jwt.Audience(*f.audience), jwt.MaxLifetime(time.Duration(*f.maxlife)), jwt.MaxSchedule(time.Duration(*f.maxSchedule)), jwt.Logger(log)}
+		if *f.encrypt {
+			jo = append(jo, jwt.Encrypt())
+		}
+		if *f.revalidate {
+			jo = append(jo, jwt.ResolveGroups(groups.Cached(gr, *f.revalidateTTL)))
+		}
+		if *f.revalidateOpen {
+			jo = append(jo, jwt.FailOpen())
+		}
+		m, err = jwt.NewManager([]byte(*f.secret), jo...)
+		kingpin.FatalIfError(err, "cannot create JWT authenticator")
+	}
 
-	m, err := jwt.NewManager([]byte(*secret), jwt.Audience(*audience), jwt.MaxLifetime(*maxlife), jwt.Logger(log))
-	kingpin.FatalIfError(err, "cannot create JWT authenticator")
+	nz, err := f.normalizer(log)
+	kingpin.FatalIfError(err, "cannot create username normalizer")
+	g := normalize.Generator(m, nz)
 
 	r := httprouter.New()
 
 	var clientCACert []byte
-	if *clientCA != nil {
-		clientCACert, err = ioutil.ReadAll(*clientCA)
+	if *f.clientCA != "" {
+		clientCACert, err = ioutil.ReadFile(*f.clientCA)
 		kingpin.FatalIfError(err, "cannot load client CA certificate file")
 	}
 
+	var svidBundle []byte
+	if *f.spiffeBundle != "" {
+		svidBundle, err = ioutil.ReadFile(*f.spiffeBundle)
+		kingpin.FatalIfError(err, "cannot load SPIFFE trust bundle file")
+	}
+
 	s := &http.Server{
-		Addr:      *listen,
-		Handler:   logRequests(r, log),
-		TLSConfig: makeTLSConfig(clientCACert, *clientCASubject),
+		Addr:      *f.listen,
+		Handler:   logRequests(requireClientCA(r, clientCACert, *f.clientCASubject), log),
+		TLSConfig: makeTLSConfig(clientCACert, *f.clientCASubject, svidBundle),
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), *grace)
+	ctx, cancel := context.WithTimeout(context.Background(), *f.grace)
 	done := make(chan struct{})
 	shutdown := func() {
 		log.Info("shutdown", zap.Error(s.Shutdown(ctx)))
@@ -177,27 +769,125 @@ func main() {
 	kingpin.FatalIfError(err, "cannot open frontend index %s", indexPath)
 
 	h := handlers.AuthHeaders{
-		User:           *userHeader,
-		Group:          *groupHeader,
-		GroupDelimiter: *groupHeaderDelim,
+		User:           *f.userHeader,
+		Group:          *f.groupHeader,
+		GroupDelimiter: *f.groupHeaderDelim,
+		UID:            *f.uidHeader,
+	}
+
+	schedule := time.Duration(*f.maxSchedule)
+	if *f.backend == backendOpaque {
+		// Opaque tokens are valid from the moment they are generated.
+		schedule = 0
 	}
 
 	r.ServeFiles("/dist/*filepath", frontend)
 	r.HandlerFunc("GET", "/", handlers.Content(index, filepath.Base(indexPath)))
-	r.HandlerFunc("POST", "/generate", generate.Handler(m, h))
+	r.HandlerFunc("POST", "/generate", generate.Handler(g, h, ge))
+	r.HandlerFunc("GET", "/generate/options", generate.Options(schedule))
 	r.HandlerFunc("POST", "/authenticate", authenticate.Handler(m))
+
+	if l, ok := m.(auth.Lister); ok {
+		r.HandlerFunc("GET", "/tokens", tokens.List(normalize.Lister(l, nz), h))
+	} else {
+		r.HandlerFunc("GET", "/tokens", handlers.NotImplemented())
+	}
+	if rv, ok := m.(auth.Revoker); ok {
+		r.HandlerFunc("POST", "/tokens/revoke", tokens.Revoke(normalize.Revoker(rv, nz), h, *f.externalURL))
+	} else {
+		r.HandlerFunc("POST", "/tokens/revoke", handlers.NotImplemented())
+	}
+
 	r.HandlerFunc("GET", "/quitquitquit", handlers.Run(shutdown))
 	r.HandlerFunc("GET", "/healthz", handlers.Ping())
+	r.HandlerFunc("GET", "/debug/vars", handlers.Vars(kubecfg.VarReloads, kubecfg.VarLastReload, kubecfg.VarLastReloadError))
+
+	load, watch, err := f.templates()
+	kingpin.FatalIfError(err, "cannot configure kubeconfig templates")
+
+	var src kubecfg.Source
+	if load != nil {
+		rl, err := kubecfg.NewReloader(load)
+		kingpin.FatalIfError(err, "cannot load kubeconfig templates")
+		logReload := func(err error) { log.Info("reload", zap.Bool("success", err == nil), zap.Error(err)) }
+		kingpin.FatalIfError(rl.Watch([]string{watch}, done, logReload), "cannot watch kubeconfig templates")
+		go func() {
+			sighup := make(chan os.Signal, 1)
+			signal.Notify(sighup, syscall.SIGHUP)
+			for range sighup {
+				logReload(rl.Reload())
+			}
+		}()
+		src = rl
+	}
+	if *f.discoveryCfg != "" {
+		rcs, err := restConfigs(*f.discoveryCfg)
+		kingpin.FatalIfError(err, "cannot load cluster discovery kubeconfig")
+		d, err := kubecfg.NewDiscovery(src, rcs, kubecfg.Interval(*f.discoveryIval), kubecfg.Logger(log))
+		kingpin.FatalIfError(err, "cannot create cluster discovery")
+		log.Info("discovery", zap.Error(d.Refresh()))
+		go d.Run(done)
+		src = d
+	}
 
-	if *template != "" {
-		t, err := kubecfg.LoadTemplate(*template)
-		kingpin.FatalIfError(err, "cannot load kubeconfig template")
-		r.HandlerFunc("GET", "/kubecfg", kubecfg.Handler(m, t, h))
+	e := kubecfg.Exec{Command: *f.execCommand, Server: *f.externalURL, Default: *f.execDefault}
+	us := kubecfg.Users{}
+	us.Name, err = kubecfg.ParseUserName(*f.userName)
+	kingpin.FatalIfError(err, "cannot parse kubecfg user name")
+	if *f.namespaceRules != "" {
+		rules, err := kubecfg.LoadNamespaceRules(*f.namespaceRules)
+		kingpin.FatalIfError(err, "cannot load kubecfg namespace rules")
+		us.Namespaces, err = kubecfg.NewNamespacer(rules)
+		kingpin.FatalIfError(err, "cannot create kubecfg namespacer")
+	}
+	if src != nil {
+		r.HandlerFunc("GET", "/kubecfg", kubecfg.Handler(g, src, h, e, us, ge, nz))
+		r.HandlerFunc("GET", "/kubecfg/templates", kubecfg.List(src, h, ge))
 	} else {
 		r.HandlerFunc("GET", "/kubecfg", handlers.NotImplemented())
+		r.HandlerFunc("GET", "/kubecfg/templates", handlers.NotImplemented())
+	}
+
+	// Devices may request tokens for any audience kubehook issues tokens for.
+	// Opaque tokens do not support audiences.
+	var auds hdevice.Audiences
+	if *f.backend == backendJWT {
+		auds = func() []string {
+			a := []string{*f.audience}
+			if src != nil {
+				a = append(a, src.Templates().Audiences()...)
+			}
+			return a
+		}
+	}
+	ds := device.NewStore(device.Expiry(*f.deviceExpiry), device.MaxPending(*f.deviceMax), device.MaxPendingPerClient(*f.deviceMaxClient))
+	r.HandlerFunc("GET", hdevice.VerificationPath, handlers.Content(index, filepath.Base(indexPath)))
+	r.HandlerFunc("POST", "/device/code", hdevice.Authorization(ds, *f.externalURL, auds))
+	r.HandlerFunc("POST", "/device/token", hdevice.Token(ds))
+	r.HandlerFunc("GET", "/device/pending", hdevice.Pending(ds, h))
+	r.HandlerFunc("POST", "/device/approve", hdevice.Approve(g, ds, h, ge, *f.externalURL))
+
+	if *f.exchangeCfg != "" {
+		clusters, err := exchangeClusters(*f.exchangeCfg, *f.exchangeGroups, f.exchangeAudiences(), log)
+		kingpin.FatalIfError(err, "cannot load token exchange clusters")
+		r.HandlerFunc("POST", "/exchange", exchange.Handler(g, clusters))
+	} else {
+		r.HandlerFunc("POST", "/exchange", handlers.NotImplemented())
+	}
+
+	if len(svidBundle) > 0 {
+		rules, err := spiffe.LoadRules(*f.spiffeRules)
+		kingpin.FatalIfError(err, "cannot load SPIFFE rules")
+		sm, err := spiffe.NewMapper(rules)
+		kingpin.FatalIfError(err, "cannot create SPIFFE ID mapper")
+		bundle := x509.NewCertPool()
+		bundle.AppendCertsFromPEM(svidBundle)
+		r.HandlerFunc("POST", "/svid", svid.Handler(g, sm, bundle))
+	} else {
+		r.HandlerFunc("POST", "/svid", handlers.NotImplemented())
 	}
 
-	log.Info("shutdown", zap.Error(listenAndServe(s, *tlsCert, *tlsKey)))
+	log.Info("shutdown", zap.Error(listenAndServe(s, *f.tlsCert, *f.tlsKey)))
 
 	<-done
 	cancel()
@@ -0,0 +1,275 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package credential
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for the credential helper.
+const (
+	DefaultLifetime    = 24 * time.Hour
+	DefaultMinValidity = time.Minute
+	DefaultAPIVersion  = "client.authentication.k8s.io/v1beta1"
+
+	// DefaultTimeout bounds each request to the kubehook server, so that an
+	// unresponsive server cannot hang kubectl.
+	DefaultTimeout = 30 * time.Second
+)
+
+const (
+	grantType       = "urn:ietf:params:oauth:grant-type:device_code"
+	errPending      = "authorization_pending"
+	errSlowDown     = "slow_down"
+	slowDownPenalty = 5 * time.Second
+)
+
+// An ExecCredential is returned to kubectl by an exec credential plugin.
+type ExecCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Status     *ExecCredentialStatus `json:"status,omitempty"`
+}
+
+// ExecCredentialStatus holds the credential kubectl should use.
+type ExecCredentialStatus struct {
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+	Token               string     `json:"token"`
+}
+
+// NewExecCredential returns an ExecCredential for the supplied token. The
+// API version is read from the KUBERNETES_EXEC_INFO environment variable set
+// by kubectl, if any.
+func NewExecCredential(token string, expiry time.Time) *ExecCredential {
+	c := &ExecCredential{APIVersion: DefaultAPIVersion}
+	if info := os.Getenv("KUBERNETES_EXEC_INFO"); info != "" {
+		json.Unmarshal([]byte(info), c) // nolint: gosec
+	}
+	c.Kind = "ExecCredential"
+	c.Status = &ExecCredentialStatus{Token: token, ExpirationTimestamp: &expiry}
+	return c
+}
+
+type authorizationRsp struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type tokenRsp struct {
+	AccessToken string `json:"access_token,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type cached struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// A Client obtains tokens from kubehook using the OAuth 2.0 device
+// authorization grant, caching them until they expire.
+type Client struct {
+	server      string
+	audience    string
+	lifetime    time.Duration
+	minValidity time.Duration
+	cacheDir    string
+	prompt      io.Writer
+	hc          *http.Client
+	now         func() time.Time
+	sleep       func(time.Duration)
+}
+
+// An Option represents an optional argument to NewClient.
+type Option func(*Client)
+
+// Audience of the requested token.
+func Audience(a string) Option {
+	return func(c *Client) {
+		c.audience = a
+	}
+}
+
+// Lifetime of the requested token.
+func Lifetime(d time.Duration) Option {
+	return func(c *Client) {
+		c.lifetime = d
+	}
+}
+
+// CacheDir is the directory in which tokens are cached. Tokens are not cached
+// if it is empty.
+func CacheDir(dir string) Option {
+	return func(c *Client) {
+		c.cacheDir = dir
+	}
+}
+
+// Prompt is where the user is told how to approve a token request.
+func Prompt(w io.Writer) Option {
+	return func(c *Client) {
+		c.prompt = w
+	}
+}
+
+// HTTPClient allows the use of a custom HTTP client.
+func HTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.hc = hc
+	}
+}
+
+// NewClient returns a client of the kubehook server at the supplied URL.
+func NewClient(server string, co ...Option) *Client {
+	c := &Client{
+		server:      strings.TrimSuffix(server, "/"),
+		lifetime:    DefaultLifetime,
+		minValidity: DefaultMinValidity,
+		prompt:      os.Stderr,
+		hc:          &http.Client{Timeout: DefaultTimeout},
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+	for _, o := range co {
+		o(c)
+	}
+	return c
+}
+
+// Token returns a cached token if one remains valid, or requests a new token.
+func (c *Client) Token() (string, time.Time, error) {
+	if t, ok := c.load(); ok {
+		return t.Token, t.Expiry, nil
+	}
+	t, err := c.request()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.save(t); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "cannot cache token")
+	}
+	return t.Token, t.Expiry, nil
+}
+
+func (c *Client) request() (*cached, error) {
+	f := url.Values{"lifetime": []string{c.lifetime.String()}}
+	if c.audience != "" {
+		f.Set("audience", c.audience)
+	}
+	a := &authorizationRsp{}
+	if err := c.post("/device/code", f, a); err != nil {
+		return nil, errors.Wrap(err, "cannot request device authorization")
+	}
+
+	fmt.Fprintf(c.prompt, "To authenticate, visit %s and confirm code %s\n", a.VerificationURIComplete, a.UserCode) // nolint: gosec
+
+	interval := time.Duration(a.Interval) * time.Second
+	deadline := c.now().Add(time.Duration(a.ExpiresIn) * time.Second)
+	f = url.Values{"grant_type": []string{grantType}, "device_code": []string{a.DeviceCode}}
+	for c.now().Before(deadline) {
+		c.sleep(interval)
+
+		t := &tokenRsp{}
+		if err := c.post("/device/token", f, t); err != nil {
+			return nil, errors.Wrap(err, "cannot poll for token")
+		}
+		switch t.Error {
+		case "":
+			return &cached{Token: t.AccessToken, Expiry: c.now().Add(time.Duration(t.ExpiresIn) * time.Second)}, nil
+		case errPending:
+			continue
+		case errSlowDown:
+			interval += slowDownPenalty
+			continue
+		default:
+			return nil, errors.Errorf("cannot get token: %s", t.Error)
+		}
+	}
+	return nil, errors.New("device authorization request expired")
+}
+
+// post a form to kubehook, decoding its JSON response. Token endpoint error
+// responses are decoded rather than returned as errors.
+func (c *Client) post(path string, f url.Values, into interface{}) error {
+	rsp, err := c.hc.PostForm(c.server+path, f)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK && rsp.StatusCode != http.StatusBadRequest {
+		return errors.Errorf("%s returned HTTP %d", path, rsp.StatusCode)
+	}
+	return errors.Wrap(json.NewDecoder(rsp.Body).Decode(into), "cannot decode response")
+}
+
+// cacheFile returns the file in which tokens are cached. Tokens requested with
+// different lifetimes are cached separately, because kubeconfig templates may
+// cap the lifetime of tokens for clusters that share an audience.
+func (c *Client) cacheFile() string {
+	h := sha256.Sum256([]byte(c.server + "\n" + c.audience + "\n" + c.lifetime.String()))
+	return filepath.Join(c.cacheDir, hex.EncodeToString(h[:8])+".json")
+}
+
+func (c *Client) load() (*cached, bool) {
+	if c.cacheDir == "" {
+		return nil, false
+	}
+	b, err := ioutil.ReadFile(c.cacheFile())
+	if err != nil {
+		return nil, false
+	}
+	t := &cached{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, false
+	}
+	now := c.now()
+	if !now.Add(c.minValidity).Before(t.Expiry) || t.Expiry.After(now.Add(c.lifetime)) {
+		return nil, false
+	}
+	return t, true
+}
+
+func (c *Client) save(t *cached) error {
+	if c.cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.cacheDir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.cacheFile(), b, 0600)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package credential
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/planetlabs/kubehook/device"
+	hdevice "github.com/planetlabs/kubehook/handlers/device"
+)
+
+// approvingServer serves the device authorization grant, approving every
+// request as soon as it is made.
+func approvingServer(t *testing.T, deny bool) (*httptest.Server, *int) {
+	s := device.NewStore(device.Interval(0))
+	requests := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		rec := httptest.NewRecorder()
+		hdevice.Authorization(s, "", func() []string { return []string{"prod"} })(rec, r)
+
+		a := &authorizationRsp{}
+		if err := json.Unmarshal(rec.Body.Bytes(), a); err != nil {
+			t.Fatalf("json.Unmarshal(%v, %+v): %v", rec.Body, a, err)
+		}
+		req, err := s.Pending(a.UserCode)
+		if err != nil {
+			t.Fatalf("s.Pending(%v): %v", a.UserCode, err)
+		}
+		if deny {
+			s.Deny(a.UserCode) // nolint: gosec
+		} else {
+			s.Approve(a.UserCode, "token-for-"+req.Audience, req.Lifetime) // nolint: gosec
+		}
+
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes()) // nolint: gosec
+	})
+	mux.HandleFunc("/device/token", hdevice.Token(s))
+	return httptest.NewServer(mux), &requests
+}
+
+func TestToken(t *testing.T) {
+	srv, requests := approvingServer(t, false)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	prompt := &bytes.Buffer{}
+	c := NewClient(srv.URL, Audience("prod"), Lifetime(time.Hour), CacheDir(dir), Prompt(prompt))
+	c.sleep = func(time.Duration) {}
+
+	token, expiry, err := c.Token()
+	if err != nil {
+		t.Fatalf("c.Token(): %v", err)
+	}
+	if token != "token-for-prod" {
+		t.Errorf("c.Token(): want token-for-prod, got %v", token)
+	}
+	if expiry.Sub(time.Now()) > time.Hour {
+		t.Errorf("c.Token(): want expiry within %v, got %v", time.Hour, expiry)
+	}
+	if !strings.Contains(prompt.String(), "/device?user_code=") {
+		t.Errorf("prompt: want verification URI, got %q", prompt.String())
+	}
+
+	// The second token should be served from the cache.
+	if _, _, err := c.Token(); err != nil {
+		t.Fatalf("c.Token(): %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("requests: want 1, got %d", *requests)
+	}
+
+	// Tokens for other audiences are cached separately.
+	other := NewClient(srv.URL, CacheDir(dir), Prompt(prompt))
+	other.sleep = c.sleep
+	if token, _, err := other.Token(); err != nil || token != "token-for-" {
+		t.Errorf("other.Token(): want token-for-, got %v, %v", token, err)
+	}
+	if *requests != 2 {
+		t.Errorf("requests: want 2, got %d", *requests)
+	}
+
+	// Tokens with shorter lifetimes are cached separately.
+	short := NewClient(srv.URL, Audience("prod"), Lifetime(30*time.Minute), CacheDir(dir), Prompt(prompt))
+	short.sleep = c.sleep
+	_, expiry, err = short.Token()
+	if err != nil {
+		t.Fatalf("short.Token(): %v", err)
+	}
+	if expiry.Sub(time.Now()) > 30*time.Minute {
+		t.Errorf("short.Token(): want expiry within %v, got %v", 30*time.Minute, expiry)
+	}
+	if *requests != 3 {
+		t.Errorf("requests: want 3, got %d", *requests)
+	}
+}
+
+func TestTokenOutlivesLifetime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewClient("https://kubehook.example.org", Lifetime(time.Hour), CacheDir(dir))
+	if err := c.save(&cached{Token: "token", Expiry: time.Now().Add(24 * time.Hour)}); err != nil {
+		t.Fatalf("c.save(...): %v", err)
+	}
+	if _, ok := c.load(); ok {
+		t.Errorf("c.load(): want cached token that outlives the requested lifetime to be ignored")
+	}
+}
+
+func TestTokenDenied(t *testing.T) {
+	srv, _ := approvingServer(t, true)
+	defer srv.Close()
+
+	c := NewClient(srv.URL, Prompt(&bytes.Buffer{}))
+	c.sleep = func(time.Duration) {}
+
+	if _, _, err := c.Token(); err == nil {
+		t.Errorf("c.Token(): want error for denied request, got nil")
+	}
+}
+
+func TestNewExecCredential(t *testing.T) {
+	expiry := time.Unix(1000000, 0).UTC()
+
+	os.Setenv("KUBERNETES_EXEC_INFO", `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","spec":{}}`)
+	defer os.Unsetenv("KUBERNETES_EXEC_INFO")
+
+	c := NewExecCredential("token", expiry)
+	if c.APIVersion != "client.authentication.k8s.io/v1" {
+		t.Errorf("c.APIVersion: want client.authentication.k8s.io/v1, got %v", c.APIVersion)
+	}
+	if c.Status.Token != "token" || !c.Status.ExpirationTimestamp.Equal(expiry) {
+		t.Errorf("c.Status: want token expiring at %v, got %+v", expiry, c.Status)
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package device
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults for device authorization requests.
+const (
+	DefaultExpiry              = 10 * time.Minute
+	DefaultInterval            = 5 * time.Second
+	DefaultMaxPending          = 10000
+	DefaultMaxPendingPerClient = 10
+)
+
+// Errors returned when polling for an access token. These map to the error
+// codes defined by RFC 8628 section 3.5.
+var (
+	ErrPending  = errors.New("authorization_pending")
+	ErrSlowDown = errors.New("slow_down")
+	ErrDenied   = errors.New("access_denied")
+	ErrExpired  = errors.New("expired_token")
+	ErrNotFound = errors.New("invalid_grant")
+)
+
+// Errors returned when creating a device authorization request.
+var (
+	// ErrFull indicates the store holds as many pending requests as it may.
+	ErrFull = errors.New("too many pending device authorization requests")
+
+	// ErrClientFull indicates the client has as many pending requests as it
+	// may.
+	ErrClientFull = errors.New("too many pending device authorization requests from client")
+)
+
+// User codes are drawn from consonants only, per RFC 8628 section 6.1, to
+// avoid accidentally spelling words and to ease manual entry.
+const (
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	deviceCodeBytes = 32
+	slowDownPenalty = 5 * time.Second
+)
+
+// A Request describes the token a device requests. Its fields are optional.
+type Request struct {
+	Audience string        // Audience for which the token should be valid.
+	Lifetime time.Duration // Lifetime is the maximum lifetime of the token.
+}
+
+// A Code is a pending device authorization request.
+type Code struct {
+	DeviceCode string        // DeviceCode is polled for by the device.
+	UserCode   string        // UserCode is entered by the user to approve the device.
+	Expiry     time.Time     // Expiry is the time after which this request is invalid.
+	Interval   time.Duration // Interval is the minimum time between polls.
+	Request
+
+	client    string
+	lastPoll  time.Time
+	token     string
+	tokenLife time.Duration
+	denied    bool
+}
+
+// ExpiresIn returns the remaining validity of the code.
+func (c *Code) ExpiresIn(now time.Time) time.Duration {
+	return c.Expiry.Sub(now)
+}
+
+// A Store holds the pending requests of the OAuth 2.0 device authorization
+// grant described by RFC 8628 until they expire.
+type Store struct {
+	mx       sync.Mutex
+	byDevice map[string]*Code
+	byUser   map[string]*Code
+	byClient map[string]int
+	expiry   time.Duration
+	interval time.Duration
+	max      int
+	maxPer   int
+	now      func() time.Time
+}
+
+// An Option represents an optional argument to NewStore.
+type Option func(*Store)
+
+// Expiry is the lifetime of a device authorization request.
+func Expiry(d time.Duration) Option {
+	return func(s *Store) {
+		s.expiry = d
+	}
+}
+
+// Interval is the minimum time devices must wait between polls.
+func Interval(d time.Duration) Option {
+	return func(s *Store) {
+		s.interval = d
+	}
+}
+
+// MaxPending is the maximum number of pending requests the store may hold.
+func MaxPending(n int) Option {
+	return func(s *Store) {
+		s.max = n
+	}
+}
+
+// MaxPendingPerClient is the maximum number of pending requests the store may
+// hold for any one client.
+func MaxPendingPerClient(n int) Option {
+	return func(s *Store) {
+		s.maxPer = n
+	}
+}
+
+// NewStore returns an in-memory store of device authorization requests.
+func NewStore(so ...Option) *Store {
+	s := &Store{
+		byDevice: make(map[string]*Code),
+		byUser:   make(map[string]*Code),
+		byClient: make(map[string]int),
+		expiry:   DefaultExpiry,
+		interval: DefaultInterval,
+		max:      DefaultMaxPending,
+		maxPer:   DefaultMaxPendingPerClient,
+		now:      time.Now,
+	}
+	for _, o := range so {
+		o(s)
+	}
+	return s
+}
+
+// New creates a pending device authorization request on behalf of the supplied
+// client, typically identified by its network address. It returns ErrFull or
+// ErrClientFull if the store or client already has the maximum number of
+// pending requests.
+func (s *Store) New(client string, r Request) (*Code, error) {
+	dc, err := deviceCode()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate device code")
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.gc()
+	if len(s.byDevice) >= s.max {
+		return nil, ErrFull
+	}
+	if s.byClient[client] >= s.maxPer {
+		return nil, ErrClientFull
+	}
+
+	var uc string
+	for {
+		uc, err = userCode()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot generate user code")
+		}
+		if _, exists := s.byUser[uc]; !exists {
+			break
+		}
+	}
+
+	c := &Code{DeviceCode: dc, UserCode: uc, Expiry: s.now().Add(s.expiry), Interval: s.interval, Request: r, client: client}
+	s.byDevice[dc] = c
+	s.byUser[uc] = c
+	s.byClient[client]++
+
+	// Return a copy so callers cannot race with pollers.
+	cp := *c
+	return &cp, nil
+}
+
+// Pending returns the token requested by the undecided request identified by the
+// supplied user code.
+func (s *Store) Pending(userCode string) (Request, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	c, err := s.pending(userCode)
+	if err != nil {
+		return Request{}, err
+	}
+	return c.Request, nil
+}
+
+// Approve the request identified by the supplied user code, associating it with
+// the supplied token.
+func (s *Store) Approve(userCode, token string, lifetime time.Duration) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	c, err := s.pending(userCode)
+	if err != nil {
+		return err
+	}
+	c.token = token
+	c.tokenLife = lifetime
+	return nil
+}
+
+// Deny the request identified by the supplied user code.
+func (s *Store) Deny(userCode string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	c, err := s.pending(userCode)
+	if err != nil {
+		return err
+	}
+	c.denied = true
+	return nil
+}
+
+// Poll for the token associated with the supplied device code. The request is
+// removed from the store once a token has been returned, or access denied.
+func (s *Store) Poll(deviceCode string) (string, time.Duration, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	c, ok := s.byDevice[deviceCode]
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+
+	now := s.now()
+	if !now.Before(c.Expiry) {
+		s.remove(c)
+		return "", 0, ErrExpired
+	}
+	if c.denied {
+		s.remove(c)
+		return "", 0, ErrDenied
+	}
+	if c.token != "" {
+		s.remove(c)
+		return c.token, c.tokenLife, nil
+	}
+	if !c.lastPoll.IsZero() && now.Sub(c.lastPoll) < c.Interval {
+		c.lastPoll = now
+		c.Interval += slowDownPenalty
+		return "", 0, ErrSlowDown
+	}
+	c.lastPoll = now
+	return "", 0, ErrPending
+}
+
+// pending returns the unexpired, undecided request for the supplied user code.
+func (s *Store) pending(userCode string) (*Code, error) {
+	c, ok := s.byUser[NormalizeUserCode(userCode)]
+	if !ok || !s.now().Before(c.Expiry) {
+		return nil, errors.Errorf("unknown or expired user code %s", userCode)
+	}
+	if c.token != "" || c.denied {
+		return nil, errors.Errorf("user code %s has already been used", userCode)
+	}
+	return c, nil
+}
+
+func (s *Store) remove(c *Code) {
+	delete(s.byDevice, c.DeviceCode)
+	delete(s.byUser, c.UserCode)
+	if s.byClient[c.client]--; s.byClient[c.client] <= 0 {
+		delete(s.byClient, c.client)
+	}
+}
+
+// gc removes expired requests. It must be called with the lock held.
+func (s *Store) gc() {
+	now := s.now()
+	for _, c := range s.byDevice {
+		if !now.Before(c.Expiry) {
+			s.remove(c)
+		}
+	}
+}
+
+// NormalizeUserCode canonicalises a user code as entered by a user, ignoring
+// case, whitespace, and dashes.
+func NormalizeUserCode(uc string) string {
+	uc = strings.ToUpper(uc)
+	uc = strings.NewReplacer("-", "", " ", "").Replace(uc)
+	if len(uc) != userCodeLength {
+		return uc
+	}
+	return uc[:userCodeLength/2] + "-" + uc[userCodeLength/2:]
+}
+
+func userCode() (string, error) {
+	b := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeCharset)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeCharset[n.Int64()]
+	}
+	return NormalizeUserCode(string(b)), nil
+}
+
+func deviceCode() (string, error) {
+	b := make([]byte, deviceCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
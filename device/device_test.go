@@ -0,0 +1,189 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestStore() (*Store, *clock) {
+	c := &clock{t: time.Unix(1000000, 0)}
+	s := NewStore(Expiry(time.Minute), Interval(5*time.Second))
+	s.now = c.now
+	return s, c
+}
+
+func TestApprove(t *testing.T) {
+	s, clk := newTestStore()
+	req := Request{Audience: "prod", Lifetime: time.Hour}
+	c, err := s.New("client", req)
+	if err != nil {
+		t.Fatalf("s.New(%+v): %v", req, err)
+	}
+
+	got, err := s.Pending(c.UserCode)
+	if err != nil {
+		t.Fatalf("s.Pending(%s): %v", c.UserCode, err)
+	}
+	if got != req {
+		t.Errorf("s.Pending(%s): want %+v, got %+v", c.UserCode, req, got)
+	}
+
+	if _, _, err := s.Poll(c.DeviceCode); err != ErrPending {
+		t.Errorf("s.Poll(...): want %v, got %v", ErrPending, err)
+	}
+
+	clk.advance(time.Second)
+	if _, _, err := s.Poll(c.DeviceCode); err != ErrSlowDown {
+		t.Errorf("s.Poll(...): want %v, got %v", ErrSlowDown, err)
+	}
+
+	// Users may enter codes in lower case without a dash.
+	uc := strings.ToLower(strings.Replace(c.UserCode, "-", "", -1))
+	if err := s.Approve(uc, "token", time.Hour); err != nil {
+		t.Fatalf("s.Approve(%s): %v", uc, err)
+	}
+	if err := s.Approve(c.UserCode, "token", time.Hour); err == nil {
+		t.Errorf("s.Approve(%s): want error approving used code, got nil", c.UserCode)
+	}
+	if _, err := s.Pending(c.UserCode); err == nil {
+		t.Errorf("s.Pending(%s): want error for used code, got nil", c.UserCode)
+	}
+
+	clk.advance(20 * time.Second)
+	token, life, err := s.Poll(c.DeviceCode)
+	if err != nil {
+		t.Fatalf("s.Poll(...): %v", err)
+	}
+	if token != "token" || life != time.Hour {
+		t.Errorf("s.Poll(...): want token, %v, got %s, %v", time.Hour, token, life)
+	}
+
+	// Tokens may only be retrieved once.
+	if _, _, err := s.Poll(c.DeviceCode); err != ErrNotFound {
+		t.Errorf("s.Poll(...): want %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	s, _ := newTestStore()
+	c, err := s.New("client", Request{})
+	if err != nil {
+		t.Fatalf("s.New(client, Request{}): %v", err)
+	}
+	if err := s.Deny(c.UserCode); err != nil {
+		t.Fatalf("s.Deny(%s): %v", c.UserCode, err)
+	}
+	if _, _, err := s.Poll(c.DeviceCode); err != ErrDenied {
+		t.Errorf("s.Poll(...): want %v, got %v", ErrDenied, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s, clk := newTestStore()
+	c, err := s.New("client", Request{})
+	if err != nil {
+		t.Fatalf("s.New(client, Request{}): %v", err)
+	}
+	clk.advance(2 * time.Minute)
+
+	if err := s.Approve(c.UserCode, "token", time.Hour); err == nil {
+		t.Errorf("s.Approve(%s): want error approving expired code, got nil", c.UserCode)
+	}
+	if _, _, err := s.Poll(c.DeviceCode); err != ErrExpired {
+		t.Errorf("s.Poll(...): want %v, got %v", ErrExpired, err)
+	}
+
+	// Expired codes are garbage collected when new codes are created.
+	e, err := s.New("client", Request{})
+	if err != nil {
+		t.Fatalf("s.New(client, Request{}): %v", err)
+	}
+	clk.advance(2 * time.Minute)
+	if _, err := s.New("client", Request{}); err != nil {
+		t.Fatalf("s.New(client, Request{}): %v", err)
+	}
+	if _, ok := s.byDevice[e.DeviceCode]; ok {
+		t.Errorf("expired device code %s was not garbage collected", e.DeviceCode)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	s, clk := newTestStore()
+	s.max, s.maxPer = 3, 2
+
+	for _, client := range []string{"a", "a", "b"} {
+		if _, err := s.New(client, Request{}); err != nil {
+			t.Fatalf("s.New(%s, Request{}): %v", client, err)
+		}
+	}
+	if _, err := s.New("c", Request{}); err != ErrFull {
+		t.Errorf("s.New(c, Request{}): want %v, got %v", ErrFull, err)
+	}
+
+	// Expired codes no longer count toward either limit.
+	clk.advance(2 * time.Minute)
+	a, err := s.New("a", Request{})
+	if err != nil {
+		t.Fatalf("s.New(a, Request{}): %v", err)
+	}
+	if _, err := s.New("a", Request{}); err != nil {
+		t.Fatalf("s.New(a, Request{}): %v", err)
+	}
+	if _, err := s.New("a", Request{}); err != ErrClientFull {
+		t.Errorf("s.New(a, Request{}): want %v, got %v", ErrClientFull, err)
+	}
+
+	// Decided codes no longer count once they have been polled.
+	if err := s.Deny(a.UserCode); err != nil {
+		t.Fatalf("s.Deny(%s): %v", a.UserCode, err)
+	}
+	if _, _, err := s.Poll(a.DeviceCode); err != ErrDenied {
+		t.Fatalf("s.Poll(...): want %v, got %v", ErrDenied, err)
+	}
+	if _, err := s.New("a", Request{}); err != nil {
+		t.Errorf("s.New(a, Request{}): %v", err)
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	cases := map[string]string{
+		"bcdf-ghjk":   "BCDF-GHJK",
+		"BCDFGHJK":    "BCDF-GHJK",
+		" bcdf ghjk ": "BCDF-GHJK",
+		"BCD":         "BCD",
+	}
+	for in, want := range cases {
+		if got := NormalizeUserCode(in); got != want {
+			t.Errorf("NormalizeUserCode(%q): want %q, got %q", in, want, got)
+		}
+	}
+}
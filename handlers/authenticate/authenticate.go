@@ -82,12 +82,20 @@ func write(w http.ResponseWriter, trStatus v1beta1.TokenReviewStatus, httpStatus
 }
 
 func tokenReviewStatus(u *auth.User) v1beta1.TokenReviewStatus {
+	var extra map[string]v1beta1.ExtraValue
+	if len(u.Extra) > 0 {
+		extra = make(map[string]v1beta1.ExtraValue, len(u.Extra))
+		for k, v := range u.Extra {
+			extra[k] = v1beta1.ExtraValue(v)
+		}
+	}
 	return v1beta1.TokenReviewStatus{
 		Authenticated: true,
 		User: v1beta1.UserInfo{
 			Username: u.Username,
 			UID:      u.UID,
 			Groups:   u.Groups,
+			Extra:    extra,
 		},
 	}
 }
@@ -48,11 +48,11 @@ func testUser(u string) *tu {
 }
 
 func (t *tu) Auth() *auth.User {
-	return &auth.User{Username: t.u, UID: "test/" + t.u, Groups: []string{"test"}}
+	return &auth.User{Username: t.u, UID: "test/" + t.u, Groups: []string{"test"}, Extra: map[string][]string{auth.ExtraLabel: {"laptop"}}}
 }
 
 func (t *tu) UserInfo() v1beta1.UserInfo {
-	return v1beta1.UserInfo{Username: t.u, UID: "test/" + t.u, Groups: []string{"test"}}
+	return v1beta1.UserInfo{Username: t.u, UID: "test/" + t.u, Groups: []string{"test"}, Extra: map[string]v1beta1.ExtraValue{auth.ExtraLabel: {"laptop"}}}
 }
 
 func TestHandler(t *testing.T) {
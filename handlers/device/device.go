@@ -0,0 +1,294 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
+	"github.com/planetlabs/kubehook/device"
+	"github.com/planetlabs/kubehook/handlers"
+	"github.com/planetlabs/kubehook/lifetime"
+
+	"github.com/pkg/errors"
+)
+
+// GrantType is the OAuth 2.0 grant type of the device authorization grant.
+const GrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// VerificationPath is the path at which users approve device authorization
+// requests.
+const VerificationPath = "/device"
+
+const tokenType = "Bearer"
+
+const (
+	formAudience = "audience"
+	formLifetime = "lifetime"
+)
+
+type authorizationRsp struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type tokenRsp struct {
+	AccessToken string `json:"access_token,omitempty"`
+	TokenType   string `json:"token_type,omitempty"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type approveReq struct {
+	UserCode string            `json:"userCode"`
+	Lifetime lifetime.Duration `json:"lifetime"`
+	Deny     bool              `json:"deny,omitempty"`
+}
+
+type approveRsp struct {
+	Error string `json:"error,omitempty"`
+}
+
+type pendingRsp struct {
+	Audience string            `json:"audience,omitempty"`
+	Lifetime lifetime.Duration `json:"lifetime,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Audiences returns the audiences for which devices may request tokens.
+type Audiences func() []string
+
+// Authorization returns an HTTP handler function that starts a device
+// authorization request, per RFC 8628 section 3.1. Devices may request a token
+// audience and maximum lifetime using the optional audience and lifetime form
+// parameters. Only the supplied audiences may be requested; devices may request
+// no particular audience if audiences is nil. Users are directed to the
+// verification path under the supplied external URL. If no external URL is
+// supplied it is derived from the request. Clients that already have the
+// maximum number of pending requests are told to slow down.
+func Authorization(s *device.Store, externalURL string, audiences Audiences) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if err := r.ParseForm(); err != nil {
+			write(w, tokenRsp{Error: "invalid_request"}, http.StatusBadRequest)
+			return
+		}
+		req := device.Request{Audience: r.PostForm.Get(formAudience)}
+		if req.Audience != "" && !allowed(audiences, req.Audience) {
+			write(w, tokenRsp{Error: "invalid_target"}, http.StatusBadRequest)
+			return
+		}
+		if l := r.PostForm.Get(formLifetime); l != "" {
+			d, err := lifetime.ParseDuration(l)
+			if err != nil {
+				write(w, tokenRsp{Error: "invalid_request"}, http.StatusBadRequest)
+				return
+			}
+			req.Lifetime = time.Duration(d)
+		}
+
+		c, err := s.New(handlers.ClientAddress(r), req)
+		switch err {
+		case nil:
+		case device.ErrClientFull:
+			write(w, tokenRsp{Error: "slow_down"}, http.StatusTooManyRequests)
+			return
+		case device.ErrFull:
+			write(w, tokenRsp{Error: "temporarily_unavailable"}, http.StatusServiceUnavailable)
+			return
+		default:
+			write(w, tokenRsp{Error: "server_error"}, http.StatusInternalServerError)
+			return
+		}
+
+		base := externalURL
+		if base == "" {
+			base = handlers.RequestURL(r)
+		}
+		v := strings.TrimSuffix(base, "/") + VerificationPath
+		write(w, authorizationRsp{
+			DeviceCode:              c.DeviceCode,
+			UserCode:                c.UserCode,
+			VerificationURI:         v,
+			VerificationURIComplete: v + "?" + url.Values{"user_code": []string{c.UserCode}}.Encode(),
+			ExpiresIn:               int64(c.ExpiresIn(time.Now()) / time.Second),
+			Interval:                int64(c.Interval / time.Second),
+		}, http.StatusOK)
+	}
+}
+
+// Token returns an HTTP handler function that devices poll for an access token,
+// per RFC 8628 section 3.4.
+func Token(s *device.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if err := r.ParseForm(); err != nil {
+			write(w, tokenRsp{Error: "invalid_request"}, http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("grant_type") != GrantType {
+			write(w, tokenRsp{Error: "unsupported_grant_type"}, http.StatusBadRequest)
+			return
+		}
+
+		t, l, err := s.Poll(r.PostForm.Get("device_code"))
+		if err != nil {
+			write(w, tokenRsp{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		write(w, tokenRsp{AccessToken: t, TokenType: tokenType, ExpiresIn: int64(l / time.Second)}, http.StatusOK)
+	}
+}
+
+// Pending returns an HTTP handler function that describes the token requested by
+// the undecided device authorization request identified by the user_code query
+// parameter, so that users may review it before approval per RFC 8628 section
+// 5.4. A device that requested no maximum lifetime omits it.
+func Pending(s *device.Store, h handlers.AuthHeaders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if _, err := h.Extract(r); err != nil {
+			write(w, pendingRsp{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		uc := r.URL.Query().Get("user_code")
+		if uc == "" {
+			write(w, pendingRsp{Error: "must specify a user code"}, http.StatusBadRequest)
+			return
+		}
+		dr, err := s.Pending(uc)
+		if err != nil {
+			write(w, pendingRsp{Error: errors.Wrap(err, "cannot find device").Error()}, http.StatusNotFound)
+			return
+		}
+		write(w, pendingRsp{Audience: dr.Audience, Lifetime: lifetime.Duration(dr.Lifetime)}, http.StatusOK)
+	}
+}
+
+// Approve returns an HTTP handler function that allows the requesting user to
+// approve or deny a device authorization request. Approved requests are issued
+// a JSON web token for the requesting user, valid for the audience the device
+// requested. The token's lifetime is the shorter of that approved by the user
+// and that requested by the device. The groups of the requesting user are
+// enriched by the supplied Enricher. Requests must be JSON requests from the
+// origin of the supplied external URL, or from the origin at which they reached
+// kubehook if no external URL is supplied.
+func Approve(g auth.Generator, s *device.Store, h handlers.AuthHeaders, ge groups.Enricher, externalURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if err := handlers.CheckSameOrigin(r, externalURL); err != nil {
+			write(w, approveRsp{Error: err.Error()}, http.StatusForbidden)
+			return
+		}
+
+		req := &approveReq{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			write(w, approveRsp{Error: errors.Wrap(err, "cannot parse JSON request body").Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.UserCode == "" {
+			write(w, approveRsp{Error: "must specify a user code"}, http.StatusBadRequest)
+			return
+		}
+
+		u, err := h.Extract(r)
+		if err != nil {
+			write(w, approveRsp{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		if req.Deny {
+			if err := s.Deny(req.UserCode); err != nil {
+				write(w, approveRsp{Error: errors.Wrap(err, "cannot deny device").Error()}, http.StatusBadRequest)
+				return
+			}
+			write(w, approveRsp{}, http.StatusOK)
+			return
+		}
+
+		if req.Lifetime == 0 {
+			write(w, approveRsp{Error: "must specify desired token lifetime"}, http.StatusBadRequest)
+			return
+		}
+		dr, err := s.Pending(req.UserCode)
+		if err != nil {
+			write(w, approveRsp{Error: errors.Wrap(err, "cannot approve device").Error()}, http.StatusBadRequest)
+			return
+		}
+		l := time.Duration(req.Lifetime)
+		if dr.Lifetime != 0 && dr.Lifetime < l {
+			l = dr.Lifetime
+		}
+		o := []auth.GenerateOption{}
+		if dr.Audience != "" {
+			o = append(o, auth.Audience(dr.Audience))
+		}
+
+		resolved, err := ge.Enrich(u)
+		if err != nil {
+			write(w, approveRsp{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		if len(resolved) > 0 {
+			o = append(o, auth.ResolvedGroups(resolved...))
+		}
+		t, _, err := g.Generate(u, l, o...)
+		if err != nil {
+			write(w, approveRsp{Error: errors.Wrap(err, "cannot generate token").Error()}, handlers.GenerateStatus(err))
+			return
+		}
+		if err := s.Approve(req.UserCode, t, l); err != nil {
+			write(w, approveRsp{Error: errors.Wrap(err, "cannot approve device").Error()}, http.StatusBadRequest)
+			return
+		}
+		write(w, approveRsp{}, http.StatusOK)
+	}
+}
+
+func allowed(audiences Audiences, audience string) bool {
+	if audiences == nil {
+		return false
+	}
+	for _, a := range audiences() {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func write(w http.ResponseWriter, v interface{}, httpStatus int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(v) // nolint: gosec
+}
@@ -0,0 +1,393 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth/groups"
+	"github.com/planetlabs/kubehook/auth/noop"
+	"github.com/planetlabs/kubehook/device"
+	"github.com/planetlabs/kubehook/handlers"
+	"github.com/planetlabs/kubehook/lifetime"
+)
+
+const user = "user"
+
+var noGroups = []string{}
+
+var audiences = func() []string { return []string{"prod"} }
+
+var h = handlers.AuthHeaders{
+	User:           handlers.DefaultUserHeader,
+	Group:          handlers.DefaultGroupHeader,
+	GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
+}
+
+func authorize(t *testing.T, s *device.Store, externalURL string) *authorizationRsp {
+	return authorizeWith(t, s, externalURL, url.Values{})
+}
+
+func authorizeWith(t *testing.T, s *device.Store, externalURL string, f url.Values) *authorizationRsp {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://kubehook.example.org/device/code", strings.NewReader(f.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	Authorization(s, externalURL, audiences)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Authorization(...): want %v, got %v - %s", http.StatusOK, w.Code, w.Body)
+	}
+	rsp := &authorizationRsp{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+	}
+	return rsp
+}
+
+func poll(t *testing.T, s *device.Store, grantType, deviceCode string) (int, *tokenRsp) {
+	w := httptest.NewRecorder()
+	f := url.Values{"grant_type": []string{grantType}, "device_code": []string{deviceCode}}
+	r := httptest.NewRequest("POST", "/device/token", strings.NewReader(f.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	Token(s)(w, r)
+	rsp := &tokenRsp{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+	}
+	return w.Code, rsp
+}
+
+func approve(t *testing.T, s *device.Store, head map[string]string, req *approveReq) (int, *approveRsp) {
+	return approveAt(t, s, "", head, req)
+}
+
+func approveAt(t *testing.T, s *device.Store, externalURL string, head map[string]string, req *approveReq) (int, *approveRsp) {
+	m, err := noop.NewManager(noGroups)
+	if err != nil {
+		t.Fatalf("noop.NewManager(%v): %v", noGroups, err)
+	}
+	w := httptest.NewRecorder()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("json.Marshal(%+#v): %v", req, err)
+	}
+	r := httptest.NewRequest("POST", "/device/approve", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range head {
+		r.Header.Set(k, v)
+	}
+	Approve(m, s, h, groups.Enricher{}, externalURL)(w, r)
+	rsp := &approveRsp{}
+	if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+		t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+	}
+	return w.Code, rsp
+}
+
+func TestAuthorization(t *testing.T) {
+	cases := []struct {
+		name        string
+		externalURL string
+		want        string
+	}{
+		{
+			name:        "ExternalURL",
+			externalURL: "https://kubehook.example.net/",
+			want:        "https://kubehook.example.net/device",
+		},
+		{
+			name: "RequestURL",
+			want: "http://kubehook.example.org/device",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := authorize(t, device.NewStore(), tt.externalURL)
+			if rsp.VerificationURI != tt.want {
+				t.Errorf("rsp.VerificationURI: want %s, got %s", tt.want, rsp.VerificationURI)
+			}
+			want := tt.want + "?user_code=" + rsp.UserCode
+			if rsp.VerificationURIComplete != want {
+				t.Errorf("rsp.VerificationURIComplete: want %s, got %s", want, rsp.VerificationURIComplete)
+			}
+			if rsp.DeviceCode == "" || rsp.UserCode == "" {
+				t.Errorf("rsp: want device and user codes, got %+v", rsp)
+			}
+		})
+	}
+}
+
+func TestAuthorizationRejected(t *testing.T) {
+	cases := []struct {
+		name      string
+		store     *device.Store
+		audiences Audiences
+		form      url.Values
+		want      int
+		wantErr   string
+	}{
+		{
+			name:      "UnknownAudience",
+			store:     device.NewStore(),
+			audiences: audiences,
+			form:      url.Values{"audience": []string{"staging"}},
+			want:      http.StatusBadRequest,
+			wantErr:   "invalid_target",
+		},
+		{
+			name:    "NoAudiences",
+			store:   device.NewStore(),
+			form:    url.Values{"audience": []string{"prod"}},
+			want:    http.StatusBadRequest,
+			wantErr: "invalid_target",
+		},
+		{
+			name:      "ClientFull",
+			store:     device.NewStore(device.MaxPendingPerClient(0)),
+			audiences: audiences,
+			want:      http.StatusTooManyRequests,
+			wantErr:   "slow_down",
+		},
+		{
+			name:      "StoreFull",
+			store:     device.NewStore(device.MaxPending(0)),
+			audiences: audiences,
+			want:      http.StatusServiceUnavailable,
+			wantErr:   "temporarily_unavailable",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/device/code", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			Authorization(tt.store, "", tt.audiences)(w, r)
+			rsp := &tokenRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+			}
+			if w.Code != tt.want || rsp.Error != tt.wantErr {
+				t.Errorf("Authorization(...): want %v %s, got %v %s", tt.want, tt.wantErr, w.Code, rsp.Error)
+			}
+		})
+	}
+}
+
+func TestFlow(t *testing.T) {
+	s := device.NewStore(device.Interval(0))
+	a := authorize(t, s, "")
+
+	code, rsp := poll(t, s, GrantType, a.DeviceCode)
+	if diff := deep.Equal(&tokenRsp{Error: "authorization_pending"}, rsp); code != http.StatusBadRequest || diff != nil {
+		t.Errorf("poll before approval: want %v, got %v: %v", http.StatusBadRequest, code, diff)
+	}
+
+	code, arsp := approve(t, s, map[string]string{}, &approveReq{UserCode: a.UserCode, Lifetime: lifetime.Hour})
+	if code != http.StatusBadRequest {
+		t.Errorf("approve without username: want %v, got %v - %+v", http.StatusBadRequest, code, arsp)
+	}
+
+	head := map[string]string{handlers.DefaultUserHeader: user}
+	code, arsp = approve(t, s, head, &approveReq{UserCode: a.UserCode})
+	if code != http.StatusBadRequest {
+		t.Errorf("approve without lifetime: want %v, got %v - %+v", http.StatusBadRequest, code, arsp)
+	}
+
+	code, arsp = approve(t, s, head, &approveReq{UserCode: a.UserCode, Lifetime: lifetime.Hour})
+	if diff := deep.Equal(&approveRsp{}, arsp); code != http.StatusOK || diff != nil {
+		t.Errorf("approve: want %v, got %v: %v", http.StatusOK, code, diff)
+	}
+
+	code, rsp = poll(t, s, "password", a.DeviceCode)
+	if diff := deep.Equal(&tokenRsp{Error: "unsupported_grant_type"}, rsp); code != http.StatusBadRequest || diff != nil {
+		t.Errorf("poll with wrong grant type: want %v, got %v: %v", http.StatusBadRequest, code, diff)
+	}
+
+	code, rsp = poll(t, s, GrantType, a.DeviceCode)
+	want := &tokenRsp{AccessToken: user, TokenType: tokenType, ExpiresIn: int64(time.Hour / time.Second)}
+	if diff := deep.Equal(want, rsp); code != http.StatusOK || diff != nil {
+		t.Errorf("poll after approval: want %v, got %v: %v", http.StatusOK, code, diff)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	s := device.NewStore()
+	a := authorize(t, s, "")
+
+	head := map[string]string{handlers.DefaultUserHeader: user}
+	code, arsp := approve(t, s, head, &approveReq{UserCode: a.UserCode, Deny: true})
+	if diff := deep.Equal(&approveRsp{}, arsp); code != http.StatusOK || diff != nil {
+		t.Errorf("deny: want %v, got %v: %v", http.StatusOK, code, diff)
+	}
+
+	code, rsp := poll(t, s, GrantType, a.DeviceCode)
+	if diff := deep.Equal(&tokenRsp{Error: "access_denied"}, rsp); code != http.StatusBadRequest || diff != nil {
+		t.Errorf("poll after denial: want %v, got %v: %v", http.StatusBadRequest, code, diff)
+	}
+}
+
+func TestRequestedLifetime(t *testing.T) {
+	s := device.NewStore(device.Interval(0))
+	a := authorizeWith(t, s, "", url.Values{"lifetime": []string{"30m"}})
+
+	head := map[string]string{handlers.DefaultUserHeader: user}
+	code, arsp := approve(t, s, head, &approveReq{UserCode: a.UserCode, Lifetime: lifetime.Hour})
+	if diff := deep.Equal(&approveRsp{}, arsp); code != http.StatusOK || diff != nil {
+		t.Errorf("approve: want %v, got %v: %v", http.StatusOK, code, diff)
+	}
+
+	code, rsp := poll(t, s, GrantType, a.DeviceCode)
+	want := &tokenRsp{AccessToken: user, TokenType: tokenType, ExpiresIn: int64(30 * time.Minute / time.Second)}
+	if diff := deep.Equal(want, rsp); code != http.StatusOK || diff != nil {
+		t.Errorf("poll after approval: want %v, got %v: %v", http.StatusOK, code, diff)
+	}
+}
+
+func TestApproveCrossSite(t *testing.T) {
+	cases := []struct {
+		name        string
+		externalURL string
+		head        map[string]string
+		want        int
+	}{
+		{
+			name: "SameOrigin",
+			head: map[string]string{handlers.DefaultUserHeader: user, "Origin": "http://example.com"},
+			want: http.StatusOK,
+		},
+		{
+			name: "CrossOrigin",
+			head: map[string]string{handlers.DefaultUserHeader: user, "Origin": "https://evil.example.org"},
+			want: http.StatusForbidden,
+		},
+		{
+			name:        "ExternalURL",
+			externalURL: "https://kubehook.example.net/kubehook/",
+			head:        map[string]string{handlers.DefaultUserHeader: user, "Origin": "https://kubehook.example.net"},
+			want:        http.StatusOK,
+		},
+		{
+			name:        "RequestOriginWithExternalURL",
+			externalURL: "https://kubehook.example.net/kubehook/",
+			head:        map[string]string{handlers.DefaultUserHeader: user, "Origin": "http://example.com"},
+			want:        http.StatusForbidden,
+		},
+		{
+			name: "FormEncoded",
+			head: map[string]string{handlers.DefaultUserHeader: user, "Content-Type": "application/x-www-form-urlencoded"},
+			want: http.StatusForbidden,
+		},
+		{
+			name: "PlainText",
+			head: map[string]string{handlers.DefaultUserHeader: user, "Content-Type": "text/plain"},
+			want: http.StatusForbidden,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := device.NewStore(device.Interval(0))
+			a := authorize(t, s, "")
+
+			code, rsp := approveAt(t, s, tt.externalURL, tt.head, &approveReq{UserCode: a.UserCode, Lifetime: lifetime.Hour})
+			if code != tt.want {
+				t.Errorf("approve: want %v, got %v - %+v", tt.want, code, rsp)
+			}
+
+			code, _ = poll(t, s, GrantType, a.DeviceCode)
+			if approved := code == http.StatusOK; approved != (tt.want == http.StatusOK) {
+				t.Errorf("poll: want approved %v, got %v", tt.want == http.StatusOK, approved)
+			}
+		})
+	}
+}
+
+func TestPending(t *testing.T) {
+	s := device.NewStore(device.Interval(0))
+	a := authorizeWith(t, s, "", url.Values{"audience": []string{"prod"}, "lifetime": []string{"30m"}})
+	b := authorize(t, s, "")
+
+	head := map[string]string{handlers.DefaultUserHeader: user}
+	cases := []struct {
+		name     string
+		head     map[string]string
+		userCode string
+		want     *pendingRsp
+		wantCode int
+	}{
+		{
+			name:     "Requested",
+			head:     head,
+			userCode: a.UserCode,
+			want:     &pendingRsp{Audience: "prod", Lifetime: lifetime.Duration(30 * time.Minute)},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "NothingRequested",
+			head:     head,
+			userCode: b.UserCode,
+			want:     &pendingRsp{},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "NoUsername",
+			head:     map[string]string{},
+			userCode: a.UserCode,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "NoUserCode",
+			head:     head,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "UnknownUserCode",
+			head:     head,
+			userCode: "AAAA-AAAA",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/device/pending?"+url.Values{"user_code": []string{tt.userCode}}.Encode(), nil)
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+			Pending(s, h)(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("Pending(...): want %v, got %v - %s", tt.wantCode, w.Code, w.Body)
+			}
+			if tt.want == nil {
+				return
+			}
+			rsp := &pendingRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+			}
+			if diff := deep.Equal(tt.want, rsp); diff != nil {
+				t.Errorf("Pending(...): want != got %v", diff)
+			}
+		})
+	}
+}
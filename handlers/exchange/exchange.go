@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package exchange
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/handlers"
+	"github.com/planetlabs/kubehook/lifetime"
+
+	"github.com/pkg/errors"
+)
+
+type req struct {
+	Cluster  string            `json:"cluster"`
+	Token    string            `json:"token"`
+	Lifetime lifetime.Duration `json:"lifetime"`
+}
+
+type rsp struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler returns an HTTP handler function that exchanges a token issued by one
+// of the supplied source clusters for a JSON web token. Source cluster tokens
+// are validated by the authenticator of the requested cluster.
+func Handler(g auth.Generator, clusters map[string]auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		req := &req{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot parse JSON request body").Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.Lifetime == 0 {
+			write(w, rsp{Error: "must specify desired token lifetime"}, http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			write(w, rsp{Error: "must specify a token to exchange"}, http.StatusBadRequest)
+			return
+		}
+		a, ok := clusters[req.Cluster]
+		if !ok {
+			write(w, rsp{Error: errors.Errorf("unknown source cluster %q", req.Cluster).Error()}, http.StatusBadRequest)
+			return
+		}
+
+		u, err := a.Authenticate(req.Token)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot authenticate token").Error()}, http.StatusForbidden)
+			return
+		}
+
+		t, _, err := g.Generate(u, time.Duration(req.Lifetime), auth.Source(auth.SourceExchange))
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot generate token").Error()}, handlers.GenerateStatus(err))
+			return
+		}
+
+		write(w, rsp{Token: t}, http.StatusOK)
+	}
+}
+
+func write(w http.ResponseWriter, r rsp, httpStatus int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(r) // nolint: gosec
+}
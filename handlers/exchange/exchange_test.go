@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package exchange
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/noop"
+	"github.com/planetlabs/kubehook/lifetime"
+)
+
+const (
+	cluster = "source"
+	saUser  = "sa:source:default:deployer"
+)
+
+var noGroups = []string{}
+
+type predictableAuthenticator struct {
+	err error
+}
+
+func (a *predictableAuthenticator) Authenticate(token string) (*auth.User, error) {
+	return &auth.User{Username: saUser}, a.err
+}
+
+func TestHandler(t *testing.T) {
+	cases := []struct {
+		name     string
+		clusters map[string]auth.Authenticator
+		req      *req
+		status   int
+		rsp      *rsp
+	}{
+		{
+			name:     "Success",
+			clusters: map[string]auth.Authenticator{cluster: &predictableAuthenticator{}},
+			req:      &req{Cluster: cluster, Token: "sa-token", Lifetime: 10 * lifetime.Minute},
+			status:   http.StatusOK,
+			rsp:      &rsp{Token: saUser},
+		},
+		{
+			name:     "UnknownCluster",
+			clusters: map[string]auth.Authenticator{cluster: &predictableAuthenticator{}},
+			req:      &req{Cluster: "unknown", Token: "sa-token", Lifetime: 10 * lifetime.Minute},
+			status:   http.StatusBadRequest,
+			rsp:      &rsp{Error: `unknown source cluster "unknown"`},
+		},
+		{
+			name:     "MissingToken",
+			clusters: map[string]auth.Authenticator{cluster: &predictableAuthenticator{}},
+			req:      &req{Cluster: cluster, Lifetime: 10 * lifetime.Minute},
+			status:   http.StatusBadRequest,
+			rsp:      &rsp{Error: "must specify a token to exchange"},
+		},
+		{
+			name:     "MissingLifetime",
+			clusters: map[string]auth.Authenticator{cluster: &predictableAuthenticator{}},
+			req:      &req{Cluster: cluster, Token: "sa-token"},
+			status:   http.StatusBadRequest,
+			rsp:      &rsp{Error: "must specify desired token lifetime"},
+		},
+		{
+			name:     "AuthenticationFailed",
+			clusters: map[string]auth.Authenticator{cluster: &predictableAuthenticator{err: errors.New("nope")}},
+			req:      &req{Cluster: cluster, Token: "sa-token", Lifetime: 10 * lifetime.Minute},
+			status:   http.StatusForbidden,
+			rsp:      &rsp{Error: "cannot authenticate token: nope"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := noop.NewManager(noGroups)
+			if err != nil {
+				t.Fatalf("noop.NewManager(%v): %v", noGroups, err)
+			}
+
+			w := httptest.NewRecorder()
+			body, err := json.Marshal(tt.req)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+#v): %v", tt.req, err)
+			}
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+
+			Handler(m, tt.clusters)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v", tt.status, w.Code)
+			}
+
+			rsp := &rsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %s): %v", w.Body, rsp, err)
+			}
+
+			if diff := deep.Equal(tt.rsp, rsp); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
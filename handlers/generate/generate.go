@@ -20,10 +20,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"regexp"
 	"time"
 
 	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
 	"github.com/planetlabs/kubehook/handlers"
 	"github.com/planetlabs/kubehook/lifetime"
 
@@ -31,17 +32,66 @@ import (
 )
 
 type req struct {
-	Lifetime lifetime.Duration `json:"lifetime"`
+	lifetime.Expiry
+	NotBefore time.Time `json:"notBefore,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Label     string    `json:"label,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
 }
 
+// Limits on token labels and reasons, which are included in every request
+// authenticated by the token.
+const (
+	maxLabelLength  = 63
+	maxReasonLength = 256
+)
+
+var labelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+
+// APIVersion identifies the schema of generate responses. Fields may be added
+// to the schema without changing its version, but fields are never removed nor
+// their meaning changed.
+const APIVersion = "generate.kubehook/v1"
+
+// credentialsUser is the kubeconfig user suggested for the token.
+const credentialsUser = "kubehook"
+
 type rsp struct {
-	Token string `json:"token,omitempty"`
-	Error string `json:"error,omitempty"`
+	APIVersion string     `json:"apiVersion"`
+	Token      string     `json:"token,omitempty"`
+	TokenID    string     `json:"tokenID,omitempty"`
+	Username   string     `json:"username,omitempty"`
+	UID        string     `json:"uid,omitempty"`
+	Groups     []string   `json:"groups,omitempty"`
+	Audience   string     `json:"audience,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	IssuedAt   *time.Time `json:"issuedAt,omitempty"`
+	NotBefore  *time.Time `json:"notBefore,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Commands   *commands  `json:"commands,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type optionsRsp struct {
+	APIVersion  string            `json:"apiVersion"`
+	MaxSchedule lifetime.Duration `json:"maxSchedule,omitempty"`
+}
+
+type commands struct {
+	SetCredentials string `json:"setCredentials"`
 }
 
 // Handler returns an HTTP handler function that generates a JSON web token for
-// the requesting user.
-func Handler(g auth.Generator, h handlers.AuthHeaders) http.HandlerFunc {
+// the requesting user. The token's lifetime may be requested either as a
+// duration or as an RFC 3339 expiry time. Tokens may be scheduled to become
+// valid in the future, in which case their lifetime begins at that time. The
+// response describes the token, and suggests commands with which to use it.
+// Requests may specify groups in order to generate a token that includes only
+// the requested groups to which the user belongs, and may label the token and
+// describe why it was generated. The groups of the requesting user are enriched
+// by the supplied Enricher.
+func Handler(g auth.Generator, h handlers.AuthHeaders, ge groups.Enricher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
@@ -51,28 +101,114 @@ func Handler(g auth.Generator, h handlers.AuthHeaders) http.HandlerFunc {
 			write(w, rsp{Error: errors.Wrap(err, "cannot parse JSON request body").Error()}, http.StatusBadRequest)
 			return
 		}
-		if req.Lifetime == 0 {
-			write(w, rsp{Error: "must specify desired token lifetime"}, http.StatusBadRequest)
+		start := time.Now()
+		if req.NotBefore.After(start) {
+			start = req.NotBefore
+		}
+		l, err := req.Resolve(start)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "invalid token lifetime").Error()}, http.StatusBadRequest)
+			return
+		}
+
+		if err := validateLabel(req.Label, req.Reason); err != nil {
+			write(w, rsp{Error: err.Error()}, http.StatusBadRequest)
 			return
 		}
 
-		u := r.Header.Get(h.User)
-		if u == "" {
-			write(w, rsp{Error: fmt.Sprintf("cannot extract username from header %s", h.User)}, http.StatusBadRequest)
+		u, err := h.Extract(r)
+		if err != nil {
+			write(w, rsp{Error: err.Error()}, http.StatusBadRequest)
 			return
 		}
-		gs := strings.Split(r.Header.Get(h.Group), h.GroupDelimiter)
-		t, err := g.Generate(&auth.User{Username: u, Groups: gs}, time.Duration(req.Lifetime))
+		resolved, err := ge.Enrich(u)
+		if err != nil {
+			write(w, rsp{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		var omitted []string
+		u.Groups, omitted = handlers.ScopeGroups(u.Groups, req.Groups)
+		o := []auth.GenerateOption{}
+		if len(resolved) > 0 {
+			o = append(o, auth.ResolvedGroups(resolved...))
+		}
+		if len(omitted) > 0 {
+			o = append(o, auth.OmitGroups(omitted...))
+		}
+		if req.Label != "" {
+			o = append(o, auth.Label(req.Label))
+		}
+		if req.Reason != "" {
+			o = append(o, auth.Reason(req.Reason))
+		}
+		if !req.NotBefore.IsZero() {
+			o = append(o, auth.NotBefore(req.NotBefore))
+		}
+		token, t, err := g.Generate(u, time.Duration(l), o...)
 		if err != nil {
-			write(w, rsp{Error: errors.Wrap(err, "cannot generate token").Error()}, http.StatusInternalServerError)
+			write(w, rsp{Error: errors.Wrap(err, "cannot generate token").Error()}, handlers.GenerateStatus(err))
 			return
 		}
 
-		write(w, rsp{Token: t}, http.StatusOK)
+		write(w, describe(token, t), http.StatusOK)
+	}
+}
+
+// Options returns an HTTP handler function that describes the options the
+// generate API supports, so that clients may omit those it does not. Tokens may
+// be scheduled to become valid at most the supplied duration in the future. A
+// zero duration indicates that tokens may not be scheduled.
+func Options(maxSchedule time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(optionsRsp{APIVersion: APIVersion, MaxSchedule: lifetime.Duration(maxSchedule)}) // nolint: gosec
+	}
+}
+
+// describe the supplied token.
+func describe(token string, t *auth.Token) rsp {
+	r := rsp{
+		Token:    token,
+		Commands: &commands{SetCredentials: fmt.Sprintf("kubectl config set-credentials %s --token=%s", credentialsUser, token)},
+	}
+	if t == nil {
+		return r
+	}
+	r.TokenID = t.ID
+	r.Username = t.User.Username
+	r.UID = t.User.UID
+	r.Groups = t.User.Groups
+	r.Audience = t.Audience
+	r.Label = t.Label
+	r.Reason = t.Reason
+	r.IssuedAt = timePtr(t.IssuedAt)
+	r.ExpiresAt = timePtr(t.ExpiresAt)
+	if t.NotBefore.After(t.IssuedAt) {
+		r.NotBefore = timePtr(t.NotBefore)
+	}
+	return r
+}
+
+func validateLabel(label, reason string) error {
+	if label != "" && (len(label) > maxLabelLength || !labelPattern.MatchString(label)) {
+		return errors.Errorf("invalid token label %q: must be at most %d letters, digits, '-', '_' or '.', beginning and ending with a letter or digit", label, maxLabelLength)
+	}
+	if len(reason) > maxReasonLength {
+		return errors.Errorf("invalid token reason: must be at most %d characters", maxReasonLength)
+	}
+	return nil
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
 	}
+	return &t
 }
 
 func write(w http.ResponseWriter, r rsp, httpStatus int) {
+	r.APIVersion = APIVersion
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(httpStatus)
 	json.NewEncoder(w).Encode(r) // nolint: gosec
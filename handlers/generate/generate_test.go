@@ -22,9 +22,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
+	"github.com/planetlabs/kubehook/auth/jwt"
 	"github.com/planetlabs/kubehook/auth/noop"
 	"github.com/planetlabs/kubehook/handlers"
 	"github.com/planetlabs/kubehook/lifetime"
@@ -44,26 +50,68 @@ func TestHandler(t *testing.T) {
 		{
 			name: "Success",
 			head: map[string]string{handlers.DefaultUserHeader: user},
-			req:  &req{Lifetime: 10 * lifetime.Minute},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}},
 			rsp:  &rsp{Token: user},
 		},
 		{
 			name: "MissingUsernameHeader",
 			head: map[string]string{"some-header": "value"},
-			req:  &req{Lifetime: 10 * lifetime.Minute},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}},
 			rsp:  &rsp{Error: fmt.Sprintf("cannot extract username from header %s", handlers.DefaultUserHeader)},
 		},
 		{
 			name: "MissingUsernameHeaderValue",
 			head: map[string]string{handlers.DefaultUserHeader: ""},
-			req:  &req{Lifetime: 10 * lifetime.Minute},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}},
 			rsp:  &rsp{Error: fmt.Sprintf("cannot extract username from header %s", handlers.DefaultUserHeader)},
 		},
+		{
+			name: "ExpiresAt",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{ExpiresAt: time.Now().Add(time.Hour)}},
+			rsp:  &rsp{Token: user},
+		},
+		{
+			name: "ExpiresAtPast",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{ExpiresAt: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}},
+			rsp:  &rsp{Error: "invalid token lifetime: expiry time 2018-01-01T00:00:00Z is not after the token becomes valid"},
+		},
+		{
+			name: "NotBefore",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{ExpiresAt: time.Now().Add(3 * time.Hour)}, NotBefore: time.Now().Add(time.Hour)},
+			rsp:  &rsp{Token: user},
+		},
+		{
+			name: "ExpiresBeforeNotBefore",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{ExpiresAt: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}, NotBefore: time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC)},
+			rsp:  &rsp{Error: "invalid token lifetime: expiry time 2030-01-01T00:00:00Z is not after the token becomes valid"},
+		},
+		{
+			name: "Label",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}, Label: "ci-deploy", Reason: "release 1.2"},
+			rsp:  &rsp{Token: user},
+		},
+		{
+			name: "InvalidLabel",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}, Label: "my laptop"},
+			rsp:  &rsp{Error: `invalid token label "my laptop": must be at most 63 letters, digits, '-', '_' or '.', beginning and ending with a letter or digit`},
+		},
+		{
+			name: "ReasonTooLong",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			req:  &req{Expiry: lifetime.Expiry{Lifetime: 10 * lifetime.Minute}, Reason: strings.Repeat("x", 257)},
+			rsp:  &rsp{Error: "invalid token reason: must be at most 256 characters"},
+		},
 		{
 			name: "MissingLifetime",
 			head: map[string]string{handlers.DefaultUserHeader: user},
 			req:  &req{},
-			rsp:  &rsp{Error: "must specify desired token lifetime"},
+			rsp:  &rsp{Error: "invalid token lifetime: must specify a lifetime or an expiry time"},
 		},
 	}
 	for _, tt := range cases {
@@ -88,7 +136,7 @@ func TestHandler(t *testing.T) {
 				Group:          handlers.DefaultGroupHeader,
 				GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
 			}
-			Handler(m, h)(w, r)
+			Handler(m, h, groups.Enricher{})(w, r)
 
 			expectedStatus := http.StatusOK
 			if tt.rsp.Error != "" {
@@ -98,12 +146,215 @@ func TestHandler(t *testing.T) {
 				t.Errorf("w.Code: want %v, got %v", expectedStatus, w.Code)
 			}
 
-			rsp := &rsp{}
-			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
-				t.Fatalf("json.Unmarshal(%v, %s): %v", w.Body, rsp, err)
+			got := &rsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, got, err)
+			}
+			if got.APIVersion != APIVersion {
+				t.Errorf("got.APIVersion: want %v, got %v", APIVersion, got.APIVersion)
+			}
+
+			// The token's description is tested by TestHandlerDescribesToken.
+			if diff := deep.Equal(tt.rsp, &rsp{Token: got.Token, Error: got.Error}); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestHandlerDescribesToken(t *testing.T) {
+	m, err := jwt.NewManager([]byte("secret"))
+	if err != nil {
+		t.Fatalf("jwt.NewManager(): %v", err)
+	}
+	h := handlers.AuthHeaders{
+		User:           handlers.DefaultUserHeader,
+		Group:          handlers.DefaultGroupHeader,
+		GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
+	}
+
+	notBefore := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	body, _ := json.Marshal(&req{Expiry: lifetime.Expiry{Lifetime: 2 * lifetime.Hour}, NotBefore: notBefore, Label: "laptop", Reason: "on call"})
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set(handlers.DefaultUserHeader, user)
+	r.Header.Set(handlers.DefaultGroupHeader, "a;b")
+	w := httptest.NewRecorder()
+
+	Handler(m, h, groups.Enricher{})(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body)
+	}
+	got := &rsp{}
+	if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+		t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, got, err)
+	}
+	if got.IssuedAt == nil || time.Since(*got.IssuedAt) > time.Minute {
+		t.Errorf("got.IssuedAt: want about now, got %v", got.IssuedAt)
+	}
+	if got.TokenID == "" {
+		t.Errorf("got.TokenID: want token ID, got none")
+	}
+
+	want := &rsp{
+		APIVersion: APIVersion,
+		Token:      got.Token,
+		TokenID:    got.TokenID,
+		Username:   user,
+		UID:        jwt.DefaultAudience + "/" + user,
+		Groups:     []string{"a", "b"},
+		Audience:   jwt.DefaultAudience,
+		Label:      "laptop",
+		Reason:     "on call",
+		IssuedAt:   got.IssuedAt,
+		NotBefore:  &notBefore,
+		ExpiresAt:  func() *time.Time { e := notBefore.Add(2 * time.Hour); return &e }(),
+		Commands:   &commands{SetCredentials: "kubectl config set-credentials kubehook --token=" + got.Token},
+	}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("want != got: %v", diff)
+	}
+}
+
+// errGenerator fails to generate tokens.
+type errGenerator struct{ err error }
+
+func (g errGenerator) Generate(u *auth.User, l time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	return "", nil, g.err
+}
+
+func TestHandlerGenerateError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{
+			name:   "InvalidRequest",
+			err:    auth.Invalid(errors.New("opaque tokens do not support not-before times")),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "InternalError",
+			err:    errors.New("boom"),
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	h := handlers.AuthHeaders{User: handlers.DefaultUserHeader}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(&req{Expiry: lifetime.Expiry{Lifetime: lifetime.Hour}})
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			r.Header.Set(handlers.DefaultUserHeader, user)
+			w := httptest.NewRecorder()
+
+			Handler(errGenerator{tt.err}, h, groups.Enricher{})(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v - %s", tt.status, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// groupsGenerator returns tokens describing the groups they include and omit.
+type groupsGenerator struct{}
+
+func (g groupsGenerator) Generate(u *auth.User, l time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	omitted := auth.NewGenerateOptions(o...).OmittedGroups
+	return fmt.Sprintf("%s/%s", strings.Join(u.Groups, ","), strings.Join(omitted, ",")), &auth.Token{User: *u}, nil
+}
+
+func TestHandlerGroups(t *testing.T) {
+	cases := []struct {
+		name   string
+		ge     groups.Enricher
+		groups []string
+		token  string
+	}{
+		{
+			name:  "AllGroups",
+			token: "a,b,c/",
+		},
+		{
+			name:   "ScopedGroups",
+			groups: []string{"c", "a", "d"},
+			token:  "a,c/b",
+		},
+		{
+			name:   "NoGroups",
+			groups: []string{},
+			token:  "/a,b,c",
+		},
+		{
+			name:  "EnrichedGroups",
+			ge:    groups.Enricher{Resolver: groups.NewStatic(&groups.Users{Users: map[string][]string{user: {"b", "d"}}})},
+			token: "a,b,c,d/",
+		},
+		{
+			name:   "ScopedEnrichedGroups",
+			ge:     groups.Enricher{Resolver: groups.NewStatic(&groups.Users{Users: map[string][]string{user: {"b", "d"}}})},
+			groups: []string{"d"},
+			token:  "d/a,b,c",
+		},
+	}
+	h := handlers.AuthHeaders{
+		User:           handlers.DefaultUserHeader,
+		Group:          handlers.DefaultGroupHeader,
+		GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]interface{}{"lifetime": "1h", "groups": tt.groups})
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			r.Header.Set(handlers.DefaultUserHeader, user)
+			r.Header.Set(handlers.DefaultGroupHeader, "a;b;c")
+			w := httptest.NewRecorder()
+
+			Handler(groupsGenerator{}, h, tt.ge)(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body)
+			}
+			got := &rsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, got, err)
 			}
+			if got.Token != tt.token {
+				t.Errorf("got.Token: want %v, got %v", tt.token, got.Token)
+			}
+		})
+	}
+}
 
-			if diff := deep.Equal(tt.rsp, rsp); diff != nil {
+func TestOptions(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxSchedule time.Duration
+		want        *optionsRsp
+	}{
+		{
+			name:        "Scheduling",
+			maxSchedule: 7 * 24 * time.Hour,
+			want:        &optionsRsp{APIVersion: APIVersion, MaxSchedule: lifetime.Week},
+		},
+		{
+			name: "NoScheduling",
+			want: &optionsRsp{APIVersion: APIVersion},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Options(tt.maxSchedule)(w, httptest.NewRequest("GET", "/", nil))
+
+			got := &optionsRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), got); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, got, err)
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
 				t.Errorf("want != got: %v", diff)
 			}
 		})
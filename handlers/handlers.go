@@ -17,9 +17,19 @@ and limitations under the License.
 package handlers
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"expvar"
+	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
+
+	"github.com/planetlabs/kubehook/auth"
 )
 
 // Default headers used to determine the currently authenticated user and their
@@ -36,6 +46,90 @@ type AuthHeaders struct {
 	Group string // The authenticated user's groups.
 
 	GroupDelimiter string // The delimiter of the list of groups.
+
+	UID string // The authenticated user's immutable ID. Optional.
+}
+
+// Extract the authenticated user from the supplied request's headers. The
+// user's UID is extracted only if a UID header is configured, in which case it
+// is required.
+func (h AuthHeaders) Extract(r *http.Request) (*auth.User, error) {
+	u := &auth.User{
+		Username: r.Header.Get(h.User),
+		Groups:   strings.Split(r.Header.Get(h.Group), h.GroupDelimiter),
+	}
+	if u.Username == "" {
+		return nil, fmt.Errorf("cannot extract username from header %s", h.User)
+	}
+	if h.UID == "" {
+		return u, nil
+	}
+	u.UID = r.Header.Get(h.UID)
+	if u.UID == "" {
+		return nil, fmt.Errorf("cannot extract UID from header %s", h.UID)
+	}
+	return u, nil
+}
+
+// ScopeGroups returns the subset of the supplied actual groups that were
+// requested, and the actual groups that were omitted as a result. All actual
+// groups are returned if requested is nil. Requested groups to which the user
+// does not belong are ignored.
+func ScopeGroups(actual, requested []string) (scoped, omitted []string) {
+	if requested == nil {
+		return actual, nil
+	}
+	r := make(map[string]bool, len(requested))
+	for _, g := range requested {
+		r[g] = true
+	}
+	scoped = []string{}
+	for _, g := range actual {
+		if r[g] {
+			scoped = append(scoped, g)
+			continue
+		}
+		omitted = append(omitted, g)
+	}
+	return scoped, omitted
+}
+
+// VerifyClientCert verifies the TLS client certificate presented with the
+// supplied request against the supplied roots, and returns it. Certificates
+// must be verified per handler when clients with certificates issued by
+// different CAs may call different handlers on the same listener.
+func VerifyClientCert(r *http.Request, roots *x509.CertPool) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("client did not present a TLS certificate")
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	o := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if _, err := leaf.Verify(o); err != nil {
+		return nil, fmt.Errorf("cannot verify TLS client certificate: %v", err)
+	}
+	return leaf, nil
+}
+
+// RequireClientCert returns an HTTP handler that returns HTTP 401 unless the
+// client presented a TLS certificate verified against the supplied roots, and
+// valid for the supplied subject if it is not empty.
+func RequireClientCert(roots *x509.CertPool, subject string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := VerifyClientCert(r, roots)
+		if err == nil && subject != "" {
+			err = c.VerifyHostname(subject)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			r.Body.Close() // nolint: gosec
+			return
+		}
+		h.ServeHTTP(w, r)
+	}
 }
 
 // Run the provided function in a goroutine.
@@ -64,6 +158,23 @@ func Content(c io.ReadSeeker, filename string) http.HandlerFunc {
 	}
 }
 
+// Vars serves the named expvars as a JSON object. Unlike expvar.Handler it does
+// not serve every published variable, which would include the command line and
+// thus any secrets passed as arguments.
+func Vars(names ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := make(map[string]json.RawMessage, len(names))
+		for _, n := range names {
+			if v := expvar.Get(n); v != nil {
+				vars[n] = json.RawMessage(v.String())
+			}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(vars) // nolint: gosec
+		r.Body.Close()                  // nolint: gosec
+	}
+}
+
 // NotImplemented always returns HTTP 501
 func NotImplemented() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -71,3 +182,69 @@ func NotImplemented() http.HandlerFunc {
 		r.Body.Close() // nolint: gosec
 	}
 }
+
+// CheckSameOrigin returns an error unless the supplied request has a JSON body
+// and, if it has an Origin header, originates from kubehook itself. Kubehook's
+// origin is that of the supplied external URL, or is derived from the request
+// if no external URL is supplied. Browsers cannot send such requests
+// cross-origin without a CORS preflight, which kubehook does not allow.
+// Handlers that act on behalf of the user identified by proxy headers use it to
+// prevent cross-site request forgery.
+func CheckSameOrigin(r *http.Request, externalURL string) error {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return fmt.Errorf("request body must be application/json")
+	}
+	origin := RequestURL(r)
+	if externalURL != "" {
+		u, err := url.Parse(externalURL)
+		if err != nil {
+			return fmt.Errorf("invalid external URL %s: %v", externalURL, err)
+		}
+		origin = u.Scheme + "://" + u.Host
+	}
+	if o := r.Header.Get("Origin"); o != "" && o != origin {
+		return fmt.Errorf("requests from origin %s are not allowed", o)
+	}
+	return nil
+}
+
+// RequestURL returns the URL at which the client reached kubehook, taking into
+// account any reverse proxy in front of it.
+func RequestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	host := r.Host
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return scheme + "://" + host
+}
+
+// GenerateStatus returns the HTTP status with which to report an error returned
+// by an auth.Generator.
+func GenerateStatus(err error) int {
+	if auth.IsInvalid(err) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ClientAddress returns the network address of the client, taking into account
+// any reverse proxy in front of it. Only the address appended to
+// X-Forwarded-For by the nearest proxy is trusted.
+func ClientAddress(r *http.Request) string {
+	if ff := r.Header.Get("X-Forwarded-For"); ff != "" {
+		hops := strings.Split(ff, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
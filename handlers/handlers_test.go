@@ -0,0 +1,247 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"expvar"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth"
+)
+
+func TestExtract(t *testing.T) {
+	cases := []struct {
+		name    string
+		h       AuthHeaders
+		head    map[string]string
+		want    *auth.User
+		wantErr bool
+	}{
+		{
+			name: "UserAndGroups",
+			h:    AuthHeaders{User: DefaultUserHeader, Group: DefaultGroupHeader, GroupDelimiter: DefaultGroupHeaderDelimiter},
+			head: map[string]string{DefaultUserHeader: "negz", DefaultGroupHeader: "a;b"},
+			want: &auth.User{Username: "negz", Groups: []string{"a", "b"}},
+		},
+		{
+			name:    "MissingUser",
+			h:       AuthHeaders{User: DefaultUserHeader, Group: DefaultGroupHeader, GroupDelimiter: DefaultGroupHeaderDelimiter},
+			head:    map[string]string{DefaultGroupHeader: "a;b"},
+			wantErr: true,
+		},
+		{
+			name: "UID",
+			h:    AuthHeaders{User: DefaultUserHeader, Group: DefaultGroupHeader, GroupDelimiter: DefaultGroupHeaderDelimiter, UID: "X-Forwarded-Uid"},
+			head: map[string]string{DefaultUserHeader: "negz", DefaultGroupHeader: "a", "X-Forwarded-Uid": "00u1a2b3c4"},
+			want: &auth.User{Username: "negz", UID: "00u1a2b3c4", Groups: []string{"a"}},
+		},
+		{
+			name:    "MissingUID",
+			h:       AuthHeaders{User: DefaultUserHeader, Group: DefaultGroupHeader, GroupDelimiter: DefaultGroupHeaderDelimiter, UID: "X-Forwarded-Uid"},
+			head:    map[string]string{DefaultUserHeader: "negz", DefaultGroupHeader: "a"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+			got, err := tt.h.Extract(r)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("h.Extract(...): %v", err)
+			}
+			if tt.wantErr {
+				t.Fatalf("h.Extract(...): want error, got nil")
+			}
+			if diff := deep.Equal(tt.want, got); diff != nil {
+				t.Errorf("h.Extract(...): want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestScopeGroups(t *testing.T) {
+	cases := []struct {
+		name        string
+		actual      []string
+		requested   []string
+		wantScoped  []string
+		wantOmitted []string
+	}{
+		{
+			name:       "NotRequested",
+			actual:     []string{"a", "b"},
+			wantScoped: []string{"a", "b"},
+		},
+		{
+			name:        "Subset",
+			actual:      []string{"a", "b", "c"},
+			requested:   []string{"c", "a", "z"},
+			wantScoped:  []string{"a", "c"},
+			wantOmitted: []string{"b"},
+		},
+		{
+			name:        "None",
+			actual:      []string{"a", "b"},
+			requested:   []string{},
+			wantScoped:  []string{},
+			wantOmitted: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			scoped, omitted := ScopeGroups(tt.actual, tt.requested)
+			if diff := deep.Equal(tt.wantScoped, scoped); diff != nil {
+				t.Errorf("ScopeGroups(...): want scoped != got: %v", diff)
+			}
+			if diff := deep.Equal(tt.wantOmitted, omitted); diff != nil {
+				t.Errorf("ScopeGroups(...): want omitted != got: %v", diff)
+			}
+		})
+	}
+}
+
+// certificate returns a certificate with the supplied common name signed by
+// the supplied parent, or a self-signed CA certificate if parent is nil.
+func certificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...): %v", err)
+	}
+	return c, key
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca, caKey := certificate(t, "ca", nil, nil)
+	other, otherKey := certificate(t, "other", nil, nil)
+	proxy, _ := certificate(t, "proxy.example.org", ca, caKey)
+	untrusted, _ := certificate(t, "proxy.example.org", other, otherKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	cases := []struct {
+		name    string
+		subject string
+		certs   []*x509.Certificate
+		want    int
+	}{
+		{name: "Verified", certs: []*x509.Certificate{proxy}, want: http.StatusOK},
+		{name: "VerifiedSubject", subject: "proxy.example.org", certs: []*x509.Certificate{proxy}, want: http.StatusOK},
+		{name: "WrongSubject", subject: "other.example.org", certs: []*x509.Certificate{proxy}, want: http.StatusUnauthorized},
+		{name: "UntrustedCA", certs: []*x509.Certificate{untrusted}, want: http.StatusUnauthorized},
+		{name: "NoCertificate", want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: tt.certs}
+
+			RequireClientCert(roots, tt.subject, Ping())(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("w.Code: want %v, got %v", tt.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	expvar.NewInt("handlers_test_published").Set(42)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/debug/vars", nil)
+	Vars("handlers_test_published", "handlers_test_unpublished")(w, r)
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", w.Body.Bytes(), err)
+	}
+	want := map[string]interface{}{"handlers_test_published": float64(42)}
+	if diff := deep.Equal(want, got); diff != nil {
+		t.Errorf("Vars(...): want != got: %v", diff)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{name: "Direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "Proxied", remoteAddr: "10.0.0.1:1234", forwarded: "198.51.100.7, 203.0.113.9", want: "203.0.113.9"},
+		{name: "NoPort", remoteAddr: "192.0.2.1", want: "192.0.2.1"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := ClientAddress(r); got != tt.want {
+				t.Errorf("ClientAddress(...): want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
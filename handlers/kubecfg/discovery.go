@@ -0,0 +1,252 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	clusterInfoAPI        = "/api/v1/namespaces/kube-public/configmaps/cluster-info"
+	clusterInfoKubeconfig = "kubeconfig"
+)
+
+// Defaults for cluster discovery.
+const (
+	DefaultDiscoveryInterval = 10 * time.Minute
+	DefaultDiscoveryTemplate = "default"
+	DefaultDiscoveryTimeout  = 10 * time.Second
+)
+
+// A Source of kubeconfig templates.
+type Source interface {
+	Templates() Templates
+}
+
+// Templates returns the templates, allowing a static set of templates to be
+// used as a Source.
+func (ts Templates) Templates() Templates {
+	return ts
+}
+
+type cluster struct {
+	host   string
+	client *http.Client
+}
+
+// Discovery is a Source of kubeconfig templates whose clusters' server URLs and
+// certificate authority data are discovered from each cluster's
+// kube-public/cluster-info ConfigMap.
+type Discovery struct {
+	log      *zap.Logger
+	base     Source
+	clusters map[string]cluster
+	interval time.Duration
+
+	mx         sync.RWMutex
+	discovered map[string]*api.Cluster
+}
+
+// A DiscoveryOption represents an optional argument to NewDiscovery.
+type DiscoveryOption func(*Discovery) error
+
+// Logger allows the use of a custom Zap logger.
+func Logger(l *zap.Logger) DiscoveryOption {
+	return func(d *Discovery) error {
+		d.log = l
+		return nil
+	}
+}
+
+// Interval at which clusters are rediscovered.
+func Interval(i time.Duration) DiscoveryOption {
+	return func(d *Discovery) error {
+		d.interval = i
+		return nil
+	}
+}
+
+// NewDiscovery returns a Source of the supplied templates, refreshing each
+// template cluster that shares its name with one of the supplied discovery
+// clusters. If no templates are supplied a template named default containing
+// every discovered cluster is served. Clusters are not discovered until
+// Refresh is first called.
+func NewDiscovery(base Source, clusters map[string]*rest.Config, do ...DiscoveryOption) (*Discovery, error) {
+	l, err := zap.NewProduction()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create default logger")
+	}
+	d := &Discovery{
+		log:        l,
+		base:       base,
+		clusters:   make(map[string]cluster),
+		interval:   DefaultDiscoveryInterval,
+		discovered: make(map[string]*api.Cluster),
+	}
+	for name, cfg := range clusters {
+		rt, err := rest.TransportFor(cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot create transport for cluster %s", name)
+		}
+		d.clusters[name] = cluster{
+			host:   strings.TrimSuffix(cfg.Host, "/"),
+			client: &http.Client{Transport: rt, Timeout: DefaultDiscoveryTimeout},
+		}
+	}
+	for _, o := range do {
+		if err := o(d); err != nil {
+			return nil, errors.Wrap(err, "cannot apply discovery option")
+		}
+	}
+	return d, nil
+}
+
+// Templates returns the base templates, updated with the discovered clusters.
+func (d *Discovery) Templates() Templates {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	return d.build()
+}
+
+// Run refreshes the templates at the configured interval until stopped.
+func (d *Discovery) Run(stop <-chan struct{}) {
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			d.Refresh() // nolint: gosec
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Refresh discovers every cluster. Clusters that cannot be discovered retain
+// their previously discovered configuration, if any.
+func (d *Discovery) Refresh() error {
+	names := make([]string, 0, len(d.clusters))
+	for name := range d.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	discovered := make(map[string]*api.Cluster)
+	failed := []string{}
+	for _, name := range names {
+		c, err := d.clusters[name].discover()
+		if err != nil {
+			d.log.Info("discovery", zap.String("cluster", name), zap.Bool("success", false), zap.Error(err))
+			failed = append(failed, name)
+			continue
+		}
+		d.log.Debug("discovery", zap.String("cluster", name), zap.Bool("success", true), zap.String("server", c.Server))
+		discovered[name] = c
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	for name, c := range discovered {
+		d.discovered[name] = c
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("cannot discover clusters %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// build templates from the discovered clusters. It must be called with the
+// lock held.
+func (d *Discovery) build() Templates {
+	base := Templates{}
+	if d.base != nil {
+		base = d.base.Templates()
+	}
+	if len(base) == 0 {
+		cfg := api.NewConfig()
+		for name, c := range d.discovered {
+			cfg.Clusters[name] = c.DeepCopy()
+		}
+		return Templates{&Template{Name: DefaultDiscoveryTemplate, Config: cfg}}
+	}
+
+	ts := make(Templates, 0, len(base))
+	for _, b := range base {
+		t := *b
+		t.Config = b.Config.DeepCopy()
+		for name, c := range t.Config.Clusters {
+			dc, ok := d.discovered[name]
+			if !ok {
+				continue
+			}
+			c.Server = dc.Server
+			c.CertificateAuthority = ""
+			c.CertificateAuthorityData = dc.CertificateAuthorityData
+		}
+		ts = append(ts, &t)
+	}
+	return ts
+}
+
+// discover the server URL and certificate authority data advertised by a
+// cluster's cluster-info ConfigMap.
+func (c cluster) discover() (*api.Cluster, error) {
+	req, err := http.NewRequest("GET", c.host+clusterInfoAPI, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create cluster-info request")
+	}
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get cluster-info")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected cluster-info response status %s", rsp.Status)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := json.NewDecoder(rsp.Body).Decode(cm); err != nil {
+		return nil, errors.Wrap(err, "cannot parse cluster-info")
+	}
+	cfg, err := clientcmd.Load([]byte(cm.Data[clusterInfoKubeconfig]))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse cluster-info kubeconfig")
+	}
+	for _, dc := range cfg.Clusters {
+		if dc.Server == "" || len(dc.CertificateAuthorityData) == 0 {
+			return nil, errors.New("cluster-info kubeconfig must specify a server and certificate authority data")
+		}
+		return &api.Cluster{Server: dc.Server, CertificateAuthorityData: dc.CertificateAuthorityData}, nil
+	}
+	return nil, errors.New("cluster-info kubeconfig does not contain a cluster")
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-test/deep"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const clusterInfo = `apiVersion: v1
+kind: Config
+clusters:
+- name: ""
+  cluster:
+    certificate-authority-data: %s
+    server: %s
+`
+
+// fakeAPIServer serves a cluster-info ConfigMap advertising the supplied
+// server and base64 encoded CA data. It fails if ca is empty.
+type fakeAPIServer struct {
+	server string
+	ca     string
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != clusterInfoAPI || f.ca == "" {
+		http.NotFound(w, r)
+		return
+	}
+	cm := &corev1.ConfigMap{Data: map[string]string{clusterInfoKubeconfig: fmt.Sprintf(clusterInfo, f.ca, f.server)}}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cm) // nolint: gosec
+}
+
+func TestDiscovery(t *testing.T) {
+	// "PAM" and "MAP" base64 encoded.
+	prod := &fakeAPIServer{server: "https://prod.example.org", ca: "UEFN"}
+	srv := httptest.NewServer(prod)
+	defer srv.Close()
+
+	base := Templates{&Template{
+		Name: "fleet",
+		Config: &api.Config{Clusters: map[string]*api.Cluster{
+			"prod":    &api.Cluster{Server: "https://old.example.org", CertificateAuthority: "/old/ca.pem"},
+			"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+		}},
+	}}
+
+	d, err := NewDiscovery(base, map[string]*rest.Config{"prod": &rest.Config{Host: srv.URL}}, Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewDiscovery(...): %v", err)
+	}
+
+	want := map[string]*api.Cluster{
+		"prod":    &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PAM")},
+		"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+	}
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("d.Refresh(): %v", err)
+	}
+	if diff := deep.Equal(want, d.Templates()[0].Config.Clusters); diff != nil {
+		t.Errorf("d.Templates(): want != got: %v", diff)
+	}
+
+	// Rotated CAs are discovered.
+	prod.ca = "TUFQ"
+	want["prod"].CertificateAuthorityData = []byte("MAP")
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("d.Refresh(): %v", err)
+	}
+	if diff := deep.Equal(want, d.Templates()[0].Config.Clusters); diff != nil {
+		t.Errorf("d.Templates(): want != got: %v", diff)
+	}
+
+	// The last discovered configuration is kept when discovery fails.
+	prod.ca = ""
+	if err := d.Refresh(); err == nil {
+		t.Errorf("d.Refresh(): want error, got nil")
+	}
+	if diff := deep.Equal(want, d.Templates()[0].Config.Clusters); diff != nil {
+		t.Errorf("d.Templates(): want != got: %v", diff)
+	}
+
+	// The base templates are not modified.
+	if base[0].Config.Clusters["prod"].Server != "https://old.example.org" {
+		t.Errorf("base: want unmodified template, got %+v", base[0].Config.Clusters["prod"])
+	}
+}
+
+func TestDiscoveryDefaultTemplate(t *testing.T) {
+	srv := httptest.NewServer(&fakeAPIServer{server: "https://prod.example.org", ca: "UEFN"})
+	defer srv.Close()
+
+	d, err := NewDiscovery(nil, map[string]*rest.Config{"prod": &rest.Config{Host: srv.URL}}, Logger(zap.NewNop()))
+	if err != nil {
+		t.Fatalf("NewDiscovery(...): %v", err)
+	}
+	if err := d.Refresh(); err != nil {
+		t.Fatalf("d.Refresh(): %v", err)
+	}
+
+	ts := d.Templates()
+	if len(ts) != 1 || ts[0].Name != DefaultDiscoveryTemplate {
+		t.Fatalf("d.Templates(): want one template named %v, got %v", DefaultDiscoveryTemplate, ts)
+	}
+	want := map[string]*api.Cluster{"prod": &api.Cluster{Server: "https://prod.example.org", CertificateAuthorityData: []byte("PAM")}}
+	if diff := deep.Equal(want, ts[0].Config.Clusters); diff != nil {
+		t.Errorf("d.Templates(): want != got: %v", diff)
+	}
+}
@@ -17,12 +17,15 @@ and limitations under the License.
 package kubecfg
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"sort"
 	"time"
 
 	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
+	"github.com/planetlabs/kubehook/auth/normalize"
 	"github.com/planetlabs/kubehook/handlers"
 	"github.com/planetlabs/kubehook/lifetime"
 
@@ -34,63 +37,296 @@ import (
 const (
 	templateUser       = "kubehook"
 	queryParamLifetime = "lifetime"
+	queryParamExpires  = "expiresAt"
+	queryParamTemplate = "template"
+	queryParamCred     = "credential"
+	queryParamGroup    = "group"
 )
 
-// LoadTemplate loads a kubeconfig template from a file.
-func LoadTemplate(filename string) (*api.Config, error) {
-	c, err := clientcmd.LoadFromFile(filename)
-	return c, errors.Wrapf(err, "cannot load template from %v", filename)
+// Kinds of credential with which generated kubeconfig users may authenticate.
+const (
+	CredentialToken = "token"
+	CredentialExec  = "exec"
+)
+
+// ExecAPIVersion is the client.authentication.k8s.io API version of the
+// credentials returned by the kubehook credential helper.
+const ExecAPIVersion = "client.authentication.k8s.io/v1beta1"
+
+// Exec configures kubeconfig users that authenticate by running the kubehook
+// credential helper, rather than using an embedded token.
+type Exec struct {
+	Command string // Command that runs kubehook on the user's machine.
+	Server  string // Server is kubehook's URL. It is derived from each request if unset.
+	Default bool   // Default to exec users unless a token is requested.
+}
+
+type listRsp struct {
+	Templates []string `json:"templates"`
+	Default   string   `json:"default,omitempty"`
 }
 
 // Handler returns an HTTP handler function that generates a kubeconfig file
 // preconfigured with a set of clusters and a JSON Web Token for the requesting
-// user.
-func Handler(g auth.Generator, template *api.Config, h handlers.AuthHeaders) http.HandlerFunc {
+// user. The token lifetime may be specified either as a duration or as an RFC
+// 3339 expiry time. The template may be specified via a query parameter. If it
+// is not, the requesting user's default template is returned; see
+// Templates.Default.
+// Clusters the requesting user is not allowed to use are omitted. Clusters that require
+// their own audience or lifetime are configured with their own user. Users may
+// either embed a token or run the kubehook credential helper, per the
+// credential query parameter. Users are named, and contexts namespaced, per the
+// supplied Users. Requests may specify group query parameters in order to
+// generate a file whose tokens include only the requested groups to which the
+// user belongs. The groups of the requesting user are enriched by the supplied
+// Enricher. Users and namespaces are named for the username as normalized by
+// the supplied Normalizer, which should be the Normalizer used by the supplied
+// Generator.
+func Handler(g auth.Generator, src Source, h handlers.AuthHeaders, e Exec, us Users, ge groups.Enricher, n *normalize.Normalizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
-		l, err := lifetime.ParseDuration(r.URL.Query().Get(queryParamLifetime))
+		ts := src.Templates()
+
+		exp, err := lifetime.ParseExpiry(r.URL.Query().Get(queryParamLifetime), r.URL.Query().Get(queryParamExpires))
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "cannot parse query parameters").Error(), http.StatusBadRequest)
+			return
+		}
+		l, err := exp.Resolve(time.Now())
 		if err != nil {
-			http.Error(w, errors.Wrapf(err, "cannot parse query parameter %v", queryParamLifetime).Error(), http.StatusBadRequest)
+			http.Error(w, errors.Wrap(err, "invalid token lifetime").Error(), http.StatusBadRequest)
 			return
 		}
 
-		u := r.Header.Get(h.User)
-		if u == "" {
-			http.Error(w, fmt.Sprintf("cannot extract username from header %s", h.User), http.StatusBadRequest)
+		exec := e.Default
+		switch r.URL.Query().Get(queryParamCred) {
+		case "":
+		case CredentialToken:
+			exec = false
+		case CredentialExec:
+			exec = true
+		default:
+			http.Error(w, fmt.Sprintf("query parameter %v must be %v or %v", queryParamCred, CredentialToken, CredentialExec), http.StatusBadRequest)
+			return
+		}
+
+		// The credential helper requests a new token each time the last
+		// expires, so it cannot honour an expiry time.
+		if !exp.ExpiresAt.IsZero() && exec {
+			http.Error(w, fmt.Sprintf("query parameter %v requires %v=%v", queryParamExpires, queryParamCred, CredentialToken), http.StatusBadRequest)
+			return
+		}
+
+		au, err := h.Extract(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resolved, err := ge.Enrich(au)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		gs := strings.Split(r.Header.Get(h.Group), h.GroupDelimiter)
-		t, err := g.Generate(&auth.User{Username: u, Groups: gs}, time.Duration(l))
+		u, err := n.Username(au.Username)
 		if err != nil {
-			http.Error(w, errors.Wrap(err, "cannot generate token").Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requested := r.URL.Query()[queryParamGroup]
+		if requested != nil && exec {
+			http.Error(w, fmt.Sprintf("query parameter %v requires %v=%v", queryParamGroup, queryParamCred, CredentialToken), http.StatusBadRequest)
+			return
+		}
+		gs, omitted := handlers.ScopeGroups(au.Groups, requested)
+
+		allowed := ts.Allowed(gs)
+		name := r.URL.Query().Get(queryParamTemplate)
+		if name == "" {
+			d := allowed.Default(gs)
+			if d == nil {
+				http.Error(w, fmt.Sprintf("user %s is not allowed to use any kubeconfig template", u), http.StatusForbidden)
+				return
+			}
+			name = d.Name
+		}
+		if _, exists := ts.Get(name); !exists {
+			http.Error(w, fmt.Sprintf("kubeconfig template %s does not exist", name), http.StatusNotFound)
+			return
+		}
+		tmpl, ok := allowed.Get(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("user %s is not allowed to use kubeconfig template %s", u, name), http.StatusForbidden)
 			return
 		}
 
-		y, err := clientcmd.Write(populateUser(template, templateUser, t))
+		cfg := tmpl.For(gs)
+		if len(cfg.Clusters) == 0 && len(tmpl.Config.Clusters) > 0 {
+			http.Error(w, fmt.Sprintf("user %s is not allowed to use any cluster in kubeconfig template %s", u, name), http.StatusForbidden)
+			return
+		}
+
+		server := e.Server
+		if server == "" {
+			server = handlers.RequestURL(r)
+		}
+
+		users, err := clusterUsers(cfg, tmpl.Clusters, func(cluster string) (string, error) { return us.name(u, cluster) })
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "cannot name users").Error(), http.StatusInternalServerError)
+			return
+		}
+		namespaces := make(map[string]string)
+		for cluster := range cfg.Clusters {
+			ns, err := us.Namespaces.Namespace(u, gs, cluster)
+			if err != nil {
+				http.Error(w, errors.Wrap(err, "cannot determine namespace").Error(), http.StatusInternalServerError)
+				return
+			}
+			namespaces[cluster] = ns
+		}
+		authInfos := make(map[string]*api.AuthInfo)
+		for _, cluster := range sortedKeys(users) {
+			user := users[cluster]
+			if _, ok := authInfos[user]; ok {
+				continue
+			}
+			ce := tmpl.Clusters[cluster]
+			lt := l
+			if ce.Lifetime != 0 && ce.Lifetime < lt {
+				lt = ce.Lifetime
+			}
+
+			if exec {
+				authInfos[user] = &api.AuthInfo{Exec: execConfig(e.Command, server, ce.Audience, lt)}
+				continue
+			}
+
+			o := []auth.GenerateOption{}
+			if len(omitted) > 0 {
+				o = append(o, auth.OmitGroups(omitted...))
+			}
+			if len(resolved) > 0 {
+				o = append(o, auth.ResolvedGroups(resolved...))
+			}
+			if ce.Audience != "" {
+				o = append(o, auth.Audience(ce.Audience))
+			}
+			// The Generator normalizes the username itself, recording the
+			// username as supplied in order to re-resolve its groups.
+			t, _, err := g.Generate(&auth.User{Username: au.Username, UID: au.UID, Groups: gs}, time.Duration(lt), o...)
+			if err != nil {
+				http.Error(w, errors.Wrapf(err, "cannot generate token for cluster %s", cluster).Error(), handlers.GenerateStatus(err))
+				return
+			}
+			authInfos[user] = &api.AuthInfo{Token: t}
+		}
+
+		y, err := clientcmd.Write(populateUsers(cfg, users, authInfos, namespaces))
 		if err != nil {
 			http.Error(w, errors.Wrap(err, "cannot marshal template to YAML").Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/x-yaml; charset=utf-8")
-		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tmpl.Name+".kubeconfig"))
 		w.Write(y) // nolint: gosec
 	}
 }
 
-func populateUser(cfg *api.Config, username, token string) api.Config {
-	c := api.Config{}
-	c.AuthInfos = make(map[string]*api.AuthInfo)
-	c.Clusters = make(map[string]*api.Cluster)
-	c.Contexts = make(map[string]*api.Context)
-	c.AuthInfos[username] = &api.AuthInfo{
-		Token: token,
+// List returns an HTTP handler function that lists the names of the templates
+// the requesting user is allowed to use, given their groups as enriched by the
+// supplied Enricher, and the template they receive by default.
+func List(src Source, h handlers.AuthHeaders, ge groups.Enricher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		u, err := h.Extract(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := ge.Enrich(u); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		allowed := src.Templates().Allowed(u.Groups)
+		rsp := listRsp{Templates: []string{}}
+		for _, t := range allowed {
+			rsp.Templates = append(rsp.Templates, t.Name)
+		}
+		if d := allowed.Default(u.Groups); d != nil {
+			rsp.Default = d.Name
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(rsp) // nolint: gosec
 	}
-	for name, cluster := range cfg.Clusters {
-		c.Clusters[name] = cluster
-		c.Contexts[name] = &api.Context{Cluster: name, AuthInfo: templateUser}
+}
+
+// clusterUsers returns the name of the user each cluster should use, as
+// returned by the supplied naming function. Clusters that require their own
+// audience or lifetime get their own user, suffixed with the cluster name if
+// another cluster's user has the same name.
+func clusterUsers(cfg *api.Config, exts map[string]ClusterExtension, name func(cluster string) (string, error)) (map[string]string, error) {
+	users := make(map[string]string)
+	count := make(map[string]int)
+	for cluster := range cfg.Clusters {
+		n, err := name(cluster)
+		if err != nil {
+			return nil, err
+		}
+		users[cluster] = n
+		count[n]++
+	}
+	for cluster, n := range users {
+		if e := exts[cluster]; (e.Audience != "" || e.Lifetime != 0) && count[n] > 1 {
+			users[cluster] = n + "-" + cluster
+		}
+	}
+	return users, nil
+}
+
+// execConfig returns an exec stanza that runs the kubehook credential helper.
+func execConfig(command, server, audience string, l lifetime.Duration) *api.ExecConfig {
+	args := []string{"credential", "--server=" + server, "--lifetime=" + l.String()}
+	if audience != "" {
+		args = append(args, "--audience="+audience)
+	}
+	return &api.ExecConfig{APIVersion: ExecAPIVersion, Command: command, Args: args}
+}
+
+// populateUsers returns a copy of the supplied template in which every context
+// refers to the user for its cluster, configured with the supplied AuthInfos.
+// Templates that define no contexts get one context per cluster. Contexts that
+// do not specify a namespace use the supplied namespace for their cluster.
+func populateUsers(cfg *api.Config, users map[string]string, authInfos map[string]*api.AuthInfo, namespaces map[string]string) api.Config {
+	c := cfg.DeepCopy()
+	c.AuthInfos = authInfos
+	delete(c.Extensions, ExtensionName)
+	if len(c.Contexts) == 0 {
+		c.Contexts = make(map[string]*api.Context)
+		for name := range c.Clusters {
+			c.Contexts[name] = &api.Context{Cluster: name}
+		}
+	}
+	for _, ctx := range c.Contexts {
+		ctx.AuthInfo = templateUser
+		if user, ok := users[ctx.Cluster]; ok {
+			ctx.AuthInfo = user
+		}
+		if ctx.Namespace == "" {
+			ctx.Namespace = namespaces[ctx.Cluster]
+		}
+	}
+	return *c
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	c.CurrentContext = cfg.CurrentContext
-	return c
+	sort.Strings(keys)
+	return keys
 }
@@ -17,15 +17,27 @@ and limitations under the License.
 package kubecfg
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/groups"
 	"github.com/planetlabs/kubehook/auth/noop"
+	"github.com/planetlabs/kubehook/auth/normalize"
 	"github.com/planetlabs/kubehook/handlers"
+	"github.com/planetlabs/kubehook/lifetime"
 
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
 )
@@ -34,6 +46,27 @@ const user = "user"
 
 var noGroups = []string{}
 
+var nz, _ = normalize.New()
+
+var h = handlers.AuthHeaders{
+	User:           handlers.DefaultUserHeader,
+	Group:          handlers.DefaultGroupHeader,
+	GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
+}
+
+var templates = Templates{
+	&Template{
+		Name:      "prod",
+		Config:    &api.Config{Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: "https://prod.example.org"}}},
+		Extension: Extension{Groups: []string{"admins"}},
+	},
+	&Template{
+		Name:      "sandbox",
+		Config:    &api.Config{Clusters: map[string]*api.Cluster{"sandbox": &api.Cluster{Server: "https://sandbox.example.org"}}},
+		Extension: Extension{DefaultForGroups: []string{"users"}},
+	},
+}
+
 func TestHandler(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -89,6 +122,60 @@ func TestHandler(t *testing.T) {
 				AuthInfos: map[string]*api.AuthInfo{templateUser: &api.AuthInfo{Token: user}},
 			},
 		},
+		{
+			name: "TemplateContexts",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			path: "/?lifetime=72h",
+			template: &api.Config{
+				Preferences: api.Preferences{Colors: true},
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a-default": &api.Context{AuthInfo: "someone", Cluster: "a"},
+					"a-team":    &api.Context{AuthInfo: "someone", Cluster: "a", Namespace: "team"},
+				},
+				AuthInfos:      map[string]*api.AuthInfo{"someone": &api.AuthInfo{Token: "secret"}},
+				CurrentContext: "a-team",
+			},
+			status: http.StatusOK,
+			want: api.Config{
+				Preferences: api.Preferences{Colors: true},
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts: map[string]*api.Context{
+					"a-default": &api.Context{AuthInfo: templateUser, Cluster: "a"},
+					"a-team":    &api.Context{AuthInfo: templateUser, Cluster: "a", Namespace: "team"},
+				},
+				AuthInfos:      map[string]*api.AuthInfo{templateUser: &api.AuthInfo{Token: user}},
+				CurrentContext: "a-team",
+			},
+		},
+		{
+			name: "TemplateExtensions",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			path: "/?lifetime=72h",
+			template: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{
+						Server:     "https://example.org",
+						Extensions: map[string]runtime.Object{"other": &runtime.Unknown{Raw: []byte(`{"some":"thing"}`)}},
+					},
+				},
+			},
+			status: http.StatusOK,
+			want: api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{
+						Server:     "https://example.org",
+						Extensions: map[string]runtime.Object{"other": &runtime.Unknown{Raw: []byte(`{"some":"thing"}`)}},
+					},
+				},
+				Contexts:  map[string]*api.Context{"a": &api.Context{AuthInfo: templateUser, Cluster: "a"}},
+				AuthInfos: map[string]*api.AuthInfo{templateUser: &api.AuthInfo{Token: user}},
+			},
+		},
 		{
 			name:     "MissingUsernameHeader",
 			head:     map[string]string{"some-header": "value"},
@@ -110,6 +197,52 @@ func TestHandler(t *testing.T) {
 			template: &api.Config{},
 			status:   http.StatusBadRequest,
 		},
+		{
+			name: "ExpiresAt",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			path: "/?expiresAt=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			template: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+			},
+			status: http.StatusOK,
+			want: api.Config{
+				Clusters: map[string]*api.Cluster{
+					"a": &api.Cluster{Server: "https://example.org", CertificateAuthorityData: []byte("PAM")},
+				},
+				Contexts:  map[string]*api.Context{"a": &api.Context{AuthInfo: templateUser, Cluster: "a"}},
+				AuthInfos: map[string]*api.AuthInfo{templateUser: &api.AuthInfo{Token: user}},
+			},
+		},
+		{
+			name:     "ExpiresAtPast",
+			head:     map[string]string{handlers.DefaultUserHeader: user},
+			path:     "/?expiresAt=2018-01-01T00:00:00Z",
+			template: &api.Config{},
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "LifetimeAndExpiresAt",
+			head:     map[string]string{handlers.DefaultUserHeader: user},
+			path:     "/?lifetime=1h&expiresAt=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			template: &api.Config{},
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "ExpiresAtWithExec",
+			head:     map[string]string{handlers.DefaultUserHeader: user},
+			path:     "/?credential=exec&expiresAt=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			template: &api.Config{},
+			status:   http.StatusBadRequest,
+		},
+		{
+			name:     "NegativeLifetime",
+			head:     map[string]string{handlers.DefaultUserHeader: user},
+			path:     "/?lifetime=-1d",
+			template: &api.Config{},
+			status:   http.StatusBadRequest,
+		},
 		{
 			name:     "EmptyLifetime",
 			head:     map[string]string{handlers.DefaultUserHeader: user},
@@ -130,13 +263,7 @@ func TestHandler(t *testing.T) {
 			for k, v := range tt.head {
 				r.Header.Set(k, v)
 			}
-
-			h := handlers.AuthHeaders{
-				User:           handlers.DefaultUserHeader,
-				Group:          handlers.DefaultGroupHeader,
-				GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
-			}
-			Handler(m, tt.template, h)(w, r)
+			Handler(m, Templates{&Template{Name: "default", Config: tt.template}}, h, Exec{}, Users{}, groups.Enricher{}, nz)(w, r)
 
 			if w.Code != tt.status {
 				t.Errorf("w.Code: want %v, got %v - %s", tt.status, w.Code, w.Body.Bytes())
@@ -157,3 +284,587 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerTemplates(t *testing.T) {
+	cases := []struct {
+		name    string
+		head    map[string]string
+		path    string
+		status  int
+		cluster string
+	}{
+		{
+			name:    "DefaultToFirstAllowed",
+			head:    map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "admins"},
+			path:    "/?lifetime=72h",
+			status:  http.StatusOK,
+			cluster: "prod",
+		},
+		{
+			name:    "DefaultForGroup",
+			head:    map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "admins;users"},
+			path:    "/?lifetime=72h",
+			status:  http.StatusOK,
+			cluster: "sandbox",
+		},
+		{
+			name:    "DefaultSkipsDisallowed",
+			head:    map[string]string{handlers.DefaultUserHeader: user},
+			path:    "/?lifetime=72h",
+			status:  http.StatusOK,
+			cluster: "sandbox",
+		},
+		{
+			name:    "SelectTemplate",
+			head:    map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "users;admins"},
+			path:    "/?lifetime=72h&template=sandbox",
+			status:  http.StatusOK,
+			cluster: "sandbox",
+		},
+		{
+			name:   "DisallowedTemplate",
+			head:   map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "users"},
+			path:   "/?lifetime=72h&template=prod",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "UnknownTemplate",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			path:   "/?lifetime=72h&template=staging",
+			status: http.StatusNotFound,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := noop.NewManager(noGroups)
+			if err != nil {
+				t.Fatalf("auth.NewNoopAuthenticator(%v): %v", noGroups, err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+
+			Handler(m, templates, h, Exec{}, Users{}, groups.Enricher{}, nz)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v - %s", tt.status, w.Code, w.Body.Bytes())
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			got, err := clientcmd.Load(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("clientcmd.Load(): %v", err)
+			}
+			if _, ok := got.Clusters[tt.cluster]; !ok || len(got.Clusters) != 1 {
+				t.Errorf("got.Clusters: want only %v, got %v", tt.cluster, got.Clusters)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	cases := []struct {
+		name string
+		head map[string]string
+		want *listRsp
+	}{
+		{
+			name: "Admin",
+			head: map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "admins"},
+			want: &listRsp{Templates: []string{"prod", "sandbox"}, Default: "prod"},
+		},
+		{
+			name: "AdminAndUser",
+			head: map[string]string{handlers.DefaultUserHeader: user, handlers.DefaultGroupHeader: "users;admins"},
+			want: &listRsp{Templates: []string{"prod", "sandbox"}, Default: "sandbox"},
+		},
+		{
+			name: "NoGroups",
+			head: map[string]string{handlers.DefaultUserHeader: user},
+			want: &listRsp{Templates: []string{"sandbox"}, Default: "sandbox"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+
+			List(templates, h, groups.Enricher{})(w, r)
+
+			rsp := &listRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+			}
+			if diff := deep.Equal(tt.want, rsp); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
+
+const prodTemplate = `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.example.org
+extensions:
+- name: kubehook
+  extension:
+    groups: [admins]
+    defaultForGroups: [oncall]
+`
+
+const sandboxTemplate = `apiVersion: v1
+kind: Config
+clusters:
+- name: sandbox
+  cluster:
+    server: https://sandbox.example.org
+    extensions:
+    - name: kubehook
+      extension:
+        groups: [developers]
+`
+
+func TestLoadTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for filename, content := range map[string]string{"sandbox.yaml": sandboxTemplate, "prod.yml": prodTemplate, ".hidden": "garbage", "prod.yml~": "garbage", "README": "garbage", "prod.yml.swp": "garbage"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), []byte(content), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile(%v): %v", filename, err)
+		}
+	}
+
+	ts, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatalf("LoadTemplates(%v): %v", dir, err)
+	}
+	if len(ts) != 2 {
+		t.Fatalf("LoadTemplates(%v): want 2 templates, got %d", dir, len(ts))
+	}
+	for i, want := range templates {
+		if ts[i].Name != want.Name {
+			t.Errorf("ts[%d].Name: want %v, got %v", i, want.Name, ts[i].Name)
+		}
+		if diff := deep.Equal(want.Groups, ts[i].Groups); diff != nil {
+			t.Errorf("ts[%d].Groups: want != got: %v", i, diff)
+		}
+	}
+
+	if diff := deep.Equal([]string{"oncall"}, ts[0].DefaultForGroups); diff != nil {
+		t.Errorf("ts[0].DefaultForGroups: want != got: %v", diff)
+	}
+	if diff := deep.Equal([]string{"developers"}, ts[1].Clusters["sandbox"].Groups); diff != nil {
+		t.Errorf("ts[1].Clusters[sandbox].Groups: want != got: %v", diff)
+	}
+
+	cfg := populateUsers(ts[0].Config, map[string]string{"prod": templateUser}, map[string]*api.AuthInfo{templateUser: &api.AuthInfo{Token: "token"}}, nil)
+	if _, ok := cfg.Extensions[ExtensionName]; ok {
+		t.Errorf("populateUsers(): want %v extension removed", ExtensionName)
+	}
+	if _, ok := ts[1].For([]string{"developers"}).Clusters["sandbox"].Extensions[ExtensionName]; ok {
+		t.Errorf("ts[1].For(): want %v cluster extension removed", ExtensionName)
+	}
+}
+
+func TestFor(t *testing.T) {
+	tmpl := &Template{
+		Name: "fleet",
+		Config: &api.Config{
+			Clusters: map[string]*api.Cluster{
+				"prod":    &api.Cluster{Server: "https://prod.example.org"},
+				"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+			},
+			Contexts: map[string]*api.Context{
+				"prod":         &api.Context{Cluster: "prod"},
+				"prod-team":    &api.Context{Cluster: "prod", Namespace: "team"},
+				"sandbox":      &api.Context{Cluster: "sandbox"},
+				"sandbox-team": &api.Context{Cluster: "sandbox", Namespace: "team"},
+			},
+			CurrentContext: "prod",
+		},
+		Clusters: map[string]ClusterExtension{"prod": ClusterExtension{Groups: []string{"admins"}}},
+	}
+
+	cases := []struct {
+		name   string
+		groups []string
+		want   *api.Config
+	}{
+		{
+			name:   "Admin",
+			groups: []string{"users", "admins"},
+			want:   tmpl.Config,
+		},
+		{
+			name:   "User",
+			groups: []string{"users"},
+			want: &api.Config{
+				Clusters: map[string]*api.Cluster{
+					"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+				},
+				Contexts: map[string]*api.Context{
+					"sandbox":      &api.Context{Cluster: "sandbox"},
+					"sandbox-team": &api.Context{Cluster: "sandbox", Namespace: "team"},
+				},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := deep.Equal(tt.want, tmpl.For(tt.groups)); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestAudiences(t *testing.T) {
+	ts := Templates{
+		&Template{Name: "a", Clusters: map[string]ClusterExtension{
+			"prod":    ClusterExtension{Audience: "prod"},
+			"sandbox": ClusterExtension{Groups: []string{"users"}},
+		}},
+		&Template{Name: "b", Clusters: map[string]ClusterExtension{
+			"prod":    ClusterExtension{Audience: "prod"},
+			"staging": ClusterExtension{Audience: "staging"},
+		}},
+		&Template{Name: "c"},
+	}
+	want := []string{"prod", "staging"}
+	if diff := deep.Equal(want, ts.Audiences()); diff != nil {
+		t.Errorf("ts.Audiences(): want != got: %v", diff)
+	}
+	if got := ts[2:].Audiences(); len(got) != 0 {
+		t.Errorf("ts.Audiences(): want no audiences, got %v", got)
+	}
+}
+
+// describingGenerator returns tokens describing how they were generated.
+type describingGenerator struct{}
+
+func (g describingGenerator) Generate(u *auth.User, l time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	return fmt.Sprintf("%s/%s/%s", u.Username, auth.NewGenerateOptions(o...).Audience, l), &auth.Token{User: *u}, nil
+}
+
+func TestHandlerClusterTokens(t *testing.T) {
+	tmpl := &Template{
+		Name: "fleet",
+		Config: &api.Config{
+			Clusters: map[string]*api.Cluster{
+				"prod":     &api.Cluster{Server: "https://prod.example.org"},
+				"staging":  &api.Cluster{Server: "https://staging.example.org"},
+				"sandbox":  &api.Cluster{Server: "https://sandbox.example.org"},
+				"sandbox2": &api.Cluster{Server: "https://sandbox2.example.org"},
+			},
+		},
+		Clusters: map[string]ClusterExtension{
+			"prod":    ClusterExtension{Audience: "prod", Lifetime: lifetime.Hour},
+			"staging": ClusterExtension{Audience: "staging", Lifetime: 100 * lifetime.Hour},
+		},
+	}
+	want := api.Config{
+		Clusters: tmpl.Config.Clusters,
+		Contexts: map[string]*api.Context{
+			"prod":     &api.Context{AuthInfo: "kubehook-prod", Cluster: "prod"},
+			"staging":  &api.Context{AuthInfo: "kubehook-staging", Cluster: "staging"},
+			"sandbox":  &api.Context{AuthInfo: templateUser, Cluster: "sandbox"},
+			"sandbox2": &api.Context{AuthInfo: templateUser, Cluster: "sandbox2"},
+		},
+		AuthInfos: map[string]*api.AuthInfo{
+			"kubehook-prod":    &api.AuthInfo{Token: "user/prod/1h0m0s"},
+			"kubehook-staging": &api.AuthInfo{Token: "user/staging/72h0m0s"},
+			templateUser:       &api.AuthInfo{Token: "user//72h0m0s"},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?lifetime=72h", nil)
+	r.Header.Set(handlers.DefaultUserHeader, user)
+
+	Handler(describingGenerator{}, Templates{tmpl}, h, Exec{}, Users{}, groups.Enricher{}, nz)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body.Bytes())
+	}
+	y, _ := clientcmd.Write(want)
+	if diff := deep.Equal(string(y), string(w.Body.Bytes())); diff != nil {
+		t.Errorf("want != got: %v", diff)
+	}
+}
+
+func TestHandlerUsers(t *testing.T) {
+	tmpl := &Template{
+		Name: "fleet",
+		Config: &api.Config{
+			Clusters: map[string]*api.Cluster{
+				"prod":    &api.Cluster{Server: "https://prod.example.org"},
+				"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+			},
+			Contexts: map[string]*api.Context{
+				"prod":    &api.Context{Cluster: "prod"},
+				"sandbox": &api.Context{Cluster: "sandbox", Namespace: "playground"},
+			},
+		},
+		Clusters: map[string]ClusterExtension{"prod": ClusterExtension{Audience: "prod"}},
+	}
+	name, err := ParseUserName("{{.Username}}@{{.Cluster}}")
+	if err != nil {
+		t.Fatalf("ParseUserName(): %v", err)
+	}
+	ns, err := NewNamespacer(&NamespaceRules{Rules: []NamespaceRule{
+		{Groups: []string{"admins"}, Namespace: "kube-system"},
+		{Groups: []string{"devs"}, Namespace: "dev-{{.Username}}"},
+	}})
+	if err != nil {
+		t.Fatalf("NewNamespacer(): %v", err)
+	}
+	want := api.Config{
+		Clusters: tmpl.Config.Clusters,
+		Contexts: map[string]*api.Context{
+			"prod":    &api.Context{AuthInfo: "user@prod", Cluster: "prod", Namespace: "dev-user"},
+			"sandbox": &api.Context{AuthInfo: "user@sandbox", Cluster: "sandbox", Namespace: "playground"},
+		},
+		AuthInfos: map[string]*api.AuthInfo{
+			"user@prod":    &api.AuthInfo{Token: "user/prod/24h0m0s"},
+			"user@sandbox": &api.AuthInfo{Token: "user//24h0m0s"},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?lifetime=24h", nil)
+	r.Header.Set(handlers.DefaultUserHeader, user)
+	r.Header.Set(handlers.DefaultGroupHeader, "devs")
+
+	Handler(describingGenerator{}, Templates{tmpl}, h, Exec{}, Users{Name: name, Namespaces: ns}, groups.Enricher{}, nz)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body.Bytes())
+	}
+	y, _ := clientcmd.Write(want)
+	if diff := deep.Equal(string(y), string(w.Body.Bytes())); diff != nil {
+		t.Errorf("want != got: %v", diff)
+	}
+}
+
+func TestHandlerNormalizedUsers(t *testing.T) {
+	tmpl := &Template{
+		Name:   "prod",
+		Config: &api.Config{Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: "https://prod.example.org"}}},
+	}
+	name, err := ParseUserName("{{.Username}}@{{.Cluster}}")
+	if err != nil {
+		t.Fatalf("ParseUserName(): %v", err)
+	}
+	ns, err := NewNamespacer(&NamespaceRules{Rules: []NamespaceRule{{Namespace: "dev-{{.Username}}"}}})
+	if err != nil {
+		t.Fatalf("NewNamespacer(): %v", err)
+	}
+	n, err := normalize.New(normalize.Lowercase(), normalize.StripDomains("corp.com"))
+	if err != nil {
+		t.Fatalf("normalize.New(): %v", err)
+	}
+	want := api.Config{
+		Clusters: tmpl.Config.Clusters,
+		Contexts: map[string]*api.Context{
+			"prod": &api.Context{AuthInfo: "alice@prod", Cluster: "prod", Namespace: "dev-alice"},
+		},
+		AuthInfos: map[string]*api.AuthInfo{
+			"alice@prod": &api.AuthInfo{Token: "alice//24h0m0s"},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?lifetime=24h", nil)
+	r.Header.Set(handlers.DefaultUserHeader, "Alice@Corp.com")
+
+	Handler(normalize.Generator(describingGenerator{}, n), Templates{tmpl}, h, Exec{}, Users{Name: name, Namespaces: ns}, groups.Enricher{}, n)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body.Bytes())
+	}
+	y, _ := clientcmd.Write(want)
+	if diff := deep.Equal(string(y), string(w.Body.Bytes())); diff != nil {
+		t.Errorf("want != got: %v", diff)
+	}
+}
+
+func TestHandlerExec(t *testing.T) {
+	tmpl := &Template{
+		Name: "fleet",
+		Config: &api.Config{
+			Clusters: map[string]*api.Cluster{
+				"prod":    &api.Cluster{Server: "https://prod.example.org"},
+				"sandbox": &api.Cluster{Server: "https://sandbox.example.org"},
+			},
+		},
+		Clusters: map[string]ClusterExtension{"prod": ClusterExtension{Audience: "prod", Lifetime: lifetime.Hour}},
+	}
+	contexts := map[string]*api.Context{
+		"prod":    &api.Context{AuthInfo: "kubehook-prod", Cluster: "prod"},
+		"sandbox": &api.Context{AuthInfo: templateUser, Cluster: "sandbox"},
+	}
+
+	cases := []struct {
+		name string
+		path string
+		e    Exec
+		want api.Config
+	}{
+		{
+			name: "QueryParam",
+			path: "/?lifetime=24h&credential=exec",
+			e:    Exec{Command: "kubehook", Server: "https://kubehook.example.org"},
+			want: api.Config{
+				Clusters: tmpl.Config.Clusters,
+				Contexts: contexts,
+				AuthInfos: map[string]*api.AuthInfo{
+					"kubehook-prod": &api.AuthInfo{Exec: &api.ExecConfig{
+						APIVersion: ExecAPIVersion,
+						Command:    "kubehook",
+						Args:       []string{"credential", "--server=https://kubehook.example.org", "--lifetime=1h0m0s", "--audience=prod"},
+					}},
+					templateUser: &api.AuthInfo{Exec: &api.ExecConfig{
+						APIVersion: ExecAPIVersion,
+						Command:    "kubehook",
+						Args:       []string{"credential", "--server=https://kubehook.example.org", "--lifetime=24h0m0s"},
+					}},
+				},
+			},
+		},
+		{
+			name: "DefaultFromRequest",
+			path: "/?lifetime=24h",
+			e:    Exec{Command: "/usr/local/bin/kubehook", Default: true},
+			want: api.Config{
+				Clusters: tmpl.Config.Clusters,
+				Contexts: contexts,
+				AuthInfos: map[string]*api.AuthInfo{
+					"kubehook-prod": &api.AuthInfo{Exec: &api.ExecConfig{
+						APIVersion: ExecAPIVersion,
+						Command:    "/usr/local/bin/kubehook",
+						Args:       []string{"credential", "--server=http://example.com", "--lifetime=1h0m0s", "--audience=prod"},
+					}},
+					templateUser: &api.AuthInfo{Exec: &api.ExecConfig{
+						APIVersion: ExecAPIVersion,
+						Command:    "/usr/local/bin/kubehook",
+						Args:       []string{"credential", "--server=http://example.com", "--lifetime=24h0m0s"},
+					}},
+				},
+			},
+		},
+		{
+			name: "TokenOverridesDefault",
+			path: "/?lifetime=24h&credential=token",
+			e:    Exec{Command: "kubehook", Default: true},
+			want: api.Config{
+				Clusters: tmpl.Config.Clusters,
+				Contexts: contexts,
+				AuthInfos: map[string]*api.AuthInfo{
+					"kubehook-prod": &api.AuthInfo{Token: "user/prod/1h0m0s"},
+					templateUser:    &api.AuthInfo{Token: "user//24h0m0s"},
+				},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set(handlers.DefaultUserHeader, user)
+
+			Handler(describingGenerator{}, Templates{tmpl}, h, tt.e, Users{}, groups.Enricher{}, nz)(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("w.Code: want %v, got %v - %s", http.StatusOK, w.Code, w.Body.Bytes())
+			}
+			y, _ := clientcmd.Write(tt.want)
+			if diff := deep.Equal(string(y), string(w.Body.Bytes())); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
+
+// groupsGenerator returns tokens describing the groups they include and omit.
+type groupsGenerator struct{}
+
+func (g groupsGenerator) Generate(u *auth.User, l time.Duration, o ...auth.GenerateOption) (string, *auth.Token, error) {
+	omitted := auth.NewGenerateOptions(o...).OmittedGroups
+	return fmt.Sprintf("%s/%s", strings.Join(u.Groups, ","), strings.Join(omitted, ",")), &auth.Token{User: *u}, nil
+}
+
+func TestHandlerGroups(t *testing.T) {
+	tmpl := &Template{
+		Name: "fleet",
+		Config: &api.Config{
+			Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: "https://prod.example.org"}},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		url    string
+		e      Exec
+		status int
+		token  string
+	}{
+		{
+			name:   "AllGroups",
+			url:    "/?lifetime=1h",
+			status: http.StatusOK,
+			token:  "a,b,c/",
+		},
+		{
+			name:   "ScopedGroups",
+			url:    "/?lifetime=1h&group=a&group=c&group=d",
+			status: http.StatusOK,
+			token:  "a,c/b",
+		},
+		{
+			name:   "ExecCredential",
+			url:    "/?lifetime=1h&group=a",
+			e:      Exec{Default: true},
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.url, nil)
+			r.Header.Set(handlers.DefaultUserHeader, user)
+			r.Header.Set(handlers.DefaultGroupHeader, "a;b;c")
+
+			Handler(groupsGenerator{}, Templates{tmpl}, h, tt.e, Users{}, groups.Enricher{}, nz)(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("w.Code: want %v, got %v - %s", tt.status, w.Code, w.Body.Bytes())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			cfg, err := clientcmd.Load(w.Body.Bytes())
+			if err != nil {
+				t.Fatalf("clientcmd.Load(): %v", err)
+			}
+			if got := cfg.AuthInfos[templateUser].Token; got != tt.token {
+				t.Errorf("token: want %v, got %v", tt.token, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Names of the template reload metrics, exposed via expvar.
+const (
+	VarReloads         = "kubecfg_template_reloads"
+	VarLastReload      = "kubecfg_template_last_reload_timestamp_seconds"
+	VarLastReloadError = "kubecfg_template_last_reload_error"
+)
+
+var (
+	reloads       = expvar.NewMap(VarReloads)
+	lastReload    = expvar.NewInt(VarLastReload)
+	lastReloadErr = expvar.NewString(VarLastReloadError)
+)
+
+// A LoadFunc loads kubeconfig templates.
+type LoadFunc func() (Templates, error)
+
+// A Reloader is a Source of kubeconfig templates that may be reloaded. The last
+// successfully loaded templates are served if a reload fails.
+type Reloader struct {
+	load LoadFunc
+
+	mx      sync.RWMutex
+	current Templates
+}
+
+// NewReloader returns a Source of the templates loaded by the supplied
+// function. The templates must load successfully.
+func NewReloader(load LoadFunc) (*Reloader, error) {
+	ts, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{load: load, current: ts}, nil
+}
+
+// Templates returns the last successfully loaded templates.
+func (r *Reloader) Templates() Templates {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.current
+}
+
+// Reload the templates, atomically replacing the current templates if they
+// load successfully.
+func (r *Reloader) Reload() error {
+	ts, err := r.load()
+	if err != nil {
+		reloads.Add("failure", 1)
+		lastReloadErr.Set(err.Error())
+		return errors.Wrap(err, "cannot reload templates")
+	}
+
+	r.mx.Lock()
+	r.current = ts
+	r.mx.Unlock()
+
+	reloads.Add("success", 1)
+	lastReload.Set(time.Now().Unix())
+	lastReloadErr.Set("")
+	return nil
+}
+
+// Watch the supplied files and directories, reloading the templates whenever
+// they change until stopped. The result of each reload is passed to the
+// supplied function. Watch the directory containing a template file rather
+// than the file itself to observe files that are replaced rather than written,
+// for example Kubernetes ConfigMap volumes.
+func (r *Reloader) Watch(paths []string, stop <-chan struct{}, reloaded func(error)) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create watcher")
+	}
+	for _, p := range paths {
+		if err := w.Add(p); err != nil {
+			w.Close() // nolint: gosec
+			return errors.Wrapf(err, "cannot watch %s", p)
+		}
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-w.Events:
+				reloaded(r.Reload())
+			case err := <-w.Errors:
+				reloaded(errors.Wrap(err, "cannot watch templates"))
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
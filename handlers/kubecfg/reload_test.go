@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(filename, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), []byte(content), 0600); err != nil {
+			t.Fatalf("ioutil.WriteFile(%v): %v", filename, err)
+		}
+	}
+	names := func(ts Templates) []string {
+		n := []string{}
+		for _, t := range ts {
+			n = append(n, t.Name)
+		}
+		return n
+	}
+
+	write("sandbox.yaml", sandboxTemplate)
+	r, err := NewReloader(func() (Templates, error) { return LoadTemplates(dir) })
+	if err != nil {
+		t.Fatalf("NewReloader(...): %v", err)
+	}
+	if got := names(r.Templates()); len(got) != 1 || got[0] != "sandbox" {
+		t.Errorf("r.Templates(): want [sandbox], got %v", got)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	reloaded := make(chan error, 10)
+	if err := r.Watch([]string{dir}, stop, func(err error) { reloaded <- err }); err != nil {
+		t.Fatalf("r.Watch(%v): %v", dir, err)
+	}
+
+	// Reloads that fail retain the last good templates.
+	write("broken.yaml", "{{{")
+	select {
+	case err := <-reloaded:
+		if err == nil {
+			t.Errorf("reload: want error for broken template, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reload: timed out waiting for reload")
+	}
+	if got := names(r.Templates()); len(got) != 1 || got[0] != "sandbox" {
+		t.Errorf("r.Templates(): want [sandbox], got %v", got)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "broken.yaml")); err != nil {
+		t.Fatalf("os.Remove(): %v", err)
+	}
+	write("prod.yaml", prodTemplate)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("r.Reload(): %v", err)
+	}
+	if got := names(r.Templates()); len(got) != 2 || got[0] != "prod" {
+		t.Errorf("r.Templates(): want [prod sandbox], got %v", got)
+	}
+}
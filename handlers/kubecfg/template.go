@@ -0,0 +1,240 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	// Register encoding of unknown kubeconfig extensions.
+	_ "github.com/planetlabs/kubehook/kubeconfig/unknown"
+	"github.com/planetlabs/kubehook/lifetime"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// ExtensionName is the name of the kubeconfig extension from which kubehook
+// reads its configuration. The extension is removed from generated kubeconfigs.
+const ExtensionName = "kubehook"
+
+// Extension configures how kubehook treats a kubeconfig template.
+type Extension struct {
+	// Groups that may use the template. Anyone may use a template that does
+	// not specify any groups.
+	Groups []string `json:"groups,omitempty"`
+
+	// DefaultForGroups are the groups whose members receive this template when
+	// they do not request a particular template.
+	DefaultForGroups []string `json:"defaultForGroups,omitempty"`
+}
+
+// ClusterExtension configures how kubehook treats a cluster in a kubeconfig
+// template.
+type ClusterExtension struct {
+	// Groups that may use the cluster. Anyone may use a cluster that does not
+	// specify any groups.
+	Groups []string `json:"groups,omitempty"`
+
+	// Audience of tokens generated for the cluster. Tokens generated for a
+	// cluster with an audience are not valid for any other cluster.
+	Audience string `json:"audience,omitempty"`
+
+	// Lifetime is the maximum lifetime of tokens generated for the cluster.
+	Lifetime lifetime.Duration `json:"lifetime,omitempty"`
+}
+
+// A Template from which kubeconfig files are generated.
+type Template struct {
+	Name   string
+	Config *api.Config
+	Extension
+
+	// Clusters maps cluster names to their extension, if any.
+	Clusters map[string]ClusterExtension
+}
+
+// Allowed returns true if a member of the supplied groups may use this
+// template.
+func (t *Template) Allowed(groups []string) bool {
+	return allowed(t.Groups, groups)
+}
+
+// For returns a copy of the template's kubeconfig containing only the clusters
+// a member of the supplied groups may use, and the contexts that refer to them.
+func (t *Template) For(groups []string) *api.Config {
+	c := t.Config.DeepCopy()
+	for name, cluster := range c.Clusters {
+		delete(cluster.Extensions, ExtensionName)
+		if !allowed(t.Clusters[name].Groups, groups) {
+			delete(c.Clusters, name)
+		}
+	}
+	for name, ctx := range c.Contexts {
+		if _, ok := c.Clusters[ctx.Cluster]; !ok {
+			delete(c.Contexts, name)
+		}
+	}
+	if _, ok := c.Contexts[c.CurrentContext]; !ok {
+		c.CurrentContext = ""
+	}
+	return c
+}
+
+// Templates from which kubeconfig files are generated, sorted by name.
+type Templates []*Template
+
+// Allowed returns the templates that a member of the supplied groups may use.
+func (ts Templates) Allowed(groups []string) Templates {
+	a := Templates{}
+	for _, t := range ts {
+		if t.Allowed(groups) {
+			a = append(a, t)
+		}
+	}
+	return a
+}
+
+// Default returns the template a member of the supplied groups receives when
+// they do not request a particular template: the first template that is the
+// default for any of their groups, or failing that the first template. It
+// returns nil if there are no templates. Templates are typically filtered via
+// Allowed before a default is chosen.
+func (ts Templates) Default(groups []string) *Template {
+	for _, t := range ts {
+		if len(t.DefaultForGroups) > 0 && allowed(t.DefaultForGroups, groups) {
+			return t
+		}
+	}
+	if len(ts) == 0 {
+		return nil
+	}
+	return ts[0]
+}
+
+// Get the named template.
+func (ts Templates) Get(name string) (*Template, bool) {
+	for _, t := range ts {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// Audiences returns the distinct audiences of the templates' clusters, sorted.
+func (ts Templates) Audiences() []string {
+	seen := map[string]bool{}
+	for _, t := range ts {
+		for _, c := range t.Clusters {
+			if c.Audience != "" {
+				seen[c.Audience] = true
+			}
+		}
+	}
+	a := make([]string, 0, len(seen))
+	for aud := range seen {
+		a = append(a, aud)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// LoadTemplate loads a kubeconfig template from a file. The template is named
+// for its file, less any extension.
+func LoadTemplate(filename string) (*Template, error) {
+	c, err := clientcmd.LoadFromFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load template from %v", filename)
+	}
+	t := &Template{
+		Name:     strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)),
+		Config:   c,
+		Clusters: make(map[string]ClusterExtension),
+	}
+	if err := extension(c.Extensions, &t.Extension); err != nil {
+		return nil, errors.Wrapf(err, "cannot load template from %v", filename)
+	}
+	for name, cluster := range c.Clusters {
+		e := ClusterExtension{}
+		if err := extension(cluster.Extensions, &e); err != nil {
+			return nil, errors.Wrapf(err, "cannot load cluster %v of template %v", name, filename)
+		}
+		t.Clusters[name] = e
+	}
+	return t, nil
+}
+
+// templateExtensions are the extensions of files LoadTemplates loads.
+var templateExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// LoadTemplates loads every kubeconfig template in a directory. Only files with
+// a .yaml, .yml, or .json extension are loaded; hidden files, subdirectories,
+// and other files such as editor backups are ignored.
+func LoadTemplates(dir string) (Templates, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read template directory %v", dir)
+	}
+	ts := Templates{}
+	for _, fi := range fis {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || !templateExtensions[filepath.Ext(fi.Name())] {
+			continue
+		}
+		t, err := LoadTemplate(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := ts.Get(t.Name); exists {
+			return nil, errors.Errorf("multiple templates named %v in %v", t.Name, dir)
+		}
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i].Name < ts[j].Name })
+	return ts, nil
+}
+
+func extension(exts map[string]runtime.Object, into interface{}) error {
+	o, ok := exts[ExtensionName]
+	if !ok {
+		return nil
+	}
+	u, ok := o.(*runtime.Unknown)
+	if !ok {
+		return errors.Errorf("cannot decode %v extension", ExtensionName)
+	}
+	return errors.Wrapf(json.Unmarshal(u.Raw, into), "cannot decode %v extension", ExtensionName)
+}
+
+func allowed(want, have []string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultUserName is the name of the user generated kubeconfig files contain
+// when no user name template is supplied.
+const DefaultUserName = templateUser
+
+// Users configures how the users and contexts of generated kubeconfig files are
+// named and namespaced.
+type Users struct {
+	// Name is rendered with a UserData to name the user for each cluster.
+	// DefaultUserName is used if it is nil.
+	Name *template.Template
+
+	// Namespaces sets the default namespace of generated contexts. Contexts
+	// are not namespaced if it is nil.
+	Namespaces *Namespacer
+}
+
+// UserData is passed to user name and namespace templates.
+type UserData struct {
+	Username string
+	Cluster  string
+}
+
+// ParseUserName parses a text/template used to name the users of generated
+// kubeconfig files, e.g. {{.Username}}@{{.Cluster}}.
+func ParseUserName(text string) (*template.Template, error) {
+	t, err := template.New("user").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse user name template")
+	}
+	if _, err := render(t, UserData{Username: "user", Cluster: "cluster"}); err != nil {
+		return nil, errors.Wrap(err, "invalid user name template")
+	}
+	return t, nil
+}
+
+// name returns the name of the user the supplied user should use to connect
+// to the supplied cluster.
+func (u Users) name(username, cluster string) (string, error) {
+	if u.Name == nil {
+		return DefaultUserName, nil
+	}
+	n, err := render(u.Name, UserData{Username: username, Cluster: cluster})
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot render user name for cluster %s", cluster)
+	}
+	if n == "" {
+		return "", errors.Errorf("user name for cluster %s is empty", cluster)
+	}
+	return n, nil
+}
+
+// A NamespaceRule sets the default namespace of contexts generated for users
+// matching all of its non-empty criteria.
+type NamespaceRule struct {
+	// Users are path.Match patterns matched against the username, e.g.
+	// *@example.org
+	Users []string `json:"users,omitempty"`
+
+	// Groups, any of which the user must be a member of.
+	Groups []string `json:"groups,omitempty"`
+
+	// Clusters to which the rule applies.
+	Clusters []string `json:"clusters,omitempty"`
+
+	// Namespace is a text/template rendered with a UserData to produce a
+	// namespace, e.g. dev-{{.Username}}.
+	Namespace string `json:"namespace"`
+}
+
+// NamespaceRules set the default namespace of generated contexts. The first
+// matching rule applies.
+type NamespaceRules struct {
+	Rules []NamespaceRule `json:"rules"`
+}
+
+// LoadNamespaceRules loads namespace rules from a YAML file.
+func LoadNamespaceRules(filename string) (*NamespaceRules, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read namespace rules from %v", filename)
+	}
+	r := &NamespaceRules{}
+	if err := yaml.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "cannot parse namespace rules from %v", filename)
+	}
+	if _, err := r.compile(); err != nil {
+		return nil, errors.Wrapf(err, "invalid namespace rules in %v", filename)
+	}
+	return r, nil
+}
+
+type namespaceRule struct {
+	NamespaceRule
+	namespace *template.Template
+}
+
+func (r *NamespaceRules) compile() ([]namespaceRule, error) {
+	compiled := make([]namespaceRule, 0, len(r.Rules))
+	for i, rl := range r.Rules {
+		for _, u := range rl.Users {
+			if _, err := path.Match(u, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid user pattern %q in rule %d", u, i)
+			}
+		}
+		if rl.Namespace == "" {
+			return nil, errors.Errorf("rule %d has no namespace", i)
+		}
+		t, err := template.New("namespace").Option("missingkey=error").Parse(rl.Namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid namespace template in rule %d", i)
+		}
+		compiled = append(compiled, namespaceRule{NamespaceRule: rl, namespace: t})
+	}
+	return compiled, nil
+}
+
+// A Namespacer determines the default namespace of generated contexts.
+type Namespacer struct {
+	rules []namespaceRule
+}
+
+// NewNamespacer returns a Namespacer that applies the supplied rules.
+func NewNamespacer(r *NamespaceRules) (*Namespacer, error) {
+	rules, err := r.compile()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid namespace rules")
+	}
+	return &Namespacer{rules: rules}, nil
+}
+
+// Namespace returns the default namespace for the supplied user when connecting
+// to the supplied cluster, or an empty string if no rule matches. It returns an
+// error if the rendered namespace is not a valid DNS-1123 label.
+func (n *Namespacer) Namespace(username string, groups []string, cluster string) (string, error) {
+	if n == nil {
+		return "", nil
+	}
+	for _, r := range n.rules {
+		if !r.matches(username, groups, cluster) {
+			continue
+		}
+		ns, err := render(r.namespace, UserData{Username: username, Cluster: cluster})
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot render namespace for cluster %s", cluster)
+		}
+		if problems := validation.IsDNS1123Label(ns); len(problems) > 0 {
+			return "", errors.Errorf("invalid namespace %q for cluster %s: %s", ns, cluster, strings.Join(problems, "; "))
+		}
+		return ns, nil
+	}
+	return "", nil
+}
+
+func (r namespaceRule) matches(username string, groups []string, cluster string) bool {
+	if len(r.Users) > 0 && !matchesAny(r.Users, username) {
+		return false
+	}
+	if len(r.Groups) > 0 && !allowed(r.Groups, groups) {
+		return false
+	}
+	if len(r.Clusters) > 0 && !allowed(r.Clusters, []string{cluster}) {
+		return false
+	}
+	return true
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func render(t *template.Template, d UserData) (string, error) {
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	n, err := NewNamespacer(&NamespaceRules{Rules: []NamespaceRule{
+		{Users: []string{"*@contractor.org"}, Namespace: "contractors"},
+		{Groups: []string{"devs"}, Clusters: []string{"sandbox"}, Namespace: "sandbox-{{.Username}}"},
+		{Groups: []string{"devs"}, Namespace: "dev"},
+	}})
+	if err != nil {
+		t.Fatalf("NewNamespacer(): %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		username string
+		groups   []string
+		cluster  string
+		want     string
+		wantErr  bool
+	}{
+		{name: "UserPattern", username: "alice@contractor.org", groups: []string{"devs"}, cluster: "sandbox", want: "contractors"},
+		{name: "ClusterSpecific", username: "bob", groups: []string{"devs"}, cluster: "sandbox", want: "sandbox-bob"},
+		{name: "Group", username: "bob", groups: []string{"ops", "devs"}, cluster: "prod", want: "dev"},
+		{name: "NoMatch", username: "carol", groups: []string{"ops"}, cluster: "prod", want: ""},
+		{name: "InvalidNamespace", username: "Bob.Smith", groups: []string{"devs"}, cluster: "sandbox", wantErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := n.Namespace(tc.username, tc.groups, tc.cluster)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("n.Namespace(): want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("n.Namespace(): %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("n.Namespace(): want %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	var none *Namespacer
+	if got, err := none.Namespace("bob", nil, "prod"); got != "" || err != nil {
+		t.Errorf("none.Namespace(): want empty namespace, got %q, %v", got, err)
+	}
+}
+
+func TestNewNamespacerInvalid(t *testing.T) {
+	cases := map[string]NamespaceRule{
+		"BadPattern":  {Users: []string{"["}, Namespace: "ns"},
+		"NoNamespace": {Groups: []string{"devs"}},
+		"BadTemplate": {Namespace: "{{.Username"},
+	}
+	for name, r := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewNamespacer(&NamespaceRules{Rules: []NamespaceRule{r}}); err == nil {
+				t.Errorf("NewNamespacer(): want error, got nil")
+			}
+		})
+	}
+}
+
+func TestParseUserName(t *testing.T) {
+	if _, err := ParseUserName("{{.Nope}}"); err == nil {
+		t.Errorf("ParseUserName(): want error for unknown field, got nil")
+	}
+	tmpl, err := ParseUserName("{{.Username}}@{{.Cluster}}")
+	if err != nil {
+		t.Fatalf("ParseUserName(): %v", err)
+	}
+	got, err := Users{Name: tmpl}.name("alice", "prod")
+	if err != nil || got != "alice@prod" {
+		t.Errorf("name(): want alice@prod, got %q, %v", got, err)
+	}
+}
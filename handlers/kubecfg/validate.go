@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Validate returns an error describing every problem with the template.
+// Cluster servers must be valid URLs, cluster CA data must be valid PEM encoded
+// certificates, the current context must exist, and no credentials may be
+// embedded. The server and CA data of the supplied discovered clusters are not
+// validated, because they are replaced by discovery.
+func (t *Template) Validate(discovered ...string) error {
+	skip := make(map[string]bool)
+	for _, name := range discovered {
+		skip[name] = true
+	}
+
+	problems := []string{}
+	for _, name := range sortedClusters(t.Config.Clusters) {
+		if skip[name] {
+			continue
+		}
+		c := t.Config.Clusters[name]
+		if err := validateServer(c.Server); err != nil {
+			problems = append(problems, fmt.Sprintf("cluster %s: %v", name, err))
+		}
+		if err := validateCA(c.CertificateAuthorityData); err != nil {
+			problems = append(problems, fmt.Sprintf("cluster %s: %v", name, err))
+		}
+	}
+	for name, ctx := range t.Config.Contexts {
+		if _, ok := t.Config.Clusters[ctx.Cluster]; !ok {
+			problems = append(problems, fmt.Sprintf("context %s refers to missing cluster %q", name, ctx.Cluster))
+		}
+	}
+	if t.Config.CurrentContext != "" {
+		if _, ok := t.Config.Contexts[t.Config.CurrentContext]; !ok {
+			problems = append(problems, fmt.Sprintf("current context %s does not exist", t.Config.CurrentContext))
+		}
+	}
+	for name, ai := range t.Config.AuthInfos {
+		if embedsCredentials(ai) {
+			problems = append(problems, fmt.Sprintf("user %s embeds credentials", name))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.Errorf("invalid kubeconfig template %s: %s", t.Name, strings.Join(problems, "; "))
+}
+
+// Validate every template.
+func (ts Templates) Validate(discovered ...string) error {
+	problems := []string{}
+	for _, t := range ts {
+		if err := t.Validate(discovered...); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "\n"))
+}
+
+func validateServer(server string) error {
+	if server == "" {
+		return errors.New("server URL is missing")
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse server URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.Errorf("server URL %s must use https or http", server)
+	}
+	if u.Host == "" {
+		return errors.Errorf("server URL %s has no host", server)
+	}
+	return nil
+}
+
+func validateCA(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	certs := 0
+	for rest := data; len(strings.TrimSpace(string(rest))) > 0; {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			return errors.New("certificate authority data is not valid PEM")
+		}
+		if b.Type != "CERTIFICATE" {
+			return errors.Errorf("certificate authority data contains a %s, not a CERTIFICATE", b.Type)
+		}
+		if _, err := x509.ParseCertificate(b.Bytes); err != nil {
+			return errors.Wrap(err, "cannot parse certificate authority data")
+		}
+		certs++
+	}
+	if certs == 0 {
+		return errors.New("certificate authority data contains no certificates")
+	}
+	return nil
+}
+
+func embedsCredentials(ai *api.AuthInfo) bool {
+	return ai.Token != "" || ai.TokenFile != "" ||
+		ai.Username != "" || ai.Password != "" ||
+		len(ai.ClientCertificateData) > 0 || ai.ClientCertificate != "" ||
+		len(ai.ClientKeyData) > 0 || ai.ClientKey != "" ||
+		ai.AuthProvider != nil || ai.Exec != nil
+}
+
+func sortedClusters(m map[string]*api.Cluster) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubecfg
+
+import (
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestValidate(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	cases := []struct {
+		name       string
+		cfg        *api.Config
+		discovered []string
+		wantErr    bool
+	}{
+		{
+			name: "Valid",
+			cfg: &api.Config{
+				Clusters:       map[string]*api.Cluster{"prod": &api.Cluster{Server: srv.URL, CertificateAuthorityData: ca}},
+				Contexts:       map[string]*api.Context{"prod": &api.Context{Cluster: "prod"}},
+				CurrentContext: "prod",
+			},
+		},
+		{
+			name: "MissingServer",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{"prod": &api.Cluster{}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "MissingServerDiscovered",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{"prod": &api.Cluster{}},
+			},
+			discovered: []string{"prod"},
+		},
+		{
+			name: "BadServer",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: "prod.example.org:443"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "BadCA",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: srv.URL, CertificateAuthorityData: []byte("not a cert")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "MissingCurrentContext",
+			cfg: &api.Config{
+				Clusters:       map[string]*api.Cluster{"prod": &api.Cluster{Server: srv.URL}},
+				CurrentContext: "prod",
+			},
+			wantErr: true,
+		},
+		{
+			name: "ContextMissingCluster",
+			cfg: &api.Config{
+				Clusters: map[string]*api.Cluster{"prod": &api.Cluster{Server: srv.URL}},
+				Contexts: map[string]*api.Context{"staging": &api.Context{Cluster: "staging"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "EmbeddedCredentials",
+			cfg: &api.Config{
+				Clusters:  map[string]*api.Cluster{"prod": &api.Cluster{Server: srv.URL}},
+				AuthInfos: map[string]*api.AuthInfo{"admin": &api.AuthInfo{Token: "secret"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Templates{&Template{Name: tt.name, Config: tt.cfg}}.Validate(tt.discovered...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(): want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
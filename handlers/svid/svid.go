@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package svid
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/auth/spiffe"
+	"github.com/planetlabs/kubehook/handlers"
+	"github.com/planetlabs/kubehook/lifetime"
+
+	"github.com/pkg/errors"
+)
+
+type req struct {
+	Lifetime lifetime.Duration `json:"lifetime"`
+}
+
+type rsp struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Handler returns an HTTP handler function that generates a JSON web token for
+// a workload presenting an X.509-SVID. The SVID is verified against the supplied
+// SPIFFE trust bundle, regardless of any other CAs trusted by the TLS listener.
+func Handler(g auth.Generator, m *spiffe.Mapper, bundle *x509.CertPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		req := &req{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot parse JSON request body").Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.Lifetime == 0 {
+			write(w, rsp{Error: "must specify desired token lifetime"}, http.StatusBadRequest)
+			return
+		}
+
+		c, err := handlers.VerifyClientCert(r, bundle)
+		if err != nil {
+			write(w, rsp{Error: "must present a verified X.509-SVID"}, http.StatusUnauthorized)
+			return
+		}
+		id, err := spiffe.IDFromSVID(c)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "invalid X.509-SVID").Error()}, http.StatusUnauthorized)
+			return
+		}
+
+		u, err := m.User(id)
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot map SPIFFE ID to user").Error()}, http.StatusForbidden)
+			return
+		}
+
+		t, _, err := g.Generate(u, time.Duration(req.Lifetime), auth.Source(auth.SourceSVID))
+		if err != nil {
+			write(w, rsp{Error: errors.Wrap(err, "cannot generate token").Error()}, handlers.GenerateStatus(err))
+			return
+		}
+
+		write(w, rsp{Token: t}, http.StatusOK)
+	}
+}
+
+func write(w http.ResponseWriter, r rsp, httpStatus int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(r) // nolint: gosec
+}
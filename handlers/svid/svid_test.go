@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package svid
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/planetlabs/kubehook/auth/noop"
+	"github.com/planetlabs/kubehook/auth/spiffe"
+	"github.com/planetlabs/kubehook/lifetime"
+)
+
+var noGroups = []string{}
+
+type ca struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) *ca {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...): %v", err)
+	}
+	return &ca{cert: c, key: key}
+}
+
+// svid returns the TLS state of a client presenting a certificate with the
+// supplied URI SAN, signed by the supplied CA.
+func (c *ca) svid(t *testing.T, uri string) *tls.ConnectionState {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(...): %v", err)
+	}
+	u, _ := url.Parse(uri)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{u},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, c.cert, &key.PublicKey, c.key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate(...): %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate(...): %v", err)
+	}
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+}
+
+func TestHandler(t *testing.T) {
+	bundle := newCA(t)
+	clientCA := newCA(t)
+	svid := func(uri string) *tls.ConnectionState { return bundle.svid(t, uri) }
+
+	cases := []struct {
+		name   string
+		tls    *tls.ConnectionState
+		req    *req
+		status int
+		rsp    *rsp
+	}{
+		{
+			name:   "Success",
+			tls:    svid("spiffe://example.org/ns/default/sa/deployer"),
+			req:    &req{Lifetime: 10 * lifetime.Minute},
+			status: http.StatusOK,
+			rsp:    &rsp{Token: "spiffe:default:deployer"},
+		},
+		{
+			name:   "NoTLS",
+			req:    &req{Lifetime: 10 * lifetime.Minute},
+			status: http.StatusUnauthorized,
+			rsp:    &rsp{Error: "must present a verified X.509-SVID"},
+		},
+		{
+			name:   "SignedByOtherCA",
+			tls:    clientCA.svid(t, "spiffe://example.org/ns/default/sa/deployer"),
+			req:    &req{Lifetime: 10 * lifetime.Minute},
+			status: http.StatusUnauthorized,
+			rsp:    &rsp{Error: "must present a verified X.509-SVID"},
+		},
+		{
+			name:   "NotSVID",
+			tls:    svid("https://example.org"),
+			req:    &req{Lifetime: 10 * lifetime.Minute},
+			status: http.StatusUnauthorized,
+			rsp:    &rsp{Error: "invalid X.509-SVID: URI https://example.org does not use the spiffe scheme"},
+		},
+		{
+			name:   "NoMatchingRule",
+			tls:    svid("spiffe://example.net/billing"),
+			req:    &req{Lifetime: 10 * lifetime.Minute},
+			status: http.StatusForbidden,
+			rsp:    &rsp{Error: "cannot map SPIFFE ID to user: no rule matches SPIFFE ID spiffe://example.net/billing"},
+		},
+		{
+			name:   "MissingLifetime",
+			tls:    svid("spiffe://example.org/ns/default/sa/deployer"),
+			req:    &req{},
+			status: http.StatusBadRequest,
+			rsp:    &rsp{Error: "must specify desired token lifetime"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := noop.NewManager(noGroups)
+			if err != nil {
+				t.Fatalf("noop.NewManager(%v): %v", noGroups, err)
+			}
+			m, err := spiffe.NewMapper(&spiffe.Rules{Rules: []spiffe.Rule{{
+				ID:       "spiffe://example.org/ns/*/sa/*",
+				Username: "spiffe:{{index .Segments 1}}:{{index .Segments 3}}",
+			}}})
+			if err != nil {
+				t.Fatalf("spiffe.NewMapper(...): %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			body, err := json.Marshal(tt.req)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+#v): %v", tt.req, err)
+			}
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			r.TLS = tt.tls
+
+			roots := x509.NewCertPool()
+			roots.AddCert(bundle.cert)
+			Handler(g, m, roots)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v", tt.status, w.Code)
+			}
+
+			rsp := &rsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %s): %v", w.Body, rsp, err)
+			}
+
+			if diff := deep.Equal(tt.rsp, rsp); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package tokens
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/handlers"
+
+	"github.com/pkg/errors"
+)
+
+type listRsp struct {
+	Tokens []auth.Token `json:"tokens,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+type revokeReq struct {
+	ID string `json:"id"`
+}
+
+type revokeRsp struct {
+	Error string `json:"error,omitempty"`
+}
+
+// List returns an HTTP handler function that lists the unexpired tokens issued
+// to the requesting user.
+func List(l auth.Lister, h handlers.AuthHeaders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		u, err := h.Extract(r)
+		if err != nil {
+			write(w, listRsp{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		ts, err := l.List(u.Username)
+		if err != nil {
+			write(w, listRsp{Error: errors.Wrap(err, "cannot list tokens").Error()}, http.StatusInternalServerError)
+			return
+		}
+		write(w, listRsp{Tokens: ts}, http.StatusOK)
+	}
+}
+
+// Revoke returns an HTTP handler function that revokes a token issued to the
+// requesting user. Requests must be JSON requests from the origin of the
+// supplied external URL, or from the origin at which they reached kubehook if
+// no external URL is supplied.
+func Revoke(rv auth.Revoker, h handlers.AuthHeaders, externalURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if err := handlers.CheckSameOrigin(r, externalURL); err != nil {
+			write(w, revokeRsp{Error: err.Error()}, http.StatusForbidden)
+			return
+		}
+
+		req := &revokeReq{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			write(w, revokeRsp{Error: errors.Wrap(err, "cannot parse JSON request body").Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" {
+			write(w, revokeRsp{Error: "must specify the ID of the token to revoke"}, http.StatusBadRequest)
+			return
+		}
+
+		u, err := h.Extract(r)
+		if err != nil {
+			write(w, revokeRsp{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		if err := rv.Revoke(u.Username, req.ID); err != nil {
+			write(w, revokeRsp{Error: errors.Wrap(err, "cannot revoke token").Error()}, http.StatusNotFound)
+			return
+		}
+		write(w, revokeRsp{}, http.StatusOK)
+	}
+}
+
+func write(w http.ResponseWriter, v interface{}, httpStatus int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(v) // nolint: gosec
+}
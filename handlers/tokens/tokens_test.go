@@ -0,0 +1,202 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package tokens
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/pkg/errors"
+	"github.com/planetlabs/kubehook/auth"
+	"github.com/planetlabs/kubehook/handlers"
+)
+
+const user = "user"
+
+var issued = time.Unix(1000000, 0).UTC()
+
+var h = handlers.AuthHeaders{
+	User:           handlers.DefaultUserHeader,
+	Group:          handlers.DefaultGroupHeader,
+	GroupDelimiter: handlers.DefaultGroupHeaderDelimiter,
+}
+
+type predictableManager struct {
+	tokens []auth.Token
+	err    error
+}
+
+func (m *predictableManager) List(username string) ([]auth.Token, error) {
+	return m.tokens, m.err
+}
+
+func (m *predictableManager) Revoke(username, id string) error {
+	return m.err
+}
+
+func TestList(t *testing.T) {
+	token := auth.Token{ID: "a", User: auth.User{Username: user}, IssuedAt: issued, ExpiresAt: issued.Add(time.Hour)}
+
+	cases := []struct {
+		name   string
+		head   map[string]string
+		m      *predictableManager
+		status int
+		rsp    *listRsp
+	}{
+		{
+			name:   "Success",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			m:      &predictableManager{tokens: []auth.Token{token}},
+			status: http.StatusOK,
+			rsp:    &listRsp{Tokens: []auth.Token{token}},
+		},
+		{
+			name:   "MissingUsernameHeader",
+			head:   map[string]string{"some-header": "value"},
+			m:      &predictableManager{},
+			status: http.StatusBadRequest,
+			rsp:    &listRsp{Error: fmt.Sprintf("cannot extract username from header %s", handlers.DefaultUserHeader)},
+		},
+		{
+			name:   "ListError",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			m:      &predictableManager{err: errors.New("boom")},
+			status: http.StatusInternalServerError,
+			rsp:    &listRsp{Error: "cannot list tokens: boom"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+
+			List(tt.m, h)(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v", tt.status, w.Code)
+			}
+
+			rsp := &listRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+			}
+
+			if diff := deep.Equal(tt.rsp, rsp); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	cases := []struct {
+		name   string
+		head   map[string]string
+		req    *revokeReq
+		m      *predictableManager
+		status int
+		rsp    *revokeRsp
+	}{
+		{
+			name:   "Success",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			req:    &revokeReq{ID: "a"},
+			m:      &predictableManager{},
+			status: http.StatusOK,
+			rsp:    &revokeRsp{},
+		},
+		{
+			name:   "MissingID",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			req:    &revokeReq{},
+			m:      &predictableManager{},
+			status: http.StatusBadRequest,
+			rsp:    &revokeRsp{Error: "must specify the ID of the token to revoke"},
+		},
+		{
+			name:   "MissingUsernameHeader",
+			head:   map[string]string{"some-header": "value"},
+			req:    &revokeReq{ID: "a"},
+			m:      &predictableManager{},
+			status: http.StatusBadRequest,
+			rsp:    &revokeRsp{Error: fmt.Sprintf("cannot extract username from header %s", handlers.DefaultUserHeader)},
+		},
+		{
+			name:   "NotFound",
+			head:   map[string]string{handlers.DefaultUserHeader: user},
+			req:    &revokeReq{ID: "a"},
+			m:      &predictableManager{err: errors.New("token not found")},
+			status: http.StatusNotFound,
+			rsp:    &revokeRsp{Error: "cannot revoke token: token not found"},
+		},
+		{
+			name:   "CrossOrigin",
+			head:   map[string]string{handlers.DefaultUserHeader: user, "Origin": "https://evil.example.org"},
+			req:    &revokeReq{ID: "a"},
+			m:      &predictableManager{},
+			status: http.StatusForbidden,
+			rsp:    &revokeRsp{Error: "requests from origin https://evil.example.org are not allowed"},
+		},
+		{
+			name:   "NotJSON",
+			head:   map[string]string{handlers.DefaultUserHeader: user, "Content-Type": "application/x-www-form-urlencoded"},
+			req:    &revokeReq{ID: "a"},
+			m:      &predictableManager{},
+			status: http.StatusForbidden,
+			rsp:    &revokeRsp{Error: "request body must be application/json"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			body, err := json.Marshal(tt.req)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+#v): %v", tt.req, err)
+			}
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			for k, v := range tt.head {
+				r.Header.Set(k, v)
+			}
+
+			Revoke(tt.m, h, "")(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("w.Code: want %v, got %v", tt.status, w.Code)
+			}
+
+			rsp := &revokeRsp{}
+			if err := json.Unmarshal(w.Body.Bytes(), rsp); err != nil {
+				t.Fatalf("json.Unmarshal(%v, %+v): %v", w.Body, rsp, err)
+			}
+
+			if diff := deep.Equal(tt.rsp, rsp); diff != nil {
+				t.Errorf("want != got: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	// Register encoding of unknown kubeconfig extensions.
+	_ "github.com/planetlabs/kubehook/kubeconfig/unknown"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// ExtensionName is the name of the extension that marks kubeconfig entries
+// merged by kubehook.
+const ExtensionName = "kubehook"
+
+// DefaultLifetime of the tokens in fetched kubeconfig files.
+const DefaultLifetime = 24 * time.Hour
+
+// DefaultTimeout of requests to fetch kubeconfig files.
+const DefaultTimeout = 30 * time.Second
+
+// backupSuffix is appended, along with a timestamp, to backups of kubeconfig
+// files.
+const backupSuffix = ".kubehook-backup-"
+
+// Extension marks a kubeconfig entry as owned by a kubehook server.
+type Extension struct {
+	Server string `json:"server"`
+}
+
+// Fetch a kubeconfig file from the kubehook server at the supplied URL. The
+// supplied headers are sent with the request, for example to authenticate with
+// a reverse proxy.
+func Fetch(hc *http.Client, server string, q url.Values, h http.Header) (*api.Config, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(server, "/")+"/kubecfg?"+q.Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	for k, vs := range h {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	rsp, err := hc.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch kubeconfig")
+	}
+	defer rsp.Body.Close()
+
+	b, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read kubeconfig")
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot fetch kubeconfig: %s: %s", rsp.Status, strings.TrimSpace(string(b)))
+	}
+	cfg, err := clientcmd.Load(b)
+	return cfg, errors.Wrap(err, "cannot parse kubeconfig")
+}
+
+// Merge the kubeconfig fetched from the supplied kubehook server into an
+// existing kubeconfig. Clusters, contexts, and users previously merged from the
+// same server are replaced. Merged entries may not replace entries that were
+// not merged from the same server. The existing current context is retained
+// unless it was replaced or unset.
+func Merge(existing, fetched *api.Config, server string) (*api.Config, error) {
+	c := existing.DeepCopy()
+	if c.Clusters == nil {
+		c.Clusters = make(map[string]*api.Cluster)
+	}
+	if c.Contexts == nil {
+		c.Contexts = make(map[string]*api.Context)
+	}
+	if c.AuthInfos == nil {
+		c.AuthInfos = make(map[string]*api.AuthInfo)
+	}
+
+	for name, cl := range c.Clusters {
+		if owned(cl.Extensions, server) {
+			delete(c.Clusters, name)
+		}
+	}
+	for name, ctx := range c.Contexts {
+		if owned(ctx.Extensions, server) {
+			delete(c.Contexts, name)
+		}
+	}
+	for name, ai := range c.AuthInfos {
+		if owned(ai.Extensions, server) {
+			delete(c.AuthInfos, name)
+		}
+	}
+
+	ext, err := json.Marshal(Extension{Server: server})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal extension")
+	}
+	mark := func(exts map[string]runtime.Object) map[string]runtime.Object {
+		if exts == nil {
+			exts = make(map[string]runtime.Object)
+		}
+		exts[ExtensionName] = &runtime.Unknown{Raw: ext, ContentType: runtime.ContentTypeJSON}
+		return exts
+	}
+
+	f := fetched.DeepCopy()
+	for name, cl := range f.Clusters {
+		if _, exists := c.Clusters[name]; exists {
+			return nil, errors.Errorf("cluster %s already exists and was not added by %s", name, server)
+		}
+		cl.Extensions = mark(cl.Extensions)
+		c.Clusters[name] = cl
+	}
+	for name, ctx := range f.Contexts {
+		if _, exists := c.Contexts[name]; exists {
+			return nil, errors.Errorf("context %s already exists and was not added by %s", name, server)
+		}
+		ctx.Extensions = mark(ctx.Extensions)
+		c.Contexts[name] = ctx
+	}
+	for name, ai := range f.AuthInfos {
+		if _, exists := c.AuthInfos[name]; exists {
+			return nil, errors.Errorf("user %s already exists and was not added by %s", name, server)
+		}
+		ai.Extensions = mark(ai.Extensions)
+		c.AuthInfos[name] = ai
+	}
+
+	if _, exists := c.Contexts[c.CurrentContext]; !exists {
+		c.CurrentContext = f.CurrentContext
+	}
+	return c, nil
+}
+
+func owned(exts map[string]runtime.Object, server string) bool {
+	u, ok := exts[ExtensionName].(*runtime.Unknown)
+	if !ok {
+		return false
+	}
+	e := &Extension{}
+	if err := json.Unmarshal(u.Raw, e); err != nil {
+		return false
+	}
+	return e.Server == server
+}
+
+// Load the kubeconfig file at the supplied path. An empty kubeconfig is
+// returned if the file does not exist.
+func Load(filename string) (*api.Config, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return api.NewConfig(), nil
+	}
+	cfg, err := clientcmd.LoadFromFile(filename)
+	return cfg, errors.Wrapf(err, "cannot load kubeconfig from %s", filename)
+}
+
+// Write the supplied kubeconfig to the supplied path, first backing up any
+// existing file. The path of the backup is returned, if one was made.
+func Write(cfg *api.Config, filename string) (string, error) {
+	backup, err := backupFile(filename)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot back up %s", filename)
+	}
+	return backup, errors.Wrapf(clientcmd.WriteToFile(*cfg, filename), "cannot write kubeconfig to %s", filename)
+}
+
+func backupFile(filename string) (string, error) {
+	src, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	backup := filename + backupSuffix + time.Now().UTC().Format("20060102T150405Z")
+	dst, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close() // nolint: gosec
+		return "", err
+	}
+	return backup, dst.Close()
+}
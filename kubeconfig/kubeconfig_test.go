@@ -0,0 +1,210 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package kubeconfig
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-test/deep"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const server = "https://kubehook.example.org"
+
+func fetchedConfig() *api.Config {
+	c := api.NewConfig()
+	c.Clusters["a"] = &api.Cluster{Server: "https://a"}
+	c.Contexts["a"] = &api.Context{Cluster: "a", AuthInfo: "kubehook"}
+	c.AuthInfos["kubehook"] = &api.AuthInfo{Token: "new"}
+	c.CurrentContext = "a"
+	return c
+}
+
+func names(c *api.Config) map[string][]string {
+	n := map[string][]string{}
+	for k := range c.Clusters {
+		n["clusters"] = append(n["clusters"], k)
+	}
+	for k := range c.Contexts {
+		n["contexts"] = append(n["contexts"], k)
+	}
+	for k := range c.AuthInfos {
+		n["users"] = append(n["users"], k)
+	}
+	for _, v := range n {
+		sort.Strings(v)
+	}
+	return n
+}
+
+func TestMerge(t *testing.T) {
+	// A config previously merged from our server, which should be replaced.
+	previous, err := Merge(api.NewConfig(), func() *api.Config {
+		c := api.NewConfig()
+		c.Clusters["old"] = &api.Cluster{Server: "https://old"}
+		c.Contexts["old"] = &api.Context{Cluster: "old", AuthInfo: "kubehook"}
+		c.AuthInfos["kubehook"] = &api.AuthInfo{Token: "old"}
+		c.CurrentContext = "old"
+		return c
+	}(), server)
+	if err != nil {
+		t.Fatalf("Merge(): %v", err)
+	}
+	previous.Clusters["mine"] = &api.Cluster{Server: "https://mine"}
+	previous.Contexts["mine"] = &api.Context{Cluster: "mine", AuthInfo: "me"}
+	previous.AuthInfos["me"] = &api.AuthInfo{Token: "mine"}
+
+	// A config merged from another kubehook server, which should be retained.
+	other, err := Merge(api.NewConfig(), func() *api.Config {
+		c := api.NewConfig()
+		c.Clusters["b"] = &api.Cluster{Server: "https://b"}
+		c.Contexts["b"] = &api.Context{Cluster: "b", AuthInfo: "kubehook-b"}
+		c.AuthInfos["kubehook-b"] = &api.AuthInfo{Token: "b"}
+		c.CurrentContext = "b"
+		return c
+	}(), "https://other.example.org")
+	if err != nil {
+		t.Fatalf("Merge(): %v", err)
+	}
+
+	conflicting := api.NewConfig()
+	conflicting.Clusters["a"] = &api.Cluster{Server: "https://elsewhere"}
+
+	cases := []struct {
+		name        string
+		existing    *api.Config
+		want        map[string][]string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{
+			name:        "Empty",
+			existing:    api.NewConfig(),
+			want:        map[string][]string{"clusters": {"a"}, "contexts": {"a"}, "users": {"kubehook"}},
+			wantCurrent: "a",
+		},
+		{
+			name:        "ReplacesPreviouslyMerged",
+			existing:    previous,
+			want:        map[string][]string{"clusters": {"a", "mine"}, "contexts": {"a", "mine"}, "users": {"kubehook", "me"}},
+			wantCurrent: "a",
+		},
+		{
+			name:        "RetainsOtherServers",
+			existing:    other,
+			want:        map[string][]string{"clusters": {"a", "b"}, "contexts": {"a", "b"}, "users": {"kubehook", "kubehook-b"}},
+			wantCurrent: "b",
+		},
+		{
+			name:     "ConflictsWithUnowned",
+			existing: conflicting,
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Merge(tc.existing, fetchedConfig(), server)
+			if err != nil {
+				if tc.wantErr {
+					return
+				}
+				t.Fatalf("Merge(): %v", err)
+			}
+			if tc.wantErr {
+				t.Fatalf("Merge(): want error, got nil")
+			}
+			if diff := deep.Equal(tc.want, names(got)); diff != nil {
+				t.Errorf("Merge(): want != got %v", diff)
+			}
+			if got.CurrentContext != tc.wantCurrent {
+				t.Errorf("Merge(): want current context %v, got %v", tc.wantCurrent, got.CurrentContext)
+			}
+			if got.AuthInfos["kubehook"].Token != "new" {
+				t.Errorf("Merge(): want token new, got %v", got.AuthInfos["kubehook"].Token)
+			}
+		})
+	}
+}
+
+func TestFetchMergeWrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/kubecfg" || r.URL.Query().Get("template") != "prod" || r.Header.Get("X-Forwarded-User") != "negz" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		y, err := clientcmd.Write(*fetchedConfig())
+		if err != nil {
+			t.Fatalf("clientcmd.Write(): %v", err)
+		}
+		w.Write(y) // nolint: gosec
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kubehook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config")
+
+	h := http.Header{"X-Forwarded-User": []string{"negz"}}
+	if _, err := Fetch(http.DefaultClient, srv.URL, url.Values{}, h); err == nil {
+		t.Errorf("Fetch(): want error for bad request, got nil")
+	}
+
+	for i, wantBackup := range []bool{false, true} {
+		fetched, err := Fetch(http.DefaultClient, srv.URL, url.Values{"template": []string{"prod"}}, h)
+		if err != nil {
+			t.Fatalf("Fetch(): %v", err)
+		}
+		existing, err := Load(filename)
+		if err != nil {
+			t.Fatalf("Load(%v): %v", filename, err)
+		}
+		merged, err := Merge(existing, fetched, srv.URL)
+		if err != nil {
+			t.Fatalf("Merge(): %v", err)
+		}
+		backup, err := Write(merged, filename)
+		if err != nil {
+			t.Fatalf("Write(): %v", err)
+		}
+		if (backup != "") != wantBackup {
+			t.Errorf("Write() %d: want backup %v, got %q", i, wantBackup, backup)
+		}
+	}
+
+	// Merging twice should have replaced, rather than conflicted with, the
+	// entries written by the first merge.
+	got, err := Load(filename)
+	if err != nil {
+		t.Fatalf("Load(%v): %v", filename, err)
+	}
+	want := map[string][]string{"clusters": {"a"}, "contexts": {"a"}, "users": {"kubehook"}}
+	if diff := deep.Equal(want, names(got)); diff != nil {
+		t.Errorf("Load(): want != got %v", diff)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+// Package unknown teaches clientcmd to encode kubeconfig extensions it does
+// not know. clientcmd decodes such extensions as runtime.Unknown, but cannot
+// encode them again. Import this package for its side effects wherever
+// kubeconfigs carrying extensions are written.
+package unknown
+
+import (
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd/api/latest"
+)
+
+func init() {
+	if err := latest.Scheme.AddConversionFuncs(encode); err != nil {
+		panic(err)
+	}
+}
+
+func encode(in *runtime.Unknown, out *runtime.RawExtension, s conversion.Scope) error {
+	out.Raw = in.Raw
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package lifetime
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An Expiry is a requested token lifetime, expressed either as a Duration or
+// as the time at which the token should expire.
+type Expiry struct {
+	Lifetime  Duration  `json:"lifetime,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// ParseExpiry parses an Expiry from a lifetime in any format accepted by
+// ParseDuration and an RFC 3339 expiry time. Either may be empty.
+func ParseExpiry(lifetime, expiresAt string) (Expiry, error) {
+	e := Expiry{}
+	if lifetime != "" {
+		d, err := ParseDuration(lifetime)
+		if err != nil {
+			return Expiry{}, errors.Wrap(err, "cannot parse lifetime")
+		}
+		e.Lifetime = d
+	}
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return Expiry{}, errors.Wrap(err, "cannot parse expiry time")
+		}
+		e.ExpiresAt = t
+	}
+	return e, nil
+}
+
+// Resolve returns the lifetime of a token that becomes valid at the supplied
+// time. Exactly one of a lifetime or an expiry time must be specified. The
+// lifetime must be positive, and the expiry time must be after the supplied
+// time.
+func (e Expiry) Resolve(now time.Time) (Duration, error) {
+	switch {
+	case e.Lifetime != 0 && !e.ExpiresAt.IsZero():
+		return 0, errors.New("must specify either a lifetime or an expiry time, not both")
+	case e.Lifetime < 0:
+		return 0, errors.Errorf("lifetime %s is not positive", e.Lifetime)
+	case e.Lifetime != 0:
+		return e.Lifetime, nil
+	case !e.ExpiresAt.IsZero():
+		if !e.ExpiresAt.After(now) {
+			return 0, errors.Errorf("expiry time %s is not after the token becomes valid", e.ExpiresAt.Format(time.RFC3339))
+		}
+		return Duration(e.ExpiresAt.Sub(now)), nil
+	default:
+		return 0, errors.New("must specify a lifetime or an expiry time")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package lifetime
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		lifetime  string
+		expiresAt string
+		want      Duration
+		wantErr   bool
+	}{
+		{name: "Lifetime", lifetime: "1d", want: 24 * Hour},
+		{name: "ExpiresAt", expiresAt: "2018-06-01T18:30:00Z", want: 6*Hour + 30*Minute},
+		{name: "ExpiresAtOffset", expiresAt: "2018-06-01T18:30:00+02:00", want: 4*Hour + 30*Minute},
+		{name: "Past", expiresAt: "2018-06-01T11:00:00Z", wantErr: true},
+		{name: "Both", lifetime: "1h", expiresAt: "2018-06-01T18:30:00Z", wantErr: true},
+		{name: "Neither", wantErr: true},
+		{name: "ZeroLifetime", lifetime: "0s", wantErr: true},
+		{name: "NegativeLifetime", lifetime: "-1d", wantErr: true},
+		{name: "BadLifetime", lifetime: "soon", wantErr: true},
+		{name: "BadExpiresAt", expiresAt: "Friday", wantErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := func() (Duration, error) {
+				e, err := ParseExpiry(tt.lifetime, tt.expiresAt)
+				if err != nil {
+					return 0, err
+				}
+				return e.Resolve(now)
+			}()
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("Resolve(): %v", err)
+			}
+			if tt.wantErr {
+				t.Fatalf("Resolve(): want error, got %v", got)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve(): want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExpiryUnmarshalJSON(t *testing.T) {
+	e := Expiry{}
+	if err := json.Unmarshal([]byte(`{"expiresAt": "2018-06-01T18:30:00Z"}`), &e); err != nil {
+		t.Fatalf("json.Unmarshal(): %v", err)
+	}
+	got, err := e.Resolve(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("e.Resolve(): %v", err)
+	}
+	if want := 6*Hour + 30*Minute; got != want {
+		t.Errorf("e.Resolve(): want %v, got %v", want, got)
+	}
+}
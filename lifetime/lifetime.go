@@ -18,11 +18,17 @@ package lifetime
 
 import (
 	"encoding/json"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 // A Duration is like a time.Duration, except it marshals to a
-// time.ParseDuration compatible string.
+// time.ParseDuration compatible string and may be parsed from a richer grammar.
 type Duration int64
 
 // Common durations.
@@ -33,6 +39,21 @@ const (
 	Second               = 1000 * Millisecond
 	Minute               = 60 * Second
 	Hour                 = 60 * Minute
+	Day                  = 24 * Hour
+	Week                 = 7 * Day
+)
+
+// units that time.ParseDuration does not support.
+var units = map[string]Duration{
+	"d": Day,
+	"w": Week,
+}
+
+var (
+	term = regexp.MustCompile(`^(\d+(?:\.\d*)?|\.\d+)(ns|us|µs|μs|ms|s|m|h|d|w)`)
+
+	// ISO 8601 durations, excluding years and months, whose length varies.
+	iso8601 = regexp.MustCompile(`^P(?:(\d+(?:[.,]\d+)?)W)?(?:(\d+(?:[.,]\d+)?)D)?(?:T(?:(\d+(?:[.,]\d+)?)H)?(?:(\d+(?:[.,]\d+)?)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
 )
 
 // String representation of a Duration.
@@ -40,14 +61,95 @@ func (d Duration) String() string {
 	return time.Duration(d).String()
 }
 
-// ParseDuration parses a string with time.ParseDuration, but returns a
-// lifetime.Duration.
+// ParseDuration parses a duration. It accepts anything time.ParseDuration
+// does, the additional units d (24 hours) and w (7 days) in any combination,
+// e.g. 1w2d12h, and ISO 8601 durations such as P7D, PT8H or P1DT12H. ISO 8601
+// years and months are not supported.
 func ParseDuration(s string) (Duration, error) {
-	td, err := time.ParseDuration(s)
+	if strings.HasPrefix(strings.ToUpper(s), "P") {
+		return parseISO8601(s)
+	}
+
+	orig := s
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	if s == "0" {
+		return 0, nil
+	}
+	if s == "" {
+		return 0, errors.Errorf("invalid duration %q", orig)
+	}
+
+	var total Duration
+	for s != "" {
+		m := term.FindStringSubmatch(s)
+		if m == nil {
+			return 0, errors.Errorf("invalid duration %q", orig)
+		}
+		d, err := parseTerm(m[1], m[2])
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid duration %q", orig)
+		}
+		if total, err = add(total, d); err != nil {
+			return 0, errors.Wrapf(err, "invalid duration %q", orig)
+		}
+		s = s[len(m[0]):]
+	}
+	if neg {
+		total = -total
+	}
+	return total, nil
+}
+
+func parseISO8601(s string) (Duration, error) {
+	m := iso8601.FindStringSubmatch(strings.ToUpper(s))
+	if m == nil || s == "P" || strings.HasSuffix(strings.ToUpper(s), "T") {
+		return 0, errors.Errorf("invalid ISO 8601 duration %q", s)
+	}
+	var total Duration
+	for i, unit := range []string{"w", "d", "h", "m", "s"} {
+		if m[i+1] == "" {
+			continue
+		}
+		d, err := parseTerm(strings.Replace(m[i+1], ",", ".", 1), unit)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid ISO 8601 duration %q", s)
+		}
+		if total, err = add(total, d); err != nil {
+			return 0, errors.Wrapf(err, "invalid ISO 8601 duration %q", s)
+		}
+	}
+	return total, nil
+}
+
+// parseTerm parses a single unsigned number and unit. Units supported by
+// time.ParseDuration are parsed exactly; days and weeks may lose precision
+// below a nanosecond.
+func parseTerm(num, unit string) (Duration, error) {
+	u, ok := units[unit]
+	if !ok {
+		d, err := time.ParseDuration(num + unit)
+		return Duration(d), err
+	}
+	v, err := strconv.ParseFloat(num, 64)
 	if err != nil {
 		return 0, err
 	}
-	return Duration(td), nil
+	f := v * float64(u)
+	if f >= math.MaxInt64 {
+		return 0, errors.New("duration is out of range")
+	}
+	return Duration(math.Round(f)), nil
+}
+
+func add(a, b Duration) (Duration, error) {
+	if a > math.MaxInt64-b {
+		return 0, errors.New("duration is out of range")
+	}
+	return a + b, nil
 }
 
 // MarshalJSON marshals a Duration into a time.ParseDuration compatible string.
@@ -55,8 +157,8 @@ func (d Duration) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + d.String() + `"`), nil
 }
 
-// UnmarshalJSON unmarshals a Duration from a time.ParseDuration compatible
-// string.
+// UnmarshalJSON unmarshals a Duration from a string in any format accepted by
+// ParseDuration.
 func (d *Duration) UnmarshalJSON(data []byte) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
@@ -71,3 +173,14 @@ func (d *Duration) UnmarshalJSON(data []byte) error {
 	*d = p
 	return nil
 }
+
+// Set a Duration from a string in any format accepted by ParseDuration. It
+// allows a Duration to be used as a command line flag value.
+func (d *Duration) Set(s string) error {
+	p, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = p
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Planet Labs Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+implied. See the License for the specific language governing permissions
+and limitations under the License.
+*/
+
+package lifetime
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDuration(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    Duration
+		wantErr bool
+	}{
+		{s: "0", want: 0},
+		{s: "1h30m", want: Hour + 30*Minute},
+		{s: "1.5h", want: Hour + 30*Minute},
+		{s: "-2m", want: -2 * Minute},
+		{s: "300ms", want: 300 * Millisecond},
+		{s: "7d", want: 7 * 24 * Hour},
+		{s: "1w", want: 168 * Hour},
+		{s: "1w2d12h", want: 9*24*Hour + 12*Hour},
+		{s: "1.5d", want: 36 * Hour},
+		{s: "2d1.5h", want: 49*Hour + 30*Minute},
+		{s: "P7D", want: 7 * 24 * Hour},
+		{s: "PT8H", want: 8 * Hour},
+		{s: "P1W", want: 168 * Hour},
+		{s: "P1DT12H30M", want: 36*Hour + 30*Minute},
+		{s: "PT0.5S", want: 500 * Millisecond},
+		{s: "PT1,5H", want: Hour + 30*Minute},
+		{s: "pt8h", want: 8 * Hour},
+		{s: "", wantErr: true},
+		{s: "7", wantErr: true},
+		{s: "1y", wantErr: true},
+		{s: "1d foo", wantErr: true},
+		{s: "P", wantErr: true},
+		{s: "PT", wantErr: true},
+		{s: "P1M", wantErr: true},
+		{s: "P1Y", wantErr: true},
+		{s: "P1DT", wantErr: true},
+		{s: "100000000w", wantErr: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseDuration(tt.s)
+			if err != nil {
+				if tt.wantErr {
+					return
+				}
+				t.Fatalf("ParseDuration(%q): %v", tt.s, err)
+			}
+			if tt.wantErr {
+				t.Fatalf("ParseDuration(%q): want error, got %v", tt.s, got)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDuration(%q): want %v, got %v", tt.s, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	for _, s := range []string{"1w", "P1DT0.000000001S", "8760h0m0.000000001s", "-90m"} {
+		t.Run(s, func(t *testing.T) {
+			want, err := ParseDuration(s)
+			if err != nil {
+				t.Fatalf("ParseDuration(%q): %v", s, err)
+			}
+			b, err := json.Marshal(want)
+			if err != nil {
+				t.Fatalf("json.Marshal(%v): %v", want, err)
+			}
+			var got Duration
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("json.Unmarshal(%s): %v", b, err)
+			}
+			if got != want {
+				t.Errorf("json.Unmarshal(%s): want %v, got %v", b, want, got)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	d := new(Duration)
+	if err := d.Set("P1W"); err != nil {
+		t.Fatalf("d.Set(P1W): %v", err)
+	}
+	if *d != Week {
+		t.Errorf("d.Set(P1W): want %v, got %v", Week, *d)
+	}
+	if err := d.Set(d.String()); err != nil || *d != Week {
+		t.Errorf("d.Set(%v): want %v, got %v (%v)", d, Week, *d, err)
+	}
+	if err := d.Set("fortnight"); err == nil {
+		t.Errorf("d.Set(fortnight): want error, got nil")
+	}
+}